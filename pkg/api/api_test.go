@@ -54,7 +54,10 @@ func setupTest(t *testing.T) http.Handler {
 
 	//create test driver with the domains and projects from start-data.sql
 	keystone := identity.Mock{}
-	storage := storage.Mock{}
+	storage, err := storage.NewMemoryFromFile("../test/events.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
 	configdb := configdb.Mock{}
 	router, _ := NewV1Router(keystone, storage, configdb)
 	return router
@@ -77,7 +80,7 @@ func Test_APIGetEventDetails(t *testing.T) {
 
 	test.APIRequest{
 		Method:           "GET",
-		Path:             "/v1/events/d5eed458-6666-58ec-ad06-8d3cf6bafca1",
+		Path:             "/v1/events/5a32c2f3-2996-4f46-819c-6197cf06037e",
 		ExpectStatusCode: 200,
 		ExpectJSON:       "fixtures/event-details.json",
 	}.Check(t, router)
@@ -89,9 +92,401 @@ func Test_APIGetEventList(t *testing.T) {
 
 	test.APIRequest{
 		Method:           "GET",
-		Path:             "/v1/events?event_type=identity.project.deleted&offset=10",
+		Path:             "/v1/events?event_type=identity.project.deleted&offset=4&limit=4",
 		ExpectStatusCode: 200,
 		ExpectJSON:       "fixtures/event-list.json",
 	}.Check(t, router)
 
 }
+
+func Test_APIGetEventListFiltered(t *testing.T) {
+	router := setupTest(t)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?source=compute&sort=time:asc&time=gte:2017-05-03T00:00:00",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-filtered.json",
+	}.Check(t, router)
+
+	// Only the events of the requested project
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?project_id=6a030751147a45c0863c3b5bde32c744&sort=time:asc",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-filtered.json",
+	}.Check(t, router)
+}
+
+func Test_APIGetEventListTime(t *testing.T) {
+	router := setupTest(t)
+
+	// The same events as with time=gte:2017-05-03T00:00:00
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?source=compute&sort=time:asc&time=gte:2017-05-03T02:00:00%2B02:00||/d,lt:now",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-filtered.json",
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?source=compute&sort=time:asc&time=gte:2017-05-02T20:00:00&time_zone=-04:00",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-filtered.json",
+	}.Check(t, router)
+
+	for _, query := range []string{"time=gte:garbage", "time=lt:now-1x", "time=gte:now-1d&time_zone=Nowhere"} {
+		test.APIRequest{
+			Method:           "GET",
+			Path:             "/v1/events?" + query,
+			ExpectStatusCode: 400,
+		}.Check(t, router)
+	}
+}
+
+func Test_APIGetEventListQuery(t *testing.T) {
+	router := setupTest(t)
+
+	// The same events as with source=compute
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?q=event_type:compute.*+AND+NOT+outcome:pending&sort=time:asc",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-filtered.json",
+	}.Check(t, router)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?q=password:secret",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?q=(outcome:failure",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+}
+
+func Test_APIGetEventListAttributeFilters(t *testing.T) {
+	router := setupTest(t)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?outcome=failure&initiator_address=10.0.0.0/24&observer_type=service/compute&resource_id=8d0b4f3e-1c2a-4e6b-9f7d-2a3b4c5d6e7f",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-failed.json",
+	}.Check(t, router)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?initiator_address=10.0.0.0/33",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+}
+
+func Test_APIGetEventListValueLists(t *testing.T) {
+	router := setupTest(t)
+
+	// The same events as with source=compute
+	for _, query := range []string{
+		"event_type=compute.instance.create.end,compute.instance.delete.end",
+		"event_type=!identity&initiator_address=!100.64.0.0/16",
+		"event_type=*.end",
+	} {
+		test.APIRequest{
+			Method:           "GET",
+			Path:             "/v1/events?" + query + "&sort=time:asc",
+			ExpectStatusCode: 200,
+			ExpectJSON:       "fixtures/event-list-filtered.json",
+		}.Check(t, router)
+	}
+
+	for _, query := range []string{"event_type=!", "initiator_address=10.0.0.1,!10.0.0.0/33"} {
+		test.APIRequest{
+			Method:           "GET",
+			Path:             "/v1/events?" + query,
+			ExpectStatusCode: 400,
+		}.Check(t, router)
+	}
+}
+
+func Test_APIGetEventListFacets(t *testing.T) {
+	router := setupTest(t)
+
+	// The facets count all matching events, not only those on the page
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?source=compute&limit=1&facets=event_type,outcome,resource_type,initiator.user_id",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-facets.json",
+	}.Check(t, router)
+
+	for _, query := range []string{"facets=payload.outcome", "facets=outcome&facet_limit=1001"} {
+		test.APIRequest{
+			Method:           "GET",
+			Path:             "/v1/events?" + query,
+			ExpectStatusCode: 400,
+		}.Check(t, router)
+	}
+}
+
+func Test_APIGetEventListNames(t *testing.T) {
+	router := setupTest(t)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?user_name=admin@monsoon3&sort=time:asc",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-filtered.json",
+	}.Check(t, router)
+
+	// Unknown names are not an error, but no events have them
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?user_name=nobody",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-empty.json",
+	}.Check(t, router)
+
+	// Ambiguous names need a domain
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?user_name=admin",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?resource_name=my-server",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+}
+
+func Test_APIGetAudit(t *testing.T) {
+	router := setupTest(t)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/audit?project_id=b3b70c8271a845709f9a03030e705da7",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/audit-details.json",
+	}.Check(t, router)
+}
+
+func Test_APIPutAudit(t *testing.T) {
+	router := setupTest(t)
+
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/audit?project_id=b3b70c8271a845709f9a03030e705da7",
+		RequestJSON:      object{"tenant_id": "b3b70c8271a845709f9a03030e705da7", "enabled": false},
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/audit-put.json",
+	}.Check(t, router)
+
+	// Missing "enabled"
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/audit?project_id=b3b70c8271a845709f9a03030e705da7",
+		RequestJSON:      object{"tenant_id": "b3b70c8271a845709f9a03030e705da7"},
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+
+	// Body for a different tenant than the request
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/audit?project_id=b3b70c8271a845709f9a03030e705da7",
+		RequestJSON:      object{"tenant_id": "6a030751147a45c0863c3b5bde32c744", "enabled": true},
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+
+	// Not JSON at all
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/audit?project_id=b3b70c8271a845709f9a03030e705da7",
+		RequestJSON:      "enabled",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+}
+
+func Test_APIGetEventListCursor(t *testing.T) {
+	router := setupTest(t)
+
+	// Offsets beyond the storage's MaxLimit() are rejected...
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?offset=10000",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+
+	// ...but cursors are not
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?limit=3&cursor=eyJwb3MiOnsib2Zmc2V0IjoxNiwiYWZ0ZXIiOlsiMjAxNy0wNS0wMlQxMToxNDoyMS4xMDg4ODgrMDAwMCIsIjBjZDUyMzA3LWYwOWYtNDUzZi1iZjFiLTAyN2IyZjkwN2U5NCJdfX0",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-cursor.json",
+	}.Check(t, router)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?cursor=garbage",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+}
+
+func Test_APIGetEventListIncludeProjects(t *testing.T) {
+	router := setupTest(t)
+
+	// The domain alone only has the domain-level event...
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?domain_id=39a253e16e4a4a3686edca72c8e101bc&limit=3",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-domain.json",
+	}.Check(t, router)
+
+	// ...but the events of its projects can be included
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?domain_id=39a253e16e4a4a3686edca72c8e101bc&include_projects=true&sort=time:asc&limit=3",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-include-projects.json",
+	}.Check(t, router)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?project_id=6a030751147a45c0863c3b5bde32c744&include_projects=true",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?domain_id=39a253e16e4a4a3686edca72c8e101bc&include_projects=all",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+}
+
+func Test_APIGetEventListAllTenants(t *testing.T) {
+	router := setupTest(t)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?all_tenants=true&sort=time:asc&limit=3",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-all-tenants.json",
+	}.Check(t, router)
+
+	// project_id and domain_id are lists of tenants to filter by
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?all_tenants=true&project_id=6a030751147a45c0863c3b5bde32c744,does-not-exist&domain_id=39a253e16e4a4a3686edca72c8e101bc",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-list-tenant-filter.json",
+	}.Check(t, router)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?all_tenants=yes",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?all_tenants=true&include_projects=true",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+
+	// Searching all tenants requires its own policy rule
+	policyEnforcer, err := policy.NewEnforcer(map[string]string{"event:list": "@"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("hermes.PolicyEnforcer", policyEnforcer)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events?all_tenants=true",
+		ExpectStatusCode: 403,
+	}.Check(t, router)
+}
+
+func Test_APIGetEventHistogram(t *testing.T) {
+	router := setupTest(t)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events/histogram?interval=1h&split_by=event_type&time=gte:2017-05-02T10:00:00,lt:2017-05-02T13:00:00",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/event-histogram.json",
+	}.Check(t, router)
+
+	// The histogram needs a lower bound of the time range
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events/histogram?interval=1h",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/events/histogram?time=gte:now-1d&split_by=resource_type",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+}
+
+func Test_APIGetAttributes(t *testing.T) {
+	router := setupTest(t)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/attributes",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/attribute-list.json",
+	}.Check(t, router)
+
+	// The values are counted among the events that match the filters of the list of events
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/attributes/event_type?limit=2&time=gte:2017-05-02T11:00:00",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/attribute-values.json",
+	}.Check(t, router)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/attributes/payload.target.id",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+}
+
+func Test_APIGetTopReport(t *testing.T) {
+	router := setupTest(t)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/reports/top?by=initiator.user_id&split_by=outcome&time=gte:2017-05-02T11:00:00",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/report-top.json",
+	}.Check(t, router)
+
+	for _, query := range []string{"", "by=event_type", "by=action&split_by=action", "by=action&limit=101"} {
+		test.APIRequest{
+			Method:           "GET",
+			Path:             "/v1/reports/top?" + query,
+			ExpectStatusCode: 400,
+		}.Check(t, router)
+	}
+}
+
+func Test_APIGetResourceEvents(t *testing.T) {
+	router := setupTest(t)
+
+	// The events of a deleted project, grouped by action
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/resources/b3b70c8271a845709f9a03030e705da7/events",
+		ExpectStatusCode: 200,
+		ExpectJSON:       "fixtures/resource-events.json",
+	}.Check(t, router)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/resources/b3b70c8271a845709f9a03030e705da7/events?resource_id=other",
+		ExpectStatusCode: 400,
+	}.Check(t, router)
+}
@@ -30,13 +30,12 @@ import (
 func (p *v1Provider) GetAudit(res http.ResponseWriter, req *http.Request) {
 	// QueryString - TenantId
 	token := p.CheckToken(req)
-	//if !token.Require(res, "audit:show") {
-	//	//return
-	//	//TODO - This is supposed to work, and isn't. So FIXME
-	//}
+	if !token.Require(res, "audit:show") {
+		return
+	}
 
 	tenantId, err := getTenantId(token, req, res)
-	if ReturnError(res, err) {
+	if err != nil {
 		return
 	}
 
@@ -57,18 +56,43 @@ func (p *v1Provider) GetAudit(res http.ResponseWriter, req *http.Request) {
 func (p *v1Provider) PutAudit(res http.ResponseWriter, req *http.Request) {
 	// Check Authorizations
 	token := p.CheckToken(req)
-	//if !token.Require(res, "audit:edit") {
-	//	//return
-	////	//TODO - This is supposed to work, and isn't. So FIXME
-	//}
+	if !token.Require(res, "audit:update") {
+		return
+	}
 
 	tenantId, err := getTenantId(token, req, res)
-	if ReturnError(res, err) {
+	if err != nil {
+		return
+	}
+	if tenantId == "" {
+		http.Error(res, "No tenant could be determined from the token or the request parameters", 400)
+		return
+	}
+
+	// Parse and validate the request body. Enabled is a pointer, so that we can
+	// tell the difference between "false" and "not given".
+	var input struct {
+		TenantID string `json:"tenant_id"`
+		Enabled  *bool  `json:"enabled"`
+	}
+	if !RequireJSON(res, req, &input) {
+		return
+	}
+	if input.Enabled == nil {
+		http.Error(res, "Missing required field: enabled", 400)
+		return
+	}
+	if input.TenantID != "" && input.TenantID != tenantId {
+		err := fmt.Errorf("tenant_id %s does not match the tenant %s of this request", input.TenantID, tenantId)
+		http.Error(res, err.Error(), 400)
 		return
 	}
 
-	auditconf, err := hermes.PutAudit(tenantId, p.configdb)
+	auditconf, err := hermes.PutAudit(tenantId, &hermes.AuditDetail{Enabled: *input.Enabled}, p.configdb)
 
+	if ReturnError(res, err) {
+		return
+	}
 	if auditconf == nil {
 		err := fmt.Errorf("Audit Configuration could not be found for tenant %s", tenantId)
 		http.Error(res, err.Error(), 404)
@@ -76,6 +100,3 @@ func (p *v1Provider) PutAudit(res http.ResponseWriter, req *http.Request) {
 	}
 	ReturnJSON(res, 200, auditconf)
 }
-
-//Check all the input, make sure they have permission to do it,
-// call the business logic, then convert to  json.
@@ -28,6 +28,7 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/sapcc/hermes/pkg/configdb"
+	"github.com/sapcc/hermes/pkg/hermes"
 	"github.com/sapcc/hermes/pkg/identity"
 	"github.com/sapcc/hermes/pkg/storage"
 )
@@ -86,8 +87,12 @@ func NewV1Router(keystone identity.Identity, storage storage.Storage, configdb c
 	})
 
 	r.Methods("GET").Path("/v1/events").HandlerFunc(p.ListEvents)
+	r.Methods("GET").Path("/v1/events/histogram").HandlerFunc(p.GetHistogram)
 	r.Methods("GET").Path("/v1/events/{event_id}").HandlerFunc(p.GetEventDetails)
+	r.Methods("GET").Path("/v1/attributes").HandlerFunc(p.ListAttributes)
 	r.Methods("GET").Path("/v1/attributes/{attribute_name}").HandlerFunc(p.GetAttributes)
+	r.Methods("GET").Path("/v1/reports/top").HandlerFunc(p.GetTopReport)
+	r.Methods("GET").Path("/v1/resources/{resource_id}/events").HandlerFunc(p.GetResourceEvents)
 	r.Methods("GET").Path("/v1/audit").HandlerFunc(p.GetAudit)
 	r.Methods("PUT").Path("/v1/audit").HandlerFunc(p.PutAudit)
 	return r, p.versionData
@@ -107,13 +112,19 @@ func ReturnJSON(w http.ResponseWriter, code int, data interface{}) {
 	}
 }
 
-//ReturnError produces an error response with HTTP status code 500 if the given
-//error is non-nil. Otherwise, nothing is done and false is returned.
+//ReturnError produces an error response with HTTP status code 500 (or 400 for
+//invalid user input) if the given error is non-nil. Otherwise, nothing is done
+//and false is returned.
 func ReturnError(w http.ResponseWriter, err error) bool {
 	if err == nil {
 		return false
 	}
 
+	switch err.(type) {
+	case hermes.InvalidInputError, storage.InvalidFilterError:
+		http.Error(w, err.Error(), 400)
+		return true
+	}
 	http.Error(w, err.Error(), 500)
 	return true
 }
@@ -26,11 +26,11 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/storage"
 	"github.com/sapcc/hermes/pkg/util"
 	"reflect"
 	"strconv"
 	"strings"
-	"time"
 )
 
 // EventList is the model for JSON returned by the ListEvents API call
@@ -39,21 +39,24 @@ type EventList struct {
 	PrevURL string              `json:"previous,omitempty"`
 	Events  []*hermes.ListEvent `json:"events"`
 	Total   int                 `json:"total"`
+	// Value counts of the requested facets among all matching events
+	Facets map[string]storage.AttributeValueList `json:"facets,omitempty"`
 }
 
 //ListEvents handles GET /v1/events.
 func (p *v1Provider) ListEvents(res http.ResponseWriter, req *http.Request) {
 	util.LogDebug("* api.ListEvents: Check token")
 	token := p.CheckToken(req)
-	if !token.Require(res, "event:list") {
+	util.LogDebug("api.ListEvents: Create filter")
+	filter, tenantId, ok := eventFilter(token, req, res)
+	if !ok {
 		return
 	}
 
-	// Figure out the data.Filter to use, based on the request parameters
-
 	// First off, parse the integers for offset & limit
 	offset, _ := strconv.ParseUint(req.FormValue("offset"), 10, 32)
 	limit, _ := strconv.ParseUint(req.FormValue("limit"), 10, 32)
+	facetLimit, _ := strconv.ParseUint(req.FormValue("facet_limit"), 10, 32)
 
 	// Parse the sort querystring
 	//slice of a struct, key and direction.
@@ -91,90 +94,58 @@ func (p *v1Provider) ListEvents(res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// Next, parse the elements of the time range filter
-	timeRange := make(map[string]string)
-	validOperators := map[string]bool{"lt": true, "lte": true, "gt": true, "gte": true}
-	timeParam := req.FormValue("time")
-	if timeParam != "" {
-		for _, timeElement := range strings.Split(timeParam, ",") {
-			keyVal := strings.SplitN(timeElement, ":", 2)
-			operator := keyVal[0]
-			if !validOperators[operator] {
-				err := errors.New(fmt.Sprintf("Time operator %s is not valid. Must be lt, lte, gt or gte.", operator))
-				http.Error(res, err.Error(), 400)
-				return
-			}
-			_, exists := timeRange[operator]
-			if exists {
-				err := errors.New(fmt.Sprintf("Time operator %s can only occur once", operator))
-				http.Error(res, err.Error(), 400)
-				return
-			}
-			if len(keyVal) != 2 {
-				err := errors.New(fmt.Sprintf("Time operator %s missing :<timestamp>", operator))
-				http.Error(res, err.Error(), 400)
-				return
-			}
-			validTimeFormats := []string{time.RFC3339, "2006-01-02T15:04:05-0700", "2006-01-02T15:04:05"}
-			var isValidTimeFormat bool
-			timeStr := keyVal[1]
-			for _, timeFormat := range validTimeFormats {
-				_, err := time.Parse(timeFormat, timeStr)
-				if err != nil {
-					isValidTimeFormat = true
-					break
-				}
-			}
-			if !isValidTimeFormat {
-				err := errors.New(fmt.Sprintf("Invalid time format: %s", timeStr))
-				http.Error(res, err.Error(), 400)
-				return
-			}
-			timeRange[operator] = timeStr
-		}
-	}
-
-	util.LogDebug("api.ListEvents: Create filter")
-	filter := hermes.Filter{
-		Source:       req.FormValue("source"),
-		ResourceType: req.FormValue("resource_type"),
-		ResourceName: req.FormValue("resource_name"),
-		UserName:     req.FormValue("user_name"),
-		EventType:    req.FormValue("event_type"),
-		Time:         timeRange,
-		Offset:       uint(offset),
-		Limit:        uint(limit),
-		Sort:         sortSpec,
-	}
+	filter.Offset = uint(offset)
+	filter.Limit = uint(limit)
+	filter.Sort = sortSpec
+	filter.Cursor = req.FormValue("cursor")
+	filter.Facets = req.FormValue("facets")
+	filter.FacetLimit = uint(facetLimit)
 
 	util.LogDebug("api.ListEvents: call hermes.GetEvents()")
-	tenantId, err := getTenantId(token, req, res)
-	if err != nil {
-		return
-	}
-	events, total, err := hermes.GetEvents(&filter, tenantId, p.keystone, p.storage)
+	page, err := hermes.GetEvents(filter, tenantId, p.keystone, p.storage)
 	if ReturnError(res, err) {
 		util.LogError("api.ListEvents: error %s", err)
 		return
 	}
 
-	eventList := EventList{Events: events, Total: total}
+	eventList := EventList{Events: page.Events, Total: page.Total, Facets: page.Facets}
 
 	// What protocol to use for PrevURL and NextURL?
 	protocol := getProtocol(req)
-	// Do we need a NextURL?
-	if int(filter.Offset+filter.Limit) < total {
-		req.Form.Set("offset", strconv.FormatUint(uint64(filter.Offset+filter.Limit), 10))
+	// Do we need a NextURL? It always uses a cursor, which unlike the offset is not
+	// restricted by the storage's MaxLimit()
+	if page.NextCursor != "" {
+		req.Form.Del("offset")
+		req.Form.Set("cursor", page.NextCursor)
 		eventList.NextURL = fmt.Sprintf("%s://%s%s?%s", protocol, req.Host, req.URL.Path, req.Form.Encode())
+		req.Form.Del("cursor")
 	}
-	// Do we need a PrevURL?
-	if int(filter.Offset-filter.Limit) >= 0 {
+	// Do we need a PrevURL? Cursors only lead forward, so this is only possible with an offset.
+	if filter.Cursor == "" && int(filter.Offset-filter.Limit) >= 0 {
 		req.Form.Set("offset", strconv.FormatUint(uint64(filter.Offset-filter.Limit), 10))
 		eventList.PrevURL = fmt.Sprintf("%s://%s%s?%s", protocol, req.Host, req.URL.Path, req.Form.Encode())
 	}
 
 	ReturnJSON(res, 200, eventList)
 }
+
+//GetHistogram handles GET /v1/events/histogram.
+func (p *v1Provider) GetHistogram(res http.ResponseWriter, req *http.Request) {
+	token := p.CheckToken(req)
+	filter, tenantId, ok := eventFilter(token, req, res)
+	if !ok {
+		return
+	}
+
+	util.LogDebug("api.GetHistogram: call hermes.GetHistogram()")
+	histogram, err := hermes.GetHistogram(filter, tenantId, req.FormValue("interval"), req.FormValue("split_by"), p.keystone, p.storage)
+	if ReturnError(res, err) {
+		util.LogError("api.GetHistogram: error %s", err)
+		return
+	}
+	ReturnJSON(res, 200, histogram)
+}
+
 func getProtocol(req *http.Request) string {
 	protocol := "http"
 	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
@@ -208,32 +179,136 @@ func (p *v1Provider) GetEventDetails(res http.ResponseWriter, req *http.Request)
 	ReturnJSON(res, 200, event)
 }
 
+//ListAttributes handles GET /v1/attributes.
+func (p *v1Provider) ListAttributes(res http.ResponseWriter, req *http.Request) {
+	token := p.CheckToken(req)
+	if !token.Require(res, "event:list") {
+		return
+	}
+	ReturnJSON(res, 200, hermes.AttributeNames())
+}
+
 //GetAttributes handles GET /v1/attributes/:attribute_name
 func (p *v1Provider) GetAttributes(res http.ResponseWriter, req *http.Request) {
 	token := p.CheckToken(req)
-	if !token.Require(res, "event:show") {
+	filter, tenantId, ok := eventFilter(token, req, res)
+	if !ok {
 		return
 	}
 	queryName := mux.Vars(req)["attribute_name"]
-	if queryName == "" {
-		fmt.Errorf("QueryName not found")
-	}
-	tenantId, err := getTenantId(token, req, res)
-	if err != nil {
+	limit, _ := strconv.ParseUint(req.FormValue("limit"), 10, 32)
+
+	attribute, err := hermes.GetAttributes(queryName, filter, tenantId, uint(limit), p.keystone, p.storage)
+	if ReturnError(res, err) {
 		return
 	}
+	ReturnJSON(res, 200, attribute)
+}
 
-	attribute, err := hermes.GetAttributes(queryName, tenantId, p.storage)
+// eventFilter parses the parameters that select events, and checks that the token
+//  allows to search them. If not, it writes an error response and returns false.
+func eventFilter(token *Token, req *http.Request, res http.ResponseWriter) (*hermes.Filter, string, bool) {
+	// Cloud admins can search the events of all tenants
+	var allTenants bool
+	switch req.FormValue("all_tenants") {
+	case "", "false":
+	case "true":
+		allTenants = true
+	default:
+		http.Error(res, "all_tenants must be true or false", 400)
+		return nil, "", false
+	}
+	if allTenants {
+		if !token.Require(res, "event:list_global") {
+			return nil, "", false
+		}
+	} else if !token.Require(res, "event:list") {
+		return nil, "", false
+	}
 
-	if ReturnError(res, err) {
-		return
+	// Figure out the data.Filter to use, based on the request parameters
+
+	// First off, parse the elements of the time range filter
+	timeRange := make(map[string]string)
+	validOperators := map[string]bool{"lt": true, "lte": true, "gt": true, "gte": true}
+	timeParam := req.FormValue("time")
+	if timeParam != "" {
+		for _, timeElement := range strings.Split(timeParam, ",") {
+			keyVal := strings.SplitN(timeElement, ":", 2)
+			operator := keyVal[0]
+			if !validOperators[operator] {
+				err := errors.New(fmt.Sprintf("Time operator %s is not valid. Must be lt, lte, gt or gte.", operator))
+				http.Error(res, err.Error(), 400)
+				return nil, "", false
+			}
+			_, exists := timeRange[operator]
+			if exists {
+				err := errors.New(fmt.Sprintf("Time operator %s can only occur once", operator))
+				http.Error(res, err.Error(), 400)
+				return nil, "", false
+			}
+			if len(keyVal) != 2 {
+				err := errors.New(fmt.Sprintf("Time operator %s missing :<timestamp>", operator))
+				http.Error(res, err.Error(), 400)
+				return nil, "", false
+			}
+			// hermes parses and checks the value
+			timeStr := keyVal[1]
+			timeRange[operator] = timeStr
+		}
 	}
-	if attribute == nil {
-		err := fmt.Errorf("Attribute %s could not be found in tenant %s", attribute, tenantId)
-		http.Error(res, err.Error(), 404)
-		return
+
+	// Domain-scoped requests can include the events of the domain's projects
+	var includeProjects, projectSubtree bool
+	switch req.FormValue("include_projects") {
+	case "", "false":
+	case "true":
+		includeProjects = true
+	case "subtree":
+		includeProjects, projectSubtree = true, true
+	default:
+		http.Error(res, "include_projects must be true, subtree or false", 400)
+		return nil, "", false
 	}
-	ReturnJSON(res, 200, attribute)
+	if includeProjects && (allTenants || !isDomainRequest(token, req)) {
+		http.Error(res, "include_projects is only possible for a domain", 400)
+		return nil, "", false
+	}
+
+	filter := &hermes.Filter{
+		Source:             req.FormValue("source"),
+		ResourceType:       req.FormValue("resource_type"),
+		ResourceName:       req.FormValue("resource_name"),
+		ResourceId:         req.FormValue("resource_id"),
+		UserName:           req.FormValue("user_name"),
+		EventType:          req.FormValue("event_type"),
+		Outcome:            req.FormValue("outcome"),
+		Action:             req.FormValue("action"),
+		InitiatorProjectId: req.FormValue("initiator_project_id"),
+		InitiatorDomainId:  req.FormValue("initiator_domain_id"),
+		ObserverId:         req.FormValue("observer_id"),
+		ObserverType:       req.FormValue("observer_type"),
+		InitiatorAddress:   req.FormValue("initiator_address"),
+		Time:               timeRange,
+		TimeZone:           req.FormValue("time_zone"),
+		Query:              req.FormValue("q"),
+		IncludeProjects:    includeProjects,
+		ProjectSubtree:     projectSubtree,
+		AllTenants:         allTenants,
+	}
+
+	var tenantId string
+	if allTenants {
+		// project_id and domain_id are lists of tenants to filter by instead
+		filter.TenantIds = append(splitList(req.FormValue("project_id")), splitList(req.FormValue("domain_id"))...)
+	} else {
+		var err error
+		tenantId, err = getTenantId(token, req, res)
+		if err != nil {
+			return nil, "", false
+		}
+	}
+	return filter, tenantId, true
 }
 
 func getTenantId(token *Token, r *http.Request, w http.ResponseWriter) (string, error) {
@@ -258,3 +333,22 @@ func getTenantId(token *Token, r *http.Request, w http.ResponseWriter) (string,
 	}
 	return tenantId, nil
 }
+
+// splitList returns the elements of a comma-separated query parameter.
+func splitList(value string) []string {
+	var result []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			result = append(result, element)
+		}
+	}
+	return result
+}
+
+// isDomainRequest returns whether the tenant that getTenantId() returns is a domain.
+func isDomainRequest(token *Token, r *http.Request) bool {
+	if r.FormValue("domain_id") != "" {
+		return true
+	}
+	return r.FormValue("project_id") == "" && token.context.Auth["tenant_id"] == "" && token.context.Auth["domain_id"] != ""
+}
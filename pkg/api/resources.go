@@ -0,0 +1,46 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/util"
+)
+
+//GetResourceEvents handles GET /v1/resources/:resource_id/events.
+func (p *v1Provider) GetResourceEvents(res http.ResponseWriter, req *http.Request) {
+	token := p.CheckToken(req)
+	filter, tenantId, ok := eventFilter(token, req, res)
+	if !ok {
+		return
+	}
+	resourceId := mux.Vars(req)["resource_id"]
+
+	util.LogDebug("api.GetResourceEvents: call hermes.GetResourceEvents()")
+	events, err := hermes.GetResourceEvents(resourceId, filter, tenantId, p.keystone, p.storage)
+	if ReturnError(res, err) {
+		util.LogError("api.GetResourceEvents: error %s", err)
+		return
+	}
+	ReturnJSON(res, 200, events)
+}
@@ -24,7 +24,7 @@ package configdb
 type Driver interface {
 	/********** requests to MySQL **********/
 	GetAudit(tenantId string) (*AuditConfig, error)
-	PutAudit(tenantId string) (*AuditConfig, error)
+	PutAudit(config *AuditConfig) (*AuditConfig, error)
 }
 
 // AuditConfig contains the mapping to MySQL config table.
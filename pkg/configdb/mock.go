@@ -5,13 +5,13 @@ type Mock struct{}
 // Mock configdb driver with static data
 
 func (m Mock) GetAudit(tenantId string) (*AuditConfig, error) {
-	d := AuditConfig{Enabled: true}
+	d := AuditConfig{Enabled: true, TenantID: tenantId}
 
 	return &d, nil
 }
 
-func (m Mock) PutAudit(tenantId string) (*AuditConfig, error) {
-	d := AuditConfig{Enabled: true}
+func (m Mock) PutAudit(config *AuditConfig) (*AuditConfig, error) {
+	d := *config
 
 	return &d, nil
 }
@@ -0,0 +1,121 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package configdb
+
+import (
+	"database/sql"
+	"fmt"
+
+	// Registers the "mysql" driver with database/sql
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/sapcc/hermes/pkg/util"
+)
+
+// MySQL is the configdb driver that persists audit configuration in MySQL.
+// The SQL used here is kept portable, so that the same driver also runs on
+// SQLite in unit tests.
+type MySQL struct {
+	db *sql.DB
+}
+
+// migrations contains the schema changes in the order in which they are applied.
+// Never change an existing entry - append a new one instead.
+var migrations = []string{
+	`CREATE TABLE audit_config (
+		tenant_id VARCHAR(64) NOT NULL PRIMARY KEY,
+		enabled   BOOLEAN     NOT NULL DEFAULT TRUE
+	)`,
+}
+
+// NewMySQL connects to the database described by the given DSN (as configured
+// in mysql.dsn), and creates or migrates the schema as needed.
+func NewMySQL(dsn string) (*MySQL, error) {
+	return openDB("mysql", dsn)
+}
+
+func openDB(driverName, dsn string) (*MySQL, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot connect to %s database: %v", driverName, err)
+	}
+	m := &MySQL{db: db}
+	err = m.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot migrate %s database schema: %v", driverName, err)
+	}
+	return m, nil
+}
+
+// migrate applies all migrations that have not been recorded in the
+// schema_migrations table yet.
+func (m *MySQL) migrate() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+	var current sql.NullInt64
+	err = m.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+	for idx := int(current.Int64); idx < len(migrations); idx++ {
+		version := idx + 1
+		util.LogInfo("Applying configdb migration %d", version)
+		_, err = m.db.Exec(migrations[idx])
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %v", version, err)
+		}
+		_, err = m.db.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAudit returns the audit configuration for the given tenant, or nil if there is none.
+func (m *MySQL) GetAudit(tenantId string) (*AuditConfig, error) {
+	var ac AuditConfig
+	err := m.db.QueryRow(`SELECT tenant_id, enabled FROM audit_config WHERE tenant_id = ?`, tenantId).
+		Scan(&ac.TenantID, &ac.Enabled)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ac, nil
+}
+
+// PutAudit stores the given audit configuration, replacing any existing
+// configuration for the same tenant, and returns the stored result.
+func (m *MySQL) PutAudit(config *AuditConfig) (*AuditConfig, error) {
+	_, err := m.db.Exec(`REPLACE INTO audit_config (tenant_id, enabled) VALUES (?, ?)`, config.TenantID, config.Enabled)
+	if err != nil {
+		return nil, err
+	}
+	return m.GetAudit(config.TenantID)
+}
@@ -0,0 +1,71 @@
+package configdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The MySQL driver only uses portable SQL, so its tests run against SQLite.
+func setupSQLite(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "hermes-configdb")
+	require.Nil(t, err)
+	return filepath.Join(dir, "configdb.sqlite"), func() { os.RemoveAll(dir) }
+}
+
+func Test_MySQL_Migrate(t *testing.T) {
+	path, cleanup := setupSQLite(t)
+	defer cleanup()
+
+	db, err := openDB("sqlite3", path)
+	require.Nil(t, err)
+	db.db.Close()
+
+	// Reopening must not try to apply the migrations a second time
+	db, err = openDB("sqlite3", path)
+	require.Nil(t, err)
+	defer db.db.Close()
+
+	var version int
+	err = db.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	require.Nil(t, err)
+	assert.Equal(t, len(migrations), version)
+}
+
+func Test_MySQL_Audit(t *testing.T) {
+	path, cleanup := setupSQLite(t)
+	defer cleanup()
+	db, err := openDB("sqlite3", path)
+	require.Nil(t, err)
+	defer db.db.Close()
+
+	ac, err := db.GetAudit("b3b70c8271a845709f9a03030e705da7")
+	require.Nil(t, err)
+	assert.Nil(t, ac)
+
+	ac, err = db.PutAudit(&AuditConfig{TenantID: "b3b70c8271a845709f9a03030e705da7", Enabled: true})
+	require.Nil(t, err)
+	require.NotNil(t, ac)
+	assert.Equal(t, "b3b70c8271a845709f9a03030e705da7", ac.TenantID)
+	assert.True(t, ac.Enabled)
+
+	// Updating an existing entry
+	ac, err = db.PutAudit(&AuditConfig{TenantID: "b3b70c8271a845709f9a03030e705da7", Enabled: false})
+	require.Nil(t, err)
+	require.NotNil(t, ac)
+	assert.False(t, ac.Enabled)
+
+	ac, err = db.GetAudit("b3b70c8271a845709f9a03030e705da7")
+	require.Nil(t, err)
+	require.NotNil(t, ac)
+	assert.False(t, ac.Enabled)
+
+	ac, err = db.GetAudit("6a030751147a45c0863c3b5bde32c744")
+	require.Nil(t, err)
+	assert.Nil(t, ac)
+}
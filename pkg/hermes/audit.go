@@ -7,7 +7,7 @@ import (
 
 type AuditDetail struct {
 	Enabled  bool   `json:"enabled"`
-	TenantID string `json:"TenantID"`
+	TenantID string `json:"tenant_id"`
 }
 
 //GetAudit returns the config for auditing matching a tenant in JSON
@@ -19,6 +19,9 @@ func GetAudit(tenantId string, configDB configdb.Driver) (*AuditDetail, error) {
 		util.LogError("Error %v", err)
 		return nil, err
 	}
+	if auditconf == nil {
+		return nil, nil
+	}
 
 	ad.Enabled = auditconf.Enabled
 	ad.TenantID = auditconf.TenantID
@@ -27,17 +30,24 @@ func GetAudit(tenantId string, configDB configdb.Driver) (*AuditDetail, error) {
 }
 
 //PutAudit changes the config for auditing for a given tenant.
-//Inserts config database entry if one doesn't exist with defaults.
-func PutAudit(tenantId string, configDB configdb.Driver) (*AuditDetail, error) {
+//Inserts config database entry if one doesn't exist yet.
+func PutAudit(tenantId string, detail *AuditDetail, configDB configdb.Driver) (*AuditDetail, error) {
 	ad := AuditDetail{}
-	auditconf, err := configDB.PutAudit(tenantId)
+	auditconf, err := configDB.PutAudit(&configdb.AuditConfig{
+		TenantID: tenantId,
+		Enabled:  detail.Enabled,
+	})
 
 	if err != nil {
 		util.LogError("Error %v", err)
 		return nil, err
 	}
+	if auditconf == nil {
+		return nil, nil
+	}
 
 	ad.Enabled = auditconf.Enabled
+	ad.TenantID = auditconf.TenantID
 
 	return &ad, nil
 }
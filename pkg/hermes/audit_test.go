@@ -13,3 +13,11 @@ func Test_GetAudit(t *testing.T) {
 	require.NotNil(t, entry)
 
 }
+
+func Test_PutAudit(t *testing.T) {
+	entry, err := PutAudit("b3b70c8271a845709f9a03030e705da7", &AuditDetail{Enabled: false}, configdb.Mock{})
+	require.Nil(t, err)
+	require.NotNil(t, entry)
+	require.Equal(t, "b3b70c8271a845709f9a03030e705da7", entry.TenantID)
+	require.False(t, entry.Enabled)
+}
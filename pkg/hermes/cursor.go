@@ -0,0 +1,74 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package hermes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// InvalidInputError is returned when a request cannot be served because of
+// invalid parameters, as opposed to a failure in Hermes or its backends.
+type InvalidInputError struct {
+	Message string
+}
+
+func (e InvalidInputError) Error() string {
+	return e.Message
+}
+
+// cursorToken is what the opaque cursor handed out to API clients contains.
+//  Besides the position in storage, it records the sort order that the position
+//  refers to, because the position is meaningless under any other sort order.
+type cursorToken struct {
+	Sort     []FieldOrder   `json:"sort,omitempty"`
+	Position storage.Cursor `json:"pos"`
+}
+
+func encodeCursor(cursor *storage.Cursor, sort []FieldOrder) (string, error) {
+	buf, err := json.Marshal(cursorToken{Sort: sort, Position: *cursor})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func decodeCursor(token string, sort []FieldOrder) (*storage.Cursor, error) {
+	invalid := InvalidInputError{"cursor is not valid, please use the \"next\" URL of a previous response"}
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, invalid
+	}
+	var ct cursorToken
+	// Keep numeric sort values as they are, instead of converting them to float64
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	if decoder.Decode(&ct) != nil {
+		return nil, invalid
+	}
+	if len(ct.Sort) != len(sort) || (len(sort) > 0 && !reflect.DeepEqual(ct.Sort, sort)) {
+		return nil, InvalidInputError{"cursor was created for a different sort order"}
+	}
+	return &ct.Position, nil
+}
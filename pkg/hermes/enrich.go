@@ -0,0 +1,82 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package hermes
+
+import (
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/sapcc/hermes/pkg/util"
+)
+
+// EnrichEvent adds the Keystone information that keystonemiddleware leaves out
+// of its CADF events, so that it can be stored along with the event:
+//   - the domain of the initiator's project
+//   - the names for the IDs of the initiator, the target project, and the
+//     project/user/group/role of role assignment events
+//
+// Values that are already present in the event are kept, so enriching an event
+// twice does not cause additional lookups. Failed lookups are logged and leave
+// the respective field empty, because a missing name must not prevent the event
+// from being stored.
+func EnrichEvent(event *storage.EventDetail, keystoneDriver identity.Identity) {
+	initiator := &event.Payload.Initiator
+	if initiator.DomainID == "" && initiator.ProjectID != "" {
+		domainId, err := keystoneDriver.ProjectDomainId(initiator.ProjectID)
+		if err != nil {
+			util.LogError("Error looking up domain for project '%s': %s", initiator.ProjectID, err.Error())
+		}
+		initiator.DomainID = domainId
+	}
+	enrichNames(event, keystoneDriver)
+}
+
+// enrichNames fills in the names for all IDs in the event that do not have a name yet.
+func enrichNames(event *storage.EventDetail, keystoneDriver identity.Identity) {
+	p := &event.Payload
+	idMap := map[string]string{}
+	addMissing := func(key, id, name string) {
+		if name == "" {
+			idMap[key] = id
+		}
+	}
+	addMissing("init_user_domain", p.Initiator.DomainID, p.Initiator.DomainName)
+	addMissing("init_user_project", p.Initiator.ProjectID, p.Initiator.ProjectName)
+	addMissing("init_user", p.Initiator.UserID, p.Initiator.UserName)
+	addMissing("project", p.Project, p.ProjectName)
+	addMissing("user", p.User, p.UserName)
+	addMissing("group", p.Group, p.GroupName)
+	addMissing("role", p.Role, p.RoleName)
+	addMissing("target", p.Target.ID, p.Target.Name)
+
+	nameMap := namesForIds(keystoneDriver, idMap, p.Target.TypeURI)
+	setMissing := func(name *string, key string) {
+		if *name == "" {
+			*name = nameMap[key]
+		}
+	}
+	setMissing(&p.Initiator.DomainName, "init_user_domain")
+	setMissing(&p.Initiator.ProjectName, "init_user_project")
+	setMissing(&p.Initiator.UserName, "init_user")
+	setMissing(&p.Target.Name, "target")
+	setMissing(&p.ProjectName, "project")
+	setMissing(&p.UserName, "user")
+	setMissing(&p.GroupName, "group")
+	setMissing(&p.RoleName, "role")
+}
@@ -0,0 +1,47 @@
+package hermes
+
+import (
+	"testing"
+
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EnrichEvent(t *testing.T) {
+	var event storage.EventDetail
+	event.Payload.Initiator.ProjectID = "6a030751147a45c0863c3b5bde32c744"
+	event.Payload.Initiator.UserID = "eb5cd8f904b06e8b2a6eb86c8b04c08e6efb89b92da77905cc8c475f30b0b812"
+	event.Payload.Target.TypeURI = "data/security/project"
+	event.Payload.Target.ID = "b3b70c8271a845709f9a03030e705da7"
+	event.Payload.Role = "b2cd5b5c2a2e4b0aba1ea4d8d23e3f58"
+
+	EnrichEvent(&event, identity.Mock{})
+	i := event.Payload.Initiator
+	assert.Equal(t, "39a253e16e4a4a3686edca72c8e101bc", i.DomainID)
+	assert.Equal(t, "monsoon3", i.DomainName)
+	assert.Equal(t, "ceilometer-cadf-delete-me", i.ProjectName)
+	assert.Equal(t, "I056593", i.UserName)
+	assert.Equal(t, "ceilometer-cadf-delete-me", event.Payload.Target.Name)
+	assert.Equal(t, "audit_viewer", event.Payload.RoleName)
+	// Only IDs that are present are looked up
+	assert.Empty(t, event.Payload.UserName)
+	assert.Empty(t, event.Payload.GroupName)
+}
+
+func Test_EnrichEventKeepsExistingValues(t *testing.T) {
+	var event storage.EventDetail
+	event.Payload.Initiator.ProjectID = "6a030751147a45c0863c3b5bde32c744"
+	event.Payload.Initiator.ProjectName = "stored-project"
+	event.Payload.Initiator.DomainID = "stored-domain-id"
+	event.Payload.Target.TypeURI = "data/security/project"
+	event.Payload.Target.ID = "b3b70c8271a845709f9a03030e705da7"
+	event.Payload.Target.Name = "stored-target"
+
+	EnrichEvent(&event, identity.Mock{})
+	i := event.Payload.Initiator
+	assert.Equal(t, "stored-domain-id", i.DomainID)
+	assert.Equal(t, "monsoon3", i.DomainName)
+	assert.Equal(t, "stored-project", i.ProjectName)
+	assert.Equal(t, "stored-target", event.Payload.Target.Name)
+}
@@ -27,7 +27,9 @@ import (
 	"github.com/sapcc/hermes/pkg/util"
 	"github.com/spf13/viper"
 	"log"
+	"sort"
 	"strings"
+	"time"
 )
 
 // ListEvent contains high-level data about an event, intended as a list item
@@ -40,7 +42,9 @@ type ListEvent struct {
 	ResourceName string `json:"resource_name,omitempty"`
 	ResourceId   string `json:"resource_id"`
 	ResourceType string `json:"resource_type"`
-	Initiator    struct {
+	// Project or domain that the event belongs to. Only set when the projects of a domain are included.
+	TenantID  string `json:"tenant_id,omitempty"`
+	Initiator struct {
 		TypeURI     string `json:"typeURI"`
 		DomainID    string `json:"domain_id,omitempty"`
 		DomainName  string `json:"domain_name,omitempty"`
@@ -63,34 +67,131 @@ type FieldOrder struct {
 }
 
 // Filter maps to the filtering/paging/sorting allowed by the API
+//  The filters on event attributes are comma-separated lists of values, see valueFilter.
 type Filter struct {
-	Source       string
-	ResourceType string
-	ResourceName string
-	UserName     string
-	EventType    string
-	Time         map[string]string
-	Offset       uint
-	Limit        uint
-	Sort         []FieldOrder
+	Source             string
+	ResourceType       string
+	ResourceName       string
+	ResourceId         string
+	UserName           string
+	EventType          string
+	Outcome            string
+	Action             string
+	InitiatorProjectId string
+	InitiatorDomainId  string
+	ObserverId         string
+	ObserverType       string
+	// IP addresses or IPv4 CIDR ranges of the initiator's host
+	InitiatorAddress string
+	// Bounds by operator (gt, gte, lt or lte) as parsed by ParseTimeExpression
+	Time map[string]string
+	// Time zone of bounds without one, and for rounding them to days, see parseTimeZone
+	TimeZone string
+	Offset   uint
+	Limit    uint
+	Sort     []FieldOrder
+	// Opaque cursor from a previous EventPage. If set, Offset is ignored.
+	Cursor string
+	// Query expression as parsed by ParseQuery
+	Query string
+	// Whether the events of the domain's projects are returned together with those of the
+	//  domain itself, and whether that includes the projects nested in them
+	IncludeProjects bool
+	ProjectSubtree  bool
+	// Whether the events of all tenants are searched, or only those of the tenants in TenantIds
+	//  if there are any. The tenantId argument of GetEvents is ignored then.
+	AllTenants bool
+	TenantIds  []string
+	// Comma-separated attributes (see AttributeNames) whose most frequent values among all
+	//  matching events are returned with the events, FacetLimit values each
+	Facets     string
+	FacetLimit uint
+}
+
+// EventPage is a page of events as returned by GetEvents
+type EventPage struct {
+	Events []*ListEvent
+	// Total number of matching events
+	Total int
+	// Cursor for the next page, or empty if there are no more events
+	NextCursor string
+	// Values of the requested Filter.Facets with their counts, by attribute
+	Facets map[string]storage.AttributeValueList
 }
 
 // GetEvents returns a list of matching events (with filtering)
-func GetEvents(filter *Filter, tenantId string, keystoneDriver identity.Identity, eventStore storage.Storage) ([]*ListEvent, int, error) {
+func GetEvents(filter *Filter, tenantId string, keystoneDriver identity.Identity, eventStore storage.Storage) (*EventPage, error) {
+	facets, facetLimit, err := parseFacets(filter.Facets, filter.FacetLimit)
+	if err != nil {
+		return nil, err
+	}
 	storageFilter, err := storageFilter(filter, keystoneDriver, eventStore)
+	if err == errNoMatch {
+		page := EventPage{}
+		if len(facets) > 0 {
+			page.Facets = make(map[string]storage.AttributeValueList)
+			for _, facet := range facets {
+				page.Facets[facet] = storage.AttributeValueList{}
+			}
+		}
+		return &page, nil
+	}
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	storageFilter.Facets, storageFilter.FacetLimit = facets, facetLimit
+	tenantId, err = storageTenant(filter, tenantId, storageFilter, keystoneDriver)
+	if err != nil {
+		return nil, err
 	}
 	util.LogDebug("hermes.GetEvents: tenant id is %s", tenantId)
-	eventDetails, total, err := eventStore.GetEvents(storageFilter, tenantId)
+	storagePage, err := eventStore.GetEvents(storageFilter, tenantId)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	events, err := eventsList(eventDetails, keystoneDriver)
+	events, err := eventsList(storagePage.Events, keystoneDriver)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	labelTenants(events, storagePage.Events, filter)
+	page := EventPage{Events: events, Total: storagePage.Total, Facets: storagePage.Facets}
+	if storagePage.Next != nil {
+		page.NextCursor, err = encodeCursor(storagePage.Next, filter.Sort)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &page, nil
+}
+
+// labelTenants sets the tenant of the events if they come from several tenants.
+func labelTenants(events []*ListEvent, storageEvents []*storage.EventDetail, filter *Filter) {
+	if filter.IncludeProjects || filter.AllTenants {
+		for i, event := range events {
+			event.TenantID = storageEvents[i].TenantID
+		}
+	}
+}
+
+// storageTenant returns the tenant whose events are searched, and sets the further tenants
+//  whose events are included in the storageFilter.
+func storageTenant(filter *Filter, tenantId string, storageFilter *storage.Filter, keystoneDriver identity.Identity) (string, error) {
+	if filter.AllTenants {
+		if len(filter.TenantIds) == 0 {
+			return "", nil
+		}
+		storageFilter.IncludeTenants = filter.TenantIds[1:]
+		return filter.TenantIds[0], nil
+	}
+	if filter.IncludeProjects {
+		var err error
+		storageFilter.IncludeTenants, err = keystoneDriver.DomainProjectIds(tenantId, filter.ProjectSubtree)
+		if err != nil {
+			return "", err
+		}
+		util.LogDebug("hermes: including %d projects of domain %s", len(storageFilter.IncludeTenants), tenantId)
 	}
-	return events, total, err
+	return tenantId, nil
 }
 
 func storageFilter(filter *Filter, keystoneDriver identity.Identity, eventStore storage.Storage) (*storage.Filter, error) {
@@ -99,9 +200,22 @@ func storageFilter(filter *Filter, keystoneDriver identity.Identity, eventStore
 		filter.Limit = 10
 	}
 
-	if filter.Offset+filter.Limit > eventStore.MaxLimit() {
-		return nil, fmt.Errorf("offset %d plus limit %d exceeds the maximum of %d",
-			filter.Offset, filter.Limit, eventStore.MaxLimit())
+	// With a cursor, the storage does not need to count through the preceding events,
+	// so only the page itself is restricted
+	var cursor *storage.Cursor
+	if filter.Cursor != "" {
+		var err error
+		cursor, err = decodeCursor(filter.Cursor, filter.Sort)
+		if err != nil {
+			return nil, err
+		}
+		if filter.Limit > eventStore.MaxLimit() {
+			return nil, InvalidInputError{fmt.Sprintf("limit %d exceeds the maximum of %d",
+				filter.Limit, eventStore.MaxLimit())}
+		}
+	} else if filter.Offset+filter.Limit > eventStore.MaxLimit() {
+		return nil, InvalidInputError{fmt.Sprintf("offset %d plus limit %d exceeds the maximum of %d, use the cursor of the \"next\" URL to page further",
+			filter.Offset, filter.Limit, eventStore.MaxLimit())}
 	}
 
 	storagefieldorder := []storage.FieldOrder{}
@@ -109,31 +223,98 @@ func storageFilter(filter *Filter, keystoneDriver identity.Identity, eventStore
 	if err != nil {
 		panic("Could not copy storage field order.")
 	}
+	timeFilter, err := normalizeTimeFilter(filter.Time, filter.TimeZone, time.Now())
+	if err != nil {
+		return nil, err
+	}
 	storageFilter := storage.Filter{
-		Source:       filter.Source,
-		ResourceType: filter.ResourceType,
-		EventType:    filter.EventType,
-		Time:         filter.Time,
-		Offset:       filter.Offset,
-		Limit:        filter.Limit,
-		Sort:         storagefieldorder,
+		Time:   timeFilter,
+		Offset: filter.Offset,
+		Limit:  filter.Limit,
+		Sort:   storagefieldorder,
+		Cursor: cursor,
+	}
+	for _, field := range []struct {
+		name   string
+		param  string
+		values *storage.ValueFilter
+	}{
+		{"source", filter.Source, &storageFilter.Source},
+		{"resource_type", filter.ResourceType, &storageFilter.ResourceType},
+		{"resource_id", filter.ResourceId, &storageFilter.ResourceId},
+		{"event_type", filter.EventType, &storageFilter.EventType},
+		{"outcome", filter.Outcome, &storageFilter.Outcome},
+		{"action", filter.Action, &storageFilter.Action},
+		{"initiator_project_id", filter.InitiatorProjectId, &storageFilter.InitiatorProjectId},
+		{"initiator_domain_id", filter.InitiatorDomainId, &storageFilter.InitiatorDomainId},
+		{"observer_id", filter.ObserverId, &storageFilter.ObserverId},
+		{"observer_type", filter.ObserverType, &storageFilter.ObserverType},
+		{"initiator_address", filter.InitiatorAddress, &storageFilter.InitiatorAddress},
+	} {
+		*field.values, err = valueFilter(field.name, field.param)
+		if err != nil {
+			return nil, err
+		}
+	}
+	storageFilter.Query, err = ParseQuery(filter.Query)
+	if err != nil {
+		return nil, err
 	}
 	// Translate hermes.Filter to storage.Filter by filling in IDs for names
 	if filter.ResourceName != "" {
-		// TODO: make sure there is a resource type, then look up the corresponding name
-		//storageFilter.ResourceId = resourceId
+		if !storageFilter.ResourceId.IsEmpty() {
+			return nil, InvalidInputError{"resource_name cannot be combined with resource_id"}
+		}
+		lookup, err := resourceNameLookup(storageFilter.ResourceType, keystoneDriver)
+		if err != nil {
+			return nil, err
+		}
+		names, err := valueFilter("resource_name", filter.ResourceName)
+		if err != nil {
+			return nil, err
+		}
+		storageFilter.ResourceId, err = resolveNames("resource_name", names, lookup)
+		if err != nil {
+			return nil, err
+		}
 	}
 	if filter.UserName != "" {
 		util.LogDebug("Filtering on UserName: %s", filter.UserName)
-		//userId, err := keystoneDriver.UserId(filter.UserName)
-		//if err != nil {
-		//	util.LogError("Could not find user ID &s for name %s", userId, filter.UserName)
-		//}
-		storageFilter.UserId = filter.UserName
+		names, err := valueFilter("user_name", filter.UserName)
+		if err != nil {
+			return nil, err
+		}
+		storageFilter.UserId, err = resolveNames("user_name", names, keystoneDriver.UserId)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &storageFilter, nil
 }
 
+// valueFilter parses a filter parameter, which is a comma-separated list of values, into
+//  a storage.ValueFilter. The events must match any of the values, except those prefixed
+//  with "!", which they must not match.
+func valueFilter(name, param string) (storage.ValueFilter, error) {
+	var values storage.ValueFilter
+	for _, value := range strings.Split(param, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if strings.HasPrefix(value, "!") {
+			value = strings.TrimSpace(strings.TrimPrefix(value, "!"))
+			if value == "" {
+				return values, InvalidInputError{name + ": \"!\" must be followed by a value"}
+			}
+			values.Exclude = append(values.Exclude, value)
+		} else {
+			values.Include = append(values.Include, value)
+		}
+	}
+	return values, nil
+}
+
 // Construct ListEvents - Optionally (default off) add the names for IDs in the events
 func eventsList(eventDetails []*storage.EventDetail, keystoneDriver identity.Identity) ([]*ListEvent, error) {
 	var events []*ListEvent
@@ -144,6 +325,7 @@ func eventsList(eventDetails []*storage.EventDetail, keystoneDriver identity.Ide
 			ID:           storageEvent.MessageID,
 			Type:         storageEvent.EventType,
 			Time:         p.EventTime,
+			ResourceName: storageEvent.Payload.Target.Name,
 			ResourceId:   storageEvent.Payload.Target.ID,
 			ResourceType: storageEvent.Payload.Target.TypeURI,
 		}
@@ -153,17 +335,33 @@ func eventsList(eventDetails []*storage.EventDetail, keystoneDriver identity.Ide
 		}
 
 		if viper.GetBool("hermes.enrich_keystone_events") {
-			nameMap := namesForIds(keystoneDriver, map[string]string{
-				"init_user_domain":  event.Initiator.DomainID,
-				"init_user_project": event.Initiator.ProjectID,
-				"init_user":         event.Initiator.UserID,
-				"target":            event.ResourceId,
-			}, event.ResourceType)
+			idMap := map[string]string{}
+			if event.Initiator.DomainName == "" {
+				idMap["init_user_domain"] = event.Initiator.DomainID
+			}
+			if event.Initiator.ProjectName == "" {
+				idMap["init_user_project"] = event.Initiator.ProjectID
+			}
+			if event.Initiator.UserName == "" {
+				idMap["init_user"] = event.Initiator.UserID
+			}
+			if event.ResourceName == "" {
+				idMap["target"] = event.ResourceId
+			}
+			nameMap := namesForIds(keystoneDriver, idMap, event.ResourceType)
 
-			event.Initiator.DomainName = nameMap["init_user_domain"]
-			event.Initiator.ProjectName = nameMap["init_user_project"]
-			event.Initiator.UserName = nameMap["init_user"]
-			event.ResourceName = nameMap["target"]
+			if event.Initiator.DomainName == "" {
+				event.Initiator.DomainName = nameMap["init_user_domain"]
+			}
+			if event.Initiator.ProjectName == "" {
+				event.Initiator.ProjectName = nameMap["init_user_project"]
+			}
+			if event.Initiator.UserName == "" {
+				event.Initiator.UserName = nameMap["init_user"]
+			}
+			if event.ResourceName == "" {
+				event.ResourceName = nameMap["target"]
+			}
 		}
 		events = append(events, &event)
 	}
@@ -174,37 +372,93 @@ func eventsList(eventDetails []*storage.EventDetail, keystoneDriver identity.Ide
 func GetEvent(eventID string, tenantId string, keystoneDriver identity.Identity, eventStore storage.Storage) (*storage.EventDetail, error) {
 	event, err := eventStore.GetEvent(eventID, tenantId)
 
-	if viper.GetBool("hermes.enrich_keystone_events") {
-		if event != nil {
-			nameMap := namesForIds(keystoneDriver, map[string]string{
-				"init_user_domain":  event.Payload.Initiator.DomainID,
-				"init_user_project": event.Payload.Initiator.ProjectID,
-				"init_user":         event.Payload.Initiator.UserID,
-				"target":            event.Payload.Target.ID,
-				"project":           event.Payload.Project,
-				"user":              event.Payload.User,
-				"group":             event.Payload.Group,
-				"role":              event.Payload.Role,
-			}, event.Payload.Target.TypeURI)
-
-			event.Payload.Initiator.DomainName = nameMap["init_user_domain"]
-			event.Payload.Initiator.ProjectName = nameMap["init_user_project"]
-			event.Payload.Initiator.UserName = nameMap["init_user"]
-			event.Payload.Target.Name = nameMap["target"]
-			event.Payload.ProjectName = nameMap["project"]
-			event.Payload.UserName = nameMap["user"]
-			event.Payload.GroupName = nameMap["group"]
-			event.Payload.RoleName = nameMap["role"]
-		}
+	// Events that were enriched at ingestion time already have their names, so this
+	// only looks up what is missing in events from other ingestion paths
+	if viper.GetBool("hermes.enrich_keystone_events") && event != nil {
+		enrichNames(event, keystoneDriver)
 	}
 	return event, err
 }
 
-// No Logic here, but handles mock implementation for eventStore
-func GetAttributes(queryName string, tenantId string, eventStore storage.Storage) ([]string, error) {
-	attribute, err := eventStore.GetAttributes(queryName, tenantId)
+// DefaultAttributeLimit is the number of values that GetAttributes returns if no limit is given
+const DefaultAttributeLimit = 10
+
+// GetAttributes returns the most frequent values of an attribute among the events
+//  matching the filter, with the number of events that have them.
+func GetAttributes(attribute string, filter *Filter, tenantId string, limit uint, keystoneDriver identity.Identity, eventStore storage.Storage) (storage.AttributeValueList, error) {
+	err := checkAttribute(attribute)
+	if err != nil {
+		return nil, err
+	}
+	limit, err = attributeLimit("limit", limit)
+	if err != nil {
+		return nil, err
+	}
+	storageFilter, err := storageFilter(filter, keystoneDriver, eventStore)
+	if err == errNoMatch {
+		return storage.AttributeValueList{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tenantId, err = storageTenant(filter, tenantId, storageFilter, keystoneDriver)
+	if err != nil {
+		return nil, err
+	}
+	return eventStore.GetAttributes(storageFilter, tenantId, attribute, limit)
+}
+
+// AttributeNames returns the names of the attributes that GetAttributes accepts, in alphabetical order.
+func AttributeNames() []string {
+	var names []string
+	for name := range storage.AttributeFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkAttribute returns an InvalidInputError if the attribute is not one of the AttributeNames.
+func checkAttribute(attribute string) error {
+	if _, ok := storage.AttributeFields[attribute]; !ok {
+		return InvalidInputError{fmt.Sprintf("\"%s\" is not a valid attribute, valid attributes are: %s",
+			attribute, strings.Join(AttributeNames(), ", "))}
+	}
+	return nil
+}
+
+// attributeLimit returns the number of attribute values to count, which defaults to
+//  DefaultAttributeLimit, or an InvalidInputError naming the parameter if it is too large.
+func attributeLimit(param string, limit uint) (uint, error) {
+	if limit == 0 {
+		return DefaultAttributeLimit, nil
+	}
+	if limit > storage.MaxAttributeLimit {
+		return 0, InvalidInputError{fmt.Sprintf("%s %d exceeds the maximum of %d", param, limit, storage.MaxAttributeLimit)}
+	}
+	return limit, nil
+}
 
-	return attribute, err
+// parseFacets parses Filter.Facets into distinct attribute names, and checks the FacetLimit.
+func parseFacets(param string, limit uint) ([]string, uint, error) {
+	var facets []string
+	seen := make(map[string]bool)
+	for _, facet := range strings.Split(param, ",") {
+		facet = strings.TrimSpace(facet)
+		if facet == "" || seen[facet] {
+			continue
+		}
+		if err := checkAttribute(facet); err != nil {
+			return nil, 0, InvalidInputError{"facets: " + err.Error()}
+		}
+		seen[facet] = true
+		facets = append(facets, facet)
+	}
+	if len(facets) == 0 {
+		return nil, 0, nil
+	}
+	limit, err := attributeLimit("facet_limit", limit)
+	return facets, limit, err
 }
 
 func namesForIds(keystoneDriver identity.Identity, idMap map[string]string, targetType string) map[string]string {
@@ -263,17 +517,20 @@ func namesForIds(keystoneDriver identity.Identity, idMap map[string]string, targ
 	}
 
 	// Depending on the type of the target, we need to look up the name in different services
-	switch targetType {
-	case "data/security/project":
-		nameMap["target"], err = keystoneDriver.ProjectName(idMap["target"])
-	case "service/security/account/user":
-	// doesn't work for users - a UUID is used for some reason, which can't be looked up
-	//	nameMap["target"], err = keystoneDriver.UserName(idMap["target"])
-	default:
-		log.Printf("Unhandled payload type \"%s\", cannot look up name.", targetType)
-	}
-	if err != nil {
-		log.Printf("Error looking up name for %s '%s'", targetType, idMap["target"])
+	targetId := idMap["target"]
+	if targetId != "" {
+		switch targetType {
+		case "data/security/project":
+			nameMap["target"], err = keystoneDriver.ProjectName(targetId)
+		case "service/security/account/user":
+		// doesn't work for users - a UUID is used for some reason, which can't be looked up
+		//	nameMap["target"], err = keystoneDriver.UserName(targetId)
+		default:
+			log.Printf("Unhandled payload type \"%s\", cannot look up name.", targetType)
+		}
+		if err != nil {
+			log.Printf("Error looking up name for %s '%s'", targetType, targetId)
+		}
 	}
 
 	return nameMap
@@ -9,9 +9,15 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func testStorage(t *testing.T) storage.Storage {
+	eventStore, err := storage.NewMemoryFromFile("../test/events.ndjson")
+	require.Nil(t, err)
+	return eventStore
+}
+
 func Test_GetEvent(t *testing.T) {
-	eventId := "d5eed458-6666-58ec-ad06-8d3cf6bafca1"
-	event, err := GetEvent(eventId, "", identity.Mock{}, storage.Mock{})
+	eventId := "5a32c2f3-2996-4f46-819c-6197cf06037e"
+	event, err := GetEvent(eventId, "", identity.Mock{}, testStorage(t))
 	require.Nil(t, err)
 	require.NotNil(t, event)
 	assert.Equal(t, "d5eed458-6666-58ec-ad06-8d3cf6bafca1", event.Payload.ID)
@@ -21,11 +27,12 @@ func Test_GetEvent(t *testing.T) {
 }
 
 func Test_GetEvents(t *testing.T) {
-	events, total, err := GetEvents(&Filter{}, "", identity.Mock{}, storage.Mock{})
+	page, err := GetEvents(&Filter{Limit: 3}, "", identity.Mock{}, testStorage(t))
 	require.Nil(t, err)
-	require.NotNil(t, events)
+	require.NotNil(t, page)
+	events := page.Events
 	assert.Equal(t, len(events), 3)
-	assert.True(t, total >= len(events))
+	assert.True(t, page.Total >= len(events))
 	for _, event := range events {
 		assert.NotEmpty(t, event.ID)
 		assert.NotEmpty(t, event.Type)
@@ -34,3 +41,165 @@ func Test_GetEvents(t *testing.T) {
 	assert.NotEqual(t, events[0].ID, events[1].ID)
 	assert.NotEqual(t, events[0].ID, events[2].ID)
 }
+
+func Test_GetEventsCursor(t *testing.T) {
+	eventStore := testStorage(t)
+	page, err := GetEvents(&Filter{Limit: 3}, "", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	require.NotEmpty(t, page.NextCursor)
+
+	// The cursor leads to the next page, even beyond MaxLimit()
+	_, err = GetEvents(&Filter{Limit: 3, Offset: 10000, Cursor: page.NextCursor}, "", identity.Mock{}, eventStore)
+	assert.Nil(t, err)
+
+	_, err = GetEvents(&Filter{Limit: 3, Offset: 10000}, "", identity.Mock{}, eventStore)
+	assert.IsType(t, InvalidInputError{}, err)
+
+	_, err = GetEvents(&Filter{Limit: 3, Cursor: "garbage"}, "", identity.Mock{}, eventStore)
+	assert.IsType(t, InvalidInputError{}, err)
+
+	// The cursor cannot be used with a different sort order
+	sort := []FieldOrder{{Fieldname: "time", Order: "asc"}}
+	_, err = GetEvents(&Filter{Limit: 3, Cursor: page.NextCursor, Sort: sort}, "", identity.Mock{}, eventStore)
+	assert.IsType(t, InvalidInputError{}, err)
+}
+
+func Test_GetEventsFilter(t *testing.T) {
+	page, err := GetEvents(&Filter{Source: "compute"}, "", identity.Mock{}, testStorage(t))
+	require.Nil(t, err)
+	assert.Equal(t, 2, page.Total)
+	for _, event := range page.Events {
+		assert.Equal(t, "compute", event.Source)
+	}
+	assert.Empty(t, page.NextCursor)
+
+	page, err = GetEvents(&Filter{}, "6a030751147a45c0863c3b5bde32c744", identity.Mock{}, testStorage(t))
+	require.Nil(t, err)
+	assert.Equal(t, 2, page.Total)
+}
+
+func Test_GetEventsValueLists(t *testing.T) {
+	page, err := GetEvents(&Filter{EventType: "compute.instance.create.end, compute.instance.delete.end"}, "", identity.Mock{}, testStorage(t))
+	require.Nil(t, err)
+	assert.Equal(t, 2, page.Total)
+
+	page, err = GetEvents(&Filter{Source: "!identity"}, "", identity.Mock{}, testStorage(t))
+	require.Nil(t, err)
+	assert.Equal(t, 2, page.Total)
+	for _, event := range page.Events {
+		assert.Equal(t, "compute", event.Source)
+	}
+
+	_, err = GetEvents(&Filter{Outcome: "success,!"}, "", identity.Mock{}, testStorage(t))
+	assert.IsType(t, InvalidInputError{}, err)
+	// addresses are checked by the storage, and still result in a 400
+	_, err = GetEvents(&Filter{InitiatorAddress: "!localhost"}, "", identity.Mock{}, testStorage(t))
+	assert.IsType(t, storage.InvalidFilterError{}, err)
+}
+
+func Test_valueFilter(t *testing.T) {
+	values, err := valueFilter("source", " identity, compute,,!*.read, ! dns ")
+	require.Nil(t, err)
+	assert.Equal(t, storage.ValueFilter{Include: []string{"identity", "compute"}, Exclude: []string{"*.read", "dns"}}, values)
+
+	values, err = valueFilter("source", "")
+	require.Nil(t, err)
+	assert.True(t, values.IsEmpty())
+}
+
+func Test_GetEventsNames(t *testing.T) {
+	eventStore := testStorage(t)
+	tests := []struct {
+		filter Filter
+		total  int
+	}{
+		{Filter{UserName: "I056593"}, 17},
+		// "admin" exists in two domains
+		{Filter{UserName: "admin@monsoon3"}, 2},
+		{Filter{UserName: "!admin@monsoon3"}, 17},
+		{Filter{UserName: "nobody,admin@monsoon3"}, 2},
+		// Unknown names match no events
+		{Filter{UserName: "nobody"}, 0},
+		{Filter{UserName: "admin@nowhere"}, 0},
+		{Filter{UserName: "!nobody"}, 19},
+		{Filter{ResourceType: "data/security/project", ResourceName: "ceilometer-cadf-delete-me"}, 4},
+		{Filter{ResourceType: "data/security/domain", ResourceName: "monsoon3"}, 1},
+		{Filter{ResourceType: "data/security/domain", ResourceName: "monsoon3@monsoon3"}, 0},
+	}
+	for _, test := range tests {
+		page, err := GetEvents(&test.filter, "", identity.Mock{}, eventStore)
+		require.Nil(t, err, "%+v", test.filter)
+		assert.Equal(t, test.total, page.Total, "%+v", test.filter)
+	}
+
+	for _, filter := range []Filter{
+		{UserName: "admin"},
+		{UserName: "adm*"},
+		{ResourceName: "ceilometer-cadf-delete-me"},
+		{ResourceType: "compute/server", ResourceName: "my-server"},
+		{ResourceType: "data/security/project", ResourceName: "ceilometer-cadf-delete-me", ResourceId: "b3b70c8271a845709f9a03030e705da7"},
+	} {
+		_, err := GetEvents(&filter, "", identity.Mock{}, eventStore)
+		assert.IsType(t, InvalidInputError{}, err, "%+v", filter)
+	}
+}
+
+func Test_GetEventsFacets(t *testing.T) {
+	eventStore := testStorage(t)
+
+	filter := Filter{Facets: "event_type, outcome,event_type", FacetLimit: 2, Limit: 1}
+	eventsList, err := GetEvents(&filter, "ae63ddf2076d4342a56eb049e37a7621", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(eventsList.Events))
+	assert.Equal(t, map[string]storage.AttributeValueList{
+		"event_type": {{Value: "identity.project.deleted", Count: 14}, {Value: "identity.project.created", Count: 1}},
+		"outcome":    {{Value: "success", Count: 16}},
+	}, eventsList.Facets)
+
+	// Unknown names match no events, so the facets have no values
+	filter = Filter{UserName: "nobody", Facets: "outcome"}
+	eventsList, err = GetEvents(&filter, "ae63ddf2076d4342a56eb049e37a7621", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]storage.AttributeValueList{"outcome": {}}, eventsList.Facets)
+
+	eventsList, err = GetEvents(&Filter{}, "ae63ddf2076d4342a56eb049e37a7621", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Nil(t, eventsList.Facets)
+
+	for _, filter := range []Filter{{Facets: "payload.action"}, {Facets: "outcome", FacetLimit: 1001}} {
+		_, err = GetEvents(&filter, "ae63ddf2076d4342a56eb049e37a7621", identity.Mock{}, eventStore)
+		assert.IsType(t, InvalidInputError{}, err, filter.Facets)
+	}
+}
+
+func Test_GetAttributes(t *testing.T) {
+	eventStore := testStorage(t)
+
+	values, err := GetAttributes("source", &Filter{AllTenants: true}, "", 0, identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, storage.AttributeValueList{{Value: "identity", Count: 17}, {Value: "compute", Count: 2}}, values)
+
+	// The values are counted among the events matching the filter
+	filter := Filter{UserName: "admin@monsoon3", Time: map[string]string{"gte": "2017-05-03T09:00:00"}}
+	values, err = GetAttributes("outcome", &filter, "6a030751147a45c0863c3b5bde32c744", 0, identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, storage.AttributeValueList{{Value: "failure", Count: 1}}, values)
+
+	values, err = GetAttributes("event_type", &Filter{}, "ae63ddf2076d4342a56eb049e37a7621", 2, identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, storage.AttributeValueList{
+		{Value: "identity.project.deleted", Count: 14}, {Value: "identity.project.created", Count: 1},
+	}, values)
+
+	values, err = GetAttributes("event_type", &Filter{UserName: "nobody"}, "ae63ddf2076d4342a56eb049e37a7621", 0, identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Empty(t, values)
+
+	for _, attribute := range []string{"payload.target.id", "time", ""} {
+		_, err = GetAttributes(attribute, &Filter{}, "ae63ddf2076d4342a56eb049e37a7621", 0, identity.Mock{}, eventStore)
+		assert.IsType(t, InvalidInputError{}, err, attribute)
+	}
+	_, err = GetAttributes("event_type", &Filter{}, "ae63ddf2076d4342a56eb049e37a7621", 1001, identity.Mock{}, eventStore)
+	assert.IsType(t, InvalidInputError{}, err)
+	assert.Contains(t, AttributeNames(), "initiator.user_id")
+}
@@ -0,0 +1,188 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package hermes
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/sapcc/hermes/pkg/util"
+)
+
+// Histogram counts the events matching a filter in intervals of time, as returned by GetHistogram
+//  The JSON annotations here are for the JSON to be returned by the API
+type Histogram struct {
+	// Length of the intervals, e.g. "1h"
+	Interval string `json:"interval"`
+	// Field by which the counts are split, if any
+	SplitBy string            `json:"split_by,omitempty"`
+	Buckets []HistogramBucket `json:"buckets"`
+	// Number of events in all buckets
+	Total int `json:"total"`
+}
+
+// HistogramBucket is an interval of a Histogram
+type HistogramBucket struct {
+	// Start of the interval in UTC
+	Time  string `json:"time"`
+	Count int    `json:"count"`
+	// Number of events by the value of the field that the histogram is split by
+	Counts map[string]int `json:"counts,omitempty"`
+}
+
+// DefaultHistogramInterval is the interval of histograms if none is given
+const DefaultHistogramInterval = "1h"
+
+// maxHistogramBuckets limits the number of buckets, i.e. the time range divided by the interval
+const maxHistogramBuckets = 1000
+
+var histogramIntervalRx = regexp.MustCompile(`^([1-9][0-9]*)([mhd])$`)
+
+// parseHistogramInterval parses an interval like "15m", "1h" or "7d".
+func parseHistogramInterval(interval string) (time.Duration, error) {
+	match := histogramIntervalRx.FindStringSubmatch(interval)
+	if match == nil {
+		return 0, InvalidInputError{fmt.Sprintf("interval: \"%s\" is not a valid interval, expected a number of minutes, hours or days like 15m, 1h or 7d", interval)}
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil || n > 100000 {
+		return 0, InvalidInputError{fmt.Sprintf("interval: \"%s\" is too long", interval)}
+	}
+	unit := map[string]time.Duration{"m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[match[2]]
+	return time.Duration(n) * unit, nil
+}
+
+// GetHistogram counts the events matching the filter in intervals of the given length.
+//  The time range of the filter needs a lower bound, and its upper bound defaults to now.
+//  Intervals start at multiples of their length since the epoch, so days start at
+//  midnight UTC. All intervals in the time range are returned, also those without events.
+func GetHistogram(filter *Filter, tenantId string, interval string, splitBy string, keystoneDriver identity.Identity, eventStore storage.Storage) (*Histogram, error) {
+	if interval == "" {
+		interval = DefaultHistogramInterval
+	}
+	duration, err := parseHistogramInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+	err = checkSplitBy(splitBy)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bounds of the time filter determine the buckets. They are normalized here, so
+	// that relative bounds refer to the same time as the buckets.
+	now := time.Now()
+	timeFilter, err := normalizeTimeFilter(filter.Time, filter.TimeZone, now)
+	if err != nil {
+		return nil, err
+	}
+	var start, end time.Time
+	for _, op := range []string{"gt", "gte"} {
+		if value, ok := timeFilter[op]; ok {
+			start, _ = time.Parse(time.RFC3339Nano, value)
+		}
+	}
+	if start.IsZero() {
+		return nil, InvalidInputError{"time: a histogram needs a lower bound like gte:now-24h"}
+	}
+	end = now
+	if value, ok := timeFilter["lte"]; ok {
+		end, _ = time.Parse(time.RFC3339Nano, value)
+	} else if value, ok := timeFilter["lt"]; ok {
+		end, _ = time.Parse(time.RFC3339Nano, value)
+		end = end.Add(-time.Nanosecond)
+	} else {
+		// events from the future would not be in any bucket
+		timeFilter["lte"] = now.UTC().Format(time.RFC3339Nano)
+	}
+	var times []time.Time
+	if !end.Before(start) {
+		first, last := bucketStart(start, duration), bucketStart(end, duration)
+		count := int64(last.Sub(first)/duration) + 1
+		if count > maxHistogramBuckets {
+			return nil, InvalidInputError{fmt.Sprintf("interval: the time range would be divided into %d intervals of %s, but at most %d are possible",
+				count, interval, maxHistogramBuckets)}
+		}
+		for t := first; !t.After(last); t = t.Add(duration) {
+			times = append(times, t)
+		}
+	}
+
+	histogram := Histogram{Interval: interval, SplitBy: splitBy, Buckets: []HistogramBucket{}}
+	histogramFilter := *filter
+	histogramFilter.Time, histogramFilter.TimeZone = timeFilter, ""
+	storageFilter, err := storageFilter(&histogramFilter, keystoneDriver, eventStore)
+	var storageBuckets []storage.HistogramBucket
+	if err != errNoMatch {
+		if err != nil {
+			return nil, err
+		}
+		tenantId, err = storageTenant(filter, tenantId, storageFilter, keystoneDriver)
+		if err != nil {
+			return nil, err
+		}
+		util.LogDebug("hermes.GetHistogram: tenant id is %s", tenantId)
+		storageBuckets, err = eventStore.GetHistogram(storageFilter, tenantId, duration, splitBy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The storage only returns the buckets with events
+	counts := make(map[time.Time]storage.HistogramBucket, len(storageBuckets))
+	for _, b := range storageBuckets {
+		counts[b.Time.UTC()] = b
+	}
+	for _, t := range times {
+		b := counts[t]
+		histogram.Buckets = append(histogram.Buckets, HistogramBucket{
+			Time:   t.Format(time.RFC3339),
+			Count:  b.Count,
+			Counts: b.Counts,
+		})
+		histogram.Total += b.Count
+	}
+	return &histogram, nil
+}
+
+// checkSplitBy returns an InvalidInputError if the field to split counts by is neither
+//  empty nor one of the storage.HistogramFields.
+func checkSplitBy(splitBy string) error {
+	if _, ok := storage.HistogramFields[splitBy]; splitBy != "" && !ok {
+		var fields []string
+		for field := range storage.HistogramFields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		return InvalidInputError{fmt.Sprintf("split_by: \"%s\" is not a valid field, valid fields are: %s", splitBy, strings.Join(fields, ", "))}
+	}
+	return nil
+}
+
+// bucketStart returns the start of the histogram interval that contains t.
+func bucketStart(t time.Time, interval time.Duration) time.Time {
+	return time.Unix(0, t.UnixNano()-t.UnixNano()%int64(interval)).UTC()
+}
@@ -0,0 +1,83 @@
+package hermes
+
+import (
+	"testing"
+
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_GetHistogram(t *testing.T) {
+	eventStore := testStorage(t)
+	day := map[string]string{"gte": "2017-05-02T10:00:00", "lt": "2017-05-02T13:00:00"}
+
+	histogram, err := GetHistogram(&Filter{Time: day}, "ae63ddf2076d4342a56eb049e37a7621", "1h", "", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, &Histogram{
+		Interval: "1h",
+		Buckets: []HistogramBucket{
+			{Time: "2017-05-02T10:00:00Z", Count: 2},
+			{Time: "2017-05-02T11:00:00Z", Count: 13},
+			{Time: "2017-05-02T12:00:00Z", Count: 1},
+		},
+		Total: 16,
+	}, histogram)
+
+	// Intervals without events are included, and the counts can be split by a field
+	filter := Filter{AllTenants: true, Time: map[string]string{"gte": "2017-04-30", "lt": "2017-05-04"}}
+	histogram, err = GetHistogram(&filter, "", "1d", "outcome", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, []HistogramBucket{
+		{Time: "2017-04-30T00:00:00Z", Count: 0},
+		{Time: "2017-05-01T00:00:00Z", Count: 1, Counts: map[string]int{"success": 1}},
+		{Time: "2017-05-02T00:00:00Z", Count: 16, Counts: map[string]int{"success": 16}},
+		{Time: "2017-05-03T00:00:00Z", Count: 2, Counts: map[string]int{"success": 1, "failure": 1}},
+	}, histogram.Buckets)
+	assert.Equal(t, 19, histogram.Total)
+
+	// Time zones only affect the bounds, the intervals are aligned to UTC
+	filter = Filter{EventType: "compute", AllTenants: true, Time: map[string]string{"gte": "2017-05-03T10:00:00", "lt": "2017-05-03T12:00:00"}, TimeZone: "+02:00"}
+	histogram, err = GetHistogram(&filter, "", "30m", "event_type", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, []HistogramBucket{
+		{Time: "2017-05-03T08:00:00Z", Count: 0},
+		{Time: "2017-05-03T08:30:00Z", Count: 1, Counts: map[string]int{"compute.instance.create.end": 1}},
+		{Time: "2017-05-03T09:00:00Z", Count: 0},
+		{Time: "2017-05-03T09:30:00Z", Count: 1, Counts: map[string]int{"compute.instance.delete.end": 1}},
+	}, histogram.Buckets)
+
+	// Unknown names match no events
+	histogram, err = GetHistogram(&Filter{UserName: "nobody", Time: day}, "", "", "", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, DefaultHistogramInterval, histogram.Interval)
+	assert.Equal(t, 3, len(histogram.Buckets))
+	assert.Equal(t, 0, histogram.Total)
+
+	// Without an upper bound, the intervals end now
+	histogram, err = GetHistogram(&Filter{Time: map[string]string{"gt": "now-2h"}}, "", "1h", "", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(histogram.Buckets))
+}
+
+func Test_GetHistogramInvalid(t *testing.T) {
+	eventStore := testStorage(t)
+	day := map[string]string{"gte": "2017-05-02", "lt": "2017-05-03"}
+	tests := []struct {
+		filter            Filter
+		interval, splitBy string
+	}{
+		{Filter{}, "1h", ""},
+		{Filter{Time: map[string]string{"lt": "2017-05-03"}}, "1h", ""},
+		{Filter{Time: day}, "1x", ""},
+		{Filter{Time: day}, "0h", ""},
+		{Filter{Time: day}, "1.5h", ""},
+		{Filter{Time: day}, "1h", "action"},
+		{Filter{Time: map[string]string{"gte": "2017-01-01", "lt": "2018-01-01"}}, "1h", ""},
+		{Filter{Time: day, Outcome: "!"}, "1h", ""},
+	}
+	for _, test := range tests {
+		_, err := GetHistogram(&test.filter, "", test.interval, test.splitBy, identity.Mock{}, eventStore)
+		assert.IsType(t, InvalidInputError{}, err, "%+v %s %s", test.filter, test.interval, test.splitBy)
+	}
+}
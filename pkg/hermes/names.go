@@ -0,0 +1,137 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+
+package hermes
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// errNoMatch is returned by storageFilter when the filter includes only names that do
+//  not exist in Keystone, so that no event can match it.
+var errNoMatch = errors.New("no event can match the filter")
+
+// nameLookup finds the ID of an object by name, optionally in the domain with the given name.
+type nameLookup func(name, domainName string) (string, error)
+
+// unqualified adapts the lookup of objects whose names are unique across domains.
+func unqualified(lookup func(name string) (string, error), kind string) nameLookup {
+	return func(name, domainName string) (string, error) {
+		if domainName != "" {
+			return "", identity.NameError{Kind: kind, Name: name + "@" + domainName}
+		}
+		return lookup(name)
+	}
+}
+
+// resourceLookups maps the resource types whose names are resolved through Keystone to their lookups.
+func resourceLookups(keystoneDriver identity.Identity) map[string]nameLookup {
+	return map[string]nameLookup{
+		"data/security/project": keystoneDriver.ProjectId,
+		"data/security/domain":  unqualified(keystoneDriver.DomainId, "domain"),
+		"data/security/group":   keystoneDriver.GroupId,
+		"data/security/role":    unqualified(keystoneDriver.RoleId, "role"),
+	}
+}
+
+// resourceNames maps the resource types whose names are looked up in Keystone to the lookup of their names.
+func resourceNames(keystoneDriver identity.Identity) map[string]func(id string) (string, error) {
+	return map[string]func(id string) (string, error){
+		"data/security/project": keystoneDriver.ProjectName,
+		"data/security/domain":  keystoneDriver.DomainName,
+		"data/security/group":   keystoneDriver.GroupName,
+		"data/security/role":    keystoneDriver.RoleName,
+	}
+}
+
+// resourceNameLookup returns the lookup for the resource_name parameter, which depends on
+//  the resource_type parameter.
+func resourceNameLookup(resourceType storage.ValueFilter, keystoneDriver identity.Identity) (nameLookup, error) {
+	lookups := resourceLookups(keystoneDriver)
+	if len(resourceType.Include) == 1 && len(resourceType.Exclude) == 0 {
+		if lookup, ok := lookups[resourceType.Include[0]]; ok {
+			return lookup, nil
+		}
+	}
+	var types []string
+	for resourceType := range lookups {
+		types = append(types, resourceType)
+	}
+	sort.Strings(types)
+	return nil, InvalidInputError{"resource_name: requires resource_type to be one of " + strings.Join(types, ", ")}
+}
+
+// resolveNames translates the names of a filter parameter into IDs. Names that do not
+//  exist are left out, and if that leaves none of the included names, errNoMatch is returned.
+func resolveNames(param string, names storage.ValueFilter, lookup nameLookup) (storage.ValueFilter, error) {
+	var ids storage.ValueFilter
+	for _, name := range names.Include {
+		id, err := resolveName(param, name, lookup)
+		if err != nil {
+			return ids, err
+		}
+		if id != "" {
+			ids.Include = append(ids.Include, id)
+		}
+	}
+	for _, name := range names.Exclude {
+		id, err := resolveName(param, name, lookup)
+		if err != nil {
+			return ids, err
+		}
+		if id != "" {
+			ids.Exclude = append(ids.Exclude, id)
+		}
+	}
+	if len(names.Include) > 0 && len(ids.Include) == 0 {
+		return ids, errNoMatch
+	}
+	return ids, nil
+}
+
+// resolveName returns the ID for a name, or "" if there is no such object. Names that
+//  exist in several domains can be qualified with the domain's name, as in "name@domain".
+func resolveName(param, name string, lookup nameLookup) (string, error) {
+	if strings.Contains(name, "*") {
+		return "", InvalidInputError{param + ": names cannot contain wildcards"}
+	}
+	id, err := lookup(name, "")
+	nameErr, ok := err.(identity.NameError)
+	if !ok {
+		return id, err
+	}
+	// The "@" could also be part of the name, which is why the whole name is tried first
+	if i := strings.LastIndex(name, "@"); i > 0 && i < len(name)-1 {
+		id, err = lookup(name[:i], name[i+1:])
+		if _, ok := err.(identity.NameError); !ok {
+			return id, err
+		}
+	}
+	if nameErr.Ambiguous {
+		return "", InvalidInputError{fmt.Sprintf("%s: %s, qualify it with a domain as in \"%s@<domain>\"", param, nameErr, name)}
+	}
+	return "", nil
+}
@@ -0,0 +1,271 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package hermes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// This file parses the query expressions of the q parameter, e.g.
+//
+//	outcome:failure AND initiator.host.address:10.0.* AND NOT action:read
+//
+// with this grammar:
+//
+//	query = and { "OR" and }
+//	and   = unary { [ "AND" ] unary }
+//	unary = "NOT" unary | "(" query ")" | term
+//	term  = [ field ":" ] ( word | '"' phrase '"' )
+//
+// A term with a field matches the field's value exactly, where "*" in an unquoted value
+// stands for any sequence of characters. A term without a field searches the text of
+// all fields that can be queried. The storage drivers translate the resulting
+// storage.Query into their own query language.
+
+// Limits that keep queries cheap for the storage
+const (
+	maxQueryLength = 1000
+	maxQueryDepth  = 10
+)
+
+// ParseQuery parses a query expression into a storage.Query. An empty expression
+//  results in nil. Invalid expressions result in an InvalidInputError.
+func ParseQuery(expression string) (storage.Query, error) {
+	if len(expression) > maxQueryLength {
+		return nil, queryError("is longer than %d characters", maxQueryLength)
+	}
+	tokens, err := tokenizeQuery(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := queryParser{tokens: tokens}
+	query, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, queryError("has an unexpected %s", p.peek())
+	}
+	return query, nil
+}
+
+func queryError(format string, args ...interface{}) error {
+	return InvalidInputError{"q: query " + fmt.Sprintf(format, args...)}
+}
+
+// queryToken is a parenthesis, an operator or a term of a query.
+type queryToken struct {
+	// "(", ")", "AND", "OR", "NOT" or "" for terms
+	operator string
+	field    string
+	value    string
+	quoted   bool
+}
+
+func (t queryToken) String() string {
+	if t.operator != "" {
+		return fmt.Sprintf("\"%s\"", t.operator)
+	}
+	if t.field != "" {
+		return fmt.Sprintf("term \"%s:%s\"", t.field, t.value)
+	}
+	return fmt.Sprintf("term \"%s\"", t.value)
+}
+
+func tokenizeQuery(expression string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		switch r := runes[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, queryToken{operator: string(r)})
+			i++
+		default:
+			var token queryToken
+			// a field name, or an unquoted value
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()"`, runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+			if strings.Contains(word, ":") {
+				parts := strings.SplitN(word, ":", 2)
+				token.field, word = parts[0], parts[1]
+				if token.field == "" {
+					return nil, queryError("has a term without field name before \":\"")
+				}
+			}
+			if word == "" && i < len(runes) && runes[i] == '"' {
+				// a quoted phrase, in which backslashes escape quotes and backslashes
+				var phrase []rune
+				for i++; i < len(runes) && runes[i] != '"'; i++ {
+					if runes[i] == '\\' && i+1 < len(runes) {
+						i++
+					}
+					phrase = append(phrase, runes[i])
+				}
+				if i == len(runes) {
+					return nil, queryError("has an unterminated quoted phrase")
+				}
+				i++
+				word, token.quoted = string(phrase), true
+			}
+			if token.field == "" && !token.quoted {
+				switch word {
+				case "AND", "OR", "NOT":
+					tokens = append(tokens, queryToken{operator: word})
+					continue
+				}
+			}
+			token.value = word
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+// accept consumes the next token if it is the given operator.
+func (p *queryParser) accept(operator string) bool {
+	if !p.done() && p.peek().operator == operator {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) parseOr(depth int) (storage.Query, error) {
+	var operands storage.QueryOr
+	for {
+		operand, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		if !p.accept("OR") {
+			break
+		}
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return operands, nil
+}
+
+func (p *queryParser) parseAnd(depth int) (storage.Query, error) {
+	var operands storage.QueryAnd
+	for {
+		operand, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		// adjacent terms are combined with AND, too
+		if !p.accept("AND") && (p.done() || p.peek().operator == "OR" || p.peek().operator == ")") {
+			break
+		}
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return operands, nil
+}
+
+func (p *queryParser) parseUnary(depth int) (storage.Query, error) {
+	if depth > maxQueryDepth {
+		return nil, queryError("is nested deeper than %d levels", maxQueryDepth)
+	}
+	if p.done() {
+		return nil, queryError("ends unexpectedly")
+	}
+	token := p.peek()
+	p.pos++
+	switch token.operator {
+	case "NOT":
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return storage.QueryNot{Operand: operand}, nil
+	case "(":
+		query, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, queryError("is missing \")\"")
+		}
+		return query, nil
+	case "":
+		return termQuery(token)
+	}
+	return nil, queryError("has an unexpected %s", token)
+}
+
+func termQuery(token queryToken) (storage.Query, error) {
+	if token.field == "" {
+		if !token.quoted && strings.Contains(token.value, "*") {
+			return nil, queryError("can only contain wildcards in field values, not in %s", token)
+		}
+		if strings.IndexFunc(token.value, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) < 0 {
+			return nil, queryError("has a %s without any words", token)
+		}
+		return storage.QueryText{Text: token.value}, nil
+	}
+
+	if _, ok := storage.QueryFields[token.field]; !ok {
+		var fields []string
+		for field := range storage.QueryFields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		return nil, queryError("has an unknown field \"%s\", valid fields are: %s", token.field, strings.Join(fields, ", "))
+	}
+	wildcard := !token.quoted && strings.Contains(token.value, "*")
+	if wildcard && strings.Trim(token.value, "*") == "" {
+		return nil, queryError("has a %s that only consists of wildcards", token)
+	}
+	if token.value == "" && !token.quoted {
+		return nil, queryError("has no value for field \"%s\"", token.field)
+	}
+	return storage.QueryMatch{Field: token.field, Value: token.value, Wildcard: wildcard}, nil
+}
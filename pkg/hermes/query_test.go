@@ -0,0 +1,83 @@
+package hermes
+
+import (
+	"testing"
+
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseQuery(t *testing.T) {
+	outcome := storage.QueryMatch{Field: "outcome", Value: "failure"}
+	address := storage.QueryMatch{Field: "initiator.host.address", Value: "10.0.*", Wildcard: true}
+	action := storage.QueryMatch{Field: "action", Value: "read"}
+	tests := []struct {
+		expression string
+		expected   storage.Query
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"outcome:failure", outcome},
+		{"outcome:failure AND initiator.host.address:10.0.* AND NOT action:read",
+			storage.QueryAnd{outcome, address, storage.QueryNot{Operand: action}}},
+		// AND is implied, and binds stronger than OR
+		{"outcome:failure action:read OR initiator.host.address:10.0.*",
+			storage.QueryOr{storage.QueryAnd{outcome, action}, address}},
+		{"outcome:failure AND (action:read OR NOT initiator.host.address:10.0.*)",
+			storage.QueryAnd{outcome, storage.QueryOr{action, storage.QueryNot{Operand: address}}}},
+		// Quoted values are taken literally
+		{`target.name:"my server*" "not found"`, storage.QueryAnd{
+			storage.QueryMatch{Field: "target.name", Value: "my server*"},
+			storage.QueryText{Text: "not found"},
+		}},
+		{`target.name:"say \"hi\""`, storage.QueryMatch{Field: "target.name", Value: `say "hi"`}},
+		// Only the first colon separates the field
+		{"initiator.host.address:fe80::1", storage.QueryMatch{Field: "initiator.host.address", Value: "fe80::1"}},
+		// Operators are case-sensitive
+		{"and", storage.QueryText{Text: "and"}},
+	}
+	for _, test := range tests {
+		query, err := ParseQuery(test.expression)
+		require.Nil(t, err, test.expression)
+		assert.Equal(t, test.expected, query, test.expression)
+	}
+}
+
+func Test_ParseQueryInvalid(t *testing.T) {
+	for _, expression := range []string{
+		"password:secret",
+		"outcome:",
+		":failure",
+		"outcome:*",
+		"fail*",
+		"(outcome:failure",
+		"outcome:failure)",
+		"outcome:failure AND",
+		"NOT",
+		"OR outcome:failure",
+		`target.name:"unterminated`,
+		`"?!"`,
+		"((((((((((((outcome:failure))))))))))))",
+	} {
+		_, err := ParseQuery(expression)
+		assert.IsType(t, InvalidInputError{}, err, expression)
+	}
+}
+
+func Test_GetEventsQuery(t *testing.T) {
+	page, err := GetEvents(&Filter{Query: "event_type:compute.*"}, "", identity.Mock{}, testStorage(t))
+	require.Nil(t, err)
+	assert.Equal(t, 2, page.Total)
+	for _, event := range page.Events {
+		assert.Equal(t, "compute", event.Source)
+	}
+
+	page, err = GetEvents(&Filter{Query: "NOT event_type:compute.*"}, "", identity.Mock{}, testStorage(t))
+	require.Nil(t, err)
+	assert.Equal(t, 17, page.Total)
+
+	_, err = GetEvents(&Filter{Query: "outcome:failure AND"}, "", identity.Mock{}, testStorage(t))
+	assert.IsType(t, InvalidInputError{}, err)
+}
@@ -0,0 +1,125 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package hermes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/sapcc/hermes/pkg/util"
+)
+
+// TopReport ranks the values of an event field by the number of events, as returned by GetTopReport
+//  The JSON annotations here are for the JSON to be returned by the API
+type TopReport struct {
+	// Field whose values are ranked, e.g. "initiator.user_id"
+	By string `json:"by"`
+	// Field by which the counts are split, if any
+	SplitBy string     `json:"split_by,omitempty"`
+	Values  []TopValue `json:"values"`
+}
+
+// TopValue is a value of a TopReport
+type TopValue struct {
+	Value string `json:"value"`
+	// Name of the user, project, domain, group or role with the ID in Value, if it can be looked up
+	Name  string `json:"name,omitempty"`
+	Count int    `json:"count"`
+	// Number of events by the value of the field that the report is split by
+	Counts map[string]int `json:"counts,omitempty"`
+}
+
+// DefaultTopLimit is the number of values in a TopReport if no limit is given
+const DefaultTopLimit = 10
+
+// GetTopReport ranks the values of one of the storage.TopFields among the events matching
+//  the filter by the number of events that have them, optionally split by another field
+//  like the outcome. IDs of users, and of targets of a resource type whose names are known
+//  to Keystone, are complemented with their names.
+func GetTopReport(by string, filter *Filter, tenantId string, limit uint, splitBy string, keystoneDriver identity.Identity, eventStore storage.Storage) (*TopReport, error) {
+	if _, ok := storage.TopFields[by]; !ok {
+		var fields []string
+		for field := range storage.TopFields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		return nil, InvalidInputError{fmt.Sprintf("by: \"%s\" is not a valid field, valid fields are: %s", by, strings.Join(fields, ", "))}
+	}
+	err := checkSplitBy(splitBy)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		limit = DefaultTopLimit
+	}
+	if limit > storage.MaxTopLimit {
+		return nil, InvalidInputError{fmt.Sprintf("limit %d exceeds the maximum of %d", limit, storage.MaxTopLimit)}
+	}
+
+	report := TopReport{By: by, SplitBy: splitBy, Values: []TopValue{}}
+	storageFilter, err := storageFilter(filter, keystoneDriver, eventStore)
+	if err == errNoMatch {
+		return &report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tenantId, err = storageTenant(filter, tenantId, storageFilter, keystoneDriver)
+	if err != nil {
+		return nil, err
+	}
+	util.LogDebug("hermes.GetTopReport: tenant id is %s", tenantId)
+	values, err := eventStore.GetTop(storageFilter, tenantId, by, limit, splitBy)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := topNameLookup(by, storageFilter.ResourceType, keystoneDriver)
+	for _, v := range values {
+		value := TopValue{Value: v.Value, Count: v.Count, Counts: v.Counts}
+		if lookup != nil {
+			// a missing name must not prevent the report, like in EnrichEvent
+			value.Name, err = lookup(v.Value)
+			if err != nil {
+				util.LogError("Error looking up name for %s '%s': %s", by, v.Value, err.Error())
+			}
+		}
+		report.Values = append(report.Values, value)
+	}
+	return &report, nil
+}
+
+// topNameLookup returns the lookup of names for the values of a TopReport, or nil if
+//  they have no names. The names of targets depend on their type, so they are only
+//  looked up if the resource_type filter selects a single type with names in Keystone.
+func topNameLookup(by string, resourceType storage.ValueFilter, keystoneDriver identity.Identity) func(id string) (string, error) {
+	switch by {
+	case "initiator.user_id":
+		return keystoneDriver.UserName
+	case "target.id":
+		if len(resourceType.Include) == 1 && len(resourceType.Exclude) == 0 {
+			return resourceNames(keystoneDriver)[resourceType.Include[0]]
+		}
+	}
+	return nil
+}
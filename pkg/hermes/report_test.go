@@ -0,0 +1,63 @@
+package hermes
+
+import (
+	"testing"
+
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_GetTopReport(t *testing.T) {
+	eventStore := testStorage(t)
+
+	// Users have names, and the counts can be split by outcome
+	report, err := GetTopReport("initiator.user_id", &Filter{AllTenants: true}, "", 0, "outcome", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, &TopReport{
+		By:      "initiator.user_id",
+		SplitBy: "outcome",
+		Values: []TopValue{
+			{Value: "eb5cd8f904b06e8b2a6eb86c8b04c08e6efb89b92da77905cc8c475f30b0b812", Name: "I056593", Count: 17, Counts: map[string]int{"success": 17}},
+			{Value: "a2f5e2b8c1d04a1e9d5b2c7f3e6a9d10", Name: "I056593", Count: 2, Counts: map[string]int{"success": 1, "failure": 1}},
+		},
+	}, report)
+
+	// Targets only have names if the resource type is known
+	filter := Filter{ResourceType: "data/security/project"}
+	report, err = GetTopReport("target.id", &filter, "ae63ddf2076d4342a56eb049e37a7621", 1, "", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, []TopValue{{Value: "b3b70c8271a845709f9a03030e705da7", Name: "ceilometer-cadf-delete-me", Count: 4}}, report.Values)
+
+	report, err = GetTopReport("target.id", &Filter{AllTenants: true, Source: "compute"}, "", 0, "", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, []TopValue{{Value: "8d0b4f3e-1c2a-4e6b-9f7d-2a3b4c5d6e7f", Count: 2}}, report.Values)
+
+	// The report covers the events matching the filter
+	filter = Filter{AllTenants: true, Time: map[string]string{"gte": "2017-05-03"}}
+	report, err = GetTopReport("initiator.host.address", &filter, "", 0, "", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, []TopValue{{Value: "10.0.0.23", Count: 2}}, report.Values)
+
+	// Unknown names match no events
+	report, err = GetTopReport("action", &Filter{UserName: "nobody"}, "", 0, "", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, []TopValue{}, report.Values)
+}
+
+func Test_GetTopReportInvalid(t *testing.T) {
+	eventStore := testStorage(t)
+	tests := []struct {
+		by, splitBy string
+		limit       uint
+	}{
+		{"", "", 0},
+		{"event_type", "", 0},
+		{"action", "action", 0},
+		{"action", "", 101},
+	}
+	for _, test := range tests {
+		_, err := GetTopReport(test.by, &Filter{}, "", test.limit, test.splitBy, identity.Mock{}, eventStore)
+		assert.IsType(t, InvalidInputError{}, err, "%+v", test)
+	}
+}
@@ -0,0 +1,138 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package hermes
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/sapcc/hermes/pkg/util"
+)
+
+// ResourceEvents is the history of a resource, as returned by GetResourceEvents
+//  The JSON annotations here are for the JSON to be returned by the API
+type ResourceEvents struct {
+	ResourceId string `json:"resource_id"`
+	// Type of the resource in its latest event
+	ResourceType string `json:"resource_type,omitempty"`
+	// Times of the first and the last event, or empty if there are none
+	FirstSeen string `json:"first_seen,omitempty"`
+	LastSeen  string `json:"last_seen,omitempty"`
+	// Number of events in all actions
+	Total int `json:"total"`
+	// The events grouped by action, in the order in which the actions first occurred
+	Actions []ResourceAction `json:"actions"`
+}
+
+// ResourceAction contains the events of a resource with the same action
+type ResourceAction struct {
+	Action    string `json:"action"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+	Count     int    `json:"count"`
+	// The events in chronological order
+	Events []*ListEvent `json:"events"`
+}
+
+// maxResourceEvents limits the number of events that GetResourceEvents returns,
+//  resourceEventsPageSize the number of events it reads from the storage at once.
+const (
+	maxResourceEvents      = 10000
+	resourceEventsPageSize = 1000
+)
+
+// GetResourceEvents returns all events matching the filter whose target is the resource
+//  with the given ID, grouped by action. Since only the events are searched, this works
+//  for resources that have been deleted as well.
+func GetResourceEvents(resourceId string, filter *Filter, tenantId string, keystoneDriver identity.Identity, eventStore storage.Storage) (*ResourceEvents, error) {
+	if resourceId == "" || strings.Contains(resourceId, "*") {
+		return nil, InvalidInputError{fmt.Sprintf("resource_id: \"%s\" is not a valid resource ID", resourceId)}
+	}
+	if filter.ResourceId != "" || filter.ResourceName != "" {
+		return nil, InvalidInputError{"resource_id and resource_name cannot be combined with the resource in the path"}
+	}
+	filter.Offset, filter.Cursor = 0, ""
+	filter.Limit = resourceEventsPageSize
+	if filter.Limit > eventStore.MaxLimit() {
+		filter.Limit = eventStore.MaxLimit()
+	}
+	filter.Sort = []FieldOrder{{Fieldname: "time", Order: "asc"}}
+
+	result := ResourceEvents{ResourceId: resourceId, Actions: []ResourceAction{}}
+	storageFilter, err := storageFilter(filter, keystoneDriver, eventStore)
+	if err == errNoMatch {
+		return &result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	storageFilter.ResourceId = storage.Values(resourceId)
+	tenantId, err = storageTenant(filter, tenantId, storageFilter, keystoneDriver)
+	if err != nil {
+		return nil, err
+	}
+	util.LogDebug("hermes.GetResourceEvents: tenant id is %s", tenantId)
+
+	// The events are read page by page, following the cursors of the storage
+	var storageEvents []*storage.EventDetail
+	for {
+		page, err := eventStore.GetEvents(storageFilter, tenantId)
+		if err != nil {
+			return nil, err
+		}
+		if page.Total > maxResourceEvents {
+			return nil, InvalidInputError{fmt.Sprintf("resource %s has %d events, more than the maximum of %d, use the time parameter to select fewer of them",
+				resourceId, page.Total, maxResourceEvents)}
+		}
+		storageEvents = append(storageEvents, page.Events...)
+		if page.Next == nil {
+			break
+		}
+		storageFilter.Cursor = page.Next
+	}
+
+	events, err := eventsList(storageEvents, keystoneDriver)
+	if err != nil {
+		return nil, err
+	}
+	labelTenants(events, storageEvents, filter)
+	groups := make(map[string]int)
+	for i, event := range events {
+		action := storageEvents[i].Payload.Action
+		g, ok := groups[action]
+		if !ok {
+			g = len(result.Actions)
+			groups[action] = g
+			result.Actions = append(result.Actions, ResourceAction{Action: action, FirstSeen: event.Time})
+		}
+		group := &result.Actions[g]
+		group.LastSeen = event.Time
+		group.Count++
+		group.Events = append(group.Events, event)
+	}
+	if len(events) > 0 {
+		result.FirstSeen, result.LastSeen = events[0].Time, events[len(events)-1].Time
+		result.ResourceType = events[len(events)-1].ResourceType
+	}
+	result.Total = len(events)
+	return &result, nil
+}
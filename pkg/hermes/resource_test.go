@@ -0,0 +1,57 @@
+package hermes
+
+import (
+	"testing"
+
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_GetResourceEvents(t *testing.T) {
+	eventStore := testStorage(t)
+
+	// The project has been deleted, but its events remain
+	resource, err := GetResourceEvents("b3b70c8271a845709f9a03030e705da7", &Filter{}, "ae63ddf2076d4342a56eb049e37a7621", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, "b3b70c8271a845709f9a03030e705da7", resource.ResourceId)
+	assert.Equal(t, "data/security/project", resource.ResourceType)
+	assert.Equal(t, "2017-05-02T10:12:03.441207+0000", resource.FirstSeen)
+	assert.Equal(t, "2017-05-02T12:02:46.726056+0000", resource.LastSeen)
+	assert.Equal(t, 4, resource.Total)
+	require.Equal(t, 2, len(resource.Actions))
+	created, deleted := resource.Actions[0], resource.Actions[1]
+	assert.Equal(t, "created.project", created.Action)
+	assert.Equal(t, 1, created.Count)
+	assert.Equal(t, "2017-05-02T10:12:03.441207+0000", created.FirstSeen)
+	assert.Equal(t, "deleted.project", deleted.Action)
+	assert.Equal(t, 3, deleted.Count)
+	assert.Equal(t, "2017-05-02T11:45:44.755215+0000", deleted.FirstSeen)
+	assert.Equal(t, "2017-05-02T12:02:46.726056+0000", deleted.LastSeen)
+	var times []string
+	for _, event := range deleted.Events {
+		times = append(times, event.Time)
+	}
+	assert.Equal(t, []string{"2017-05-02T11:45:44.755215+0000", "2017-05-02T11:45:49.982112+0000", "2017-05-02T12:02:46.726056+0000"}, times)
+
+	// The other filters apply as well
+	filter := Filter{AllTenants: true, Time: map[string]string{"gte": "2017-05-03T09:00:00"}}
+	resource, err = GetResourceEvents("8d0b4f3e-1c2a-4e6b-9f7d-2a3b4c5d6e7f", &filter, "", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(resource.Actions))
+	assert.Equal(t, "delete", resource.Actions[0].Action)
+	assert.Equal(t, "6a030751147a45c0863c3b5bde32c744", resource.Actions[0].Events[0].TenantID)
+
+	// Resources without events are not an error
+	resource, err = GetResourceEvents("unknown", &Filter{}, "ae63ddf2076d4342a56eb049e37a7621", identity.Mock{}, eventStore)
+	require.Nil(t, err)
+	assert.Equal(t, 0, resource.Total)
+	assert.Equal(t, []ResourceAction{}, resource.Actions)
+
+	for _, filter := range []Filter{{ResourceId: "other"}, {ResourceName: "other", ResourceType: "data/security/project"}} {
+		_, err = GetResourceEvents("b3b70c8271a845709f9a03030e705da7", &filter, "", identity.Mock{}, eventStore)
+		assert.IsType(t, InvalidInputError{}, err)
+	}
+	_, err = GetResourceEvents("b3b70c*", &Filter{}, "", identity.Mock{}, eventStore)
+	assert.IsType(t, InvalidInputError{}, err)
+}
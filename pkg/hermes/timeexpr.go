@@ -0,0 +1,210 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+
+package hermes
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file parses the bounds of the time filter. Besides absolute timestamps, they can
+// be expressions relative to the current time, in the date math of ElasticSearch:
+//
+//	now-24h         24 hours ago
+//	now-1d/d        the start of yesterday
+//	now/M           the start of this month
+//	2017-05-02||+1w one week after May 2nd, 2017
+//
+// Each "+" or "-" adds or subtracts a duration like "1h30m", and "/" rounds to the start
+// of a unit, or for the bounds "gt" and "lte", to the end of the unit. The units are y
+// (years), M (months), w (weeks), d (days), h (hours), m (minutes) and s (seconds).
+// Timestamps without time zone, and the rounding to days and longer units, use the
+// time zone of the filter, which defaults to UTC.
+
+// Formats of absolute timestamps. The fractions of seconds are optional in all of them.
+var timeExpressionFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+var timeOperationRx = regexp.MustCompile(`^([+-])((?:[0-9]+[yMwdhms])+)|^/([yMwdhms])`)
+var durationPartRx = regexp.MustCompile(`([0-9]+)([yMwdhms])`)
+
+// normalizeTimeFilter parses the bounds of a time filter into UTC timestamps in RFC 3339
+//  format, which all storage drivers understand.
+func normalizeTimeFilter(filter map[string]string, timeZone string, now time.Time) (map[string]string, error) {
+	if len(filter) == 0 {
+		return filter, nil
+	}
+	loc, err := parseTimeZone(timeZone)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(filter))
+	for op, expression := range filter {
+		t, err := ParseTimeExpression(expression, op == "gt" || op == "lte", now.In(loc))
+		if err != nil {
+			return nil, err
+		}
+		result[op] = t.UTC().Format(time.RFC3339Nano)
+	}
+	return result, nil
+}
+
+// parseTimeZone parses the name of a time zone, like "Europe/Berlin", or a UTC offset like "+02:00".
+func parseTimeZone(timeZone string) (*time.Location, error) {
+	if timeZone == "" {
+		return time.UTC, nil
+	}
+	for _, format := range []string{"-07:00", "-0700"} {
+		t, err := time.Parse(format, strings.Replace(timeZone, " ", "+", 1))
+		if err == nil {
+			_, offset := t.Zone()
+			return time.FixedZone(timeZone, offset), nil
+		}
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, InvalidInputError{fmt.Sprintf("time_zone: unknown time zone \"%s\"", timeZone)}
+	}
+	return loc, nil
+}
+
+// ParseTimeExpression parses an absolute timestamp or an expression relative to now, see
+//  above. Rounding goes to the end of units if roundUp is set. The result is in the time
+//  zone of now, unless the expression has its own. Invalid expressions result in an
+//  InvalidInputError.
+func ParseTimeExpression(expression string, roundUp bool, now time.Time) (time.Time, error) {
+	// In URLs, "+" stands for a space, so it is easy to forget encoding it
+	math := strings.Replace(strings.TrimSpace(expression), " ", "+", -1)
+
+	var t time.Time
+	switch {
+	case strings.HasPrefix(math, "now"):
+		t, math = now, strings.TrimPrefix(math, "now")
+	case strings.Contains(math, "||"):
+		parts := strings.SplitN(math, "||", 2)
+		var ok bool
+		t, ok = parseTimestamp(parts[0], now.Location())
+		if !ok {
+			return t, timeExpressionError(expression, fmt.Sprintf("\"%s\" is not a valid timestamp", parts[0]))
+		}
+		math = parts[1]
+		if math == "" {
+			return t, timeExpressionError(expression, "expected an expression like +1d after \"||\"")
+		}
+	default:
+		t, ok := parseTimestamp(math, now.Location())
+		if !ok {
+			return t, timeExpressionError(expression, "expected a timestamp like 2017-05-02T10:00:00Z, or an expression like now-24h")
+		}
+		return t, nil
+	}
+
+	for math != "" {
+		match := timeOperationRx.FindStringSubmatch(math)
+		if match == nil {
+			return t, timeExpressionError(expression, fmt.Sprintf("cannot parse \"%s\"", math))
+		}
+		math = math[len(match[0]):]
+		if match[3] != "" {
+			t = roundTime(t, match[3], roundUp)
+			continue
+		}
+		sign := 1
+		if match[1] == "-" {
+			sign = -1
+		}
+		for _, part := range durationPartRx.FindAllStringSubmatch(match[2], -1) {
+			n, err := strconv.Atoi(part[1])
+			if err != nil || n > 100000 {
+				return t, timeExpressionError(expression, fmt.Sprintf("%s is too large", part[0]))
+			}
+			t = addTime(t, sign*n, part[2])
+		}
+	}
+	return t, nil
+}
+
+func timeExpressionError(expression, reason string) error {
+	return InvalidInputError{fmt.Sprintf("time: invalid time \"%s\": %s", expression, reason)}
+}
+
+func parseTimestamp(value string, loc *time.Location) (time.Time, bool) {
+	for _, format := range timeExpressionFormats {
+		t, err := time.ParseInLocation(format, value, loc)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func addTime(t time.Time, n int, unit string) time.Time {
+	switch unit {
+	case "y":
+		return t.AddDate(n, 0, 0)
+	case "M":
+		return t.AddDate(0, n, 0)
+	case "w":
+		return t.AddDate(0, 0, 7*n)
+	case "d":
+		return t.AddDate(0, 0, n)
+	case "h":
+		return t.Add(time.Duration(n) * time.Hour)
+	case "m":
+		return t.Add(time.Duration(n) * time.Minute)
+	}
+	return t.Add(time.Duration(n) * time.Second)
+}
+
+// roundTime rounds down to the start of the unit, or up to its last millisecond, like
+//  ElasticSearch does. Weeks start on Monday.
+func roundTime(t time.Time, unit string, roundUp bool) time.Time {
+	year, month, day := t.Date()
+	hour, minute, second := t.Clock()
+	switch unit {
+	case "y":
+		t = time.Date(year, 1, 1, 0, 0, 0, 0, t.Location())
+	case "M":
+		t = time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	case "w":
+		t = time.Date(year, month, day-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	case "d":
+		t = time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	case "h":
+		t = time.Date(year, month, day, hour, 0, 0, 0, t.Location())
+	case "m":
+		t = time.Date(year, month, day, hour, minute, 0, 0, t.Location())
+	case "s":
+		t = time.Date(year, month, day, hour, minute, second, 0, t.Location())
+	}
+	if roundUp {
+		t = addTime(t, 1, unit).Add(-time.Millisecond)
+	}
+	return t
+}
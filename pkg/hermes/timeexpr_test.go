@@ -0,0 +1,77 @@
+package hermes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseTimeExpression(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2017, 5, 3, 14, 25, 36, 500000000, time.UTC)
+	tests := []struct {
+		expression string
+		roundUp    bool
+		expected   string
+	}{
+		{"2017-05-02T10:00:00Z", false, "2017-05-02T10:00:00Z"},
+		{"2017-05-02T10:00:00.123456+0200", false, "2017-05-02T08:00:00.123456Z"},
+		{"2017-05-02T10:00:00+02:00", false, "2017-05-02T08:00:00Z"},
+		{"2017-05-02T10:00:00 02:00", false, "2017-05-02T08:00:00Z"},
+		{"2017-05-02T10:00:00", false, "2017-05-02T10:00:00Z"},
+		{"2017-05-02T10:00", false, "2017-05-02T10:00:00Z"},
+		{"2017-05-02", false, "2017-05-02T00:00:00Z"},
+		{"now", false, "2017-05-03T14:25:36.5Z"},
+		{"now-24h", false, "2017-05-02T14:25:36.5Z"},
+		{"now-1h30m", false, "2017-05-03T12:55:36.5Z"},
+		{"now+1d", false, "2017-05-04T14:25:36.5Z"},
+		{"now 1d", false, "2017-05-04T14:25:36.5Z"},
+		{"now-1M", false, "2017-04-03T14:25:36.5Z"},
+		{"now/d", false, "2017-05-03T00:00:00Z"},
+		{"now/d", true, "2017-05-03T23:59:59.999Z"},
+		{"now-1d/d", false, "2017-05-02T00:00:00Z"},
+		{"now/w", false, "2017-05-01T00:00:00Z"},
+		{"now/M", true, "2017-05-31T23:59:59.999Z"},
+		{"now/y", false, "2017-01-01T00:00:00Z"},
+		{"now/h-1h", false, "2017-05-03T13:00:00Z"},
+		{"now/s", false, "2017-05-03T14:25:36Z"},
+		{"2017-05-02||+1w", false, "2017-05-09T00:00:00Z"},
+		{"2017-05-02T10:00:00+02:00||/d", false, "2017-05-01T22:00:00Z"},
+	}
+	for _, test := range tests {
+		actual, err := ParseTimeExpression(test.expression, test.roundUp, now)
+		require.Nil(t, err, test.expression)
+		assert.Equal(t, test.expected, actual.UTC().Format(time.RFC3339Nano), test.expression)
+	}
+
+	for _, expression := range []string{
+		"", "yesterday", "2017-05-32", "2017/05/02", "now-", "now-1", "now-1x", "now/2d", "now-1d/", "nowadays",
+		"2017-05-02||", "05/02/2017||+1d", "now-1000000000d",
+	} {
+		_, err := ParseTimeExpression(expression, false, now)
+		assert.IsType(t, InvalidInputError{}, err, expression)
+	}
+}
+
+func Test_NormalizeTimeFilter(t *testing.T) {
+	now := time.Date(2017, 5, 3, 1, 0, 0, 0, time.UTC)
+	filter := map[string]string{"gte": "now/d", "lte": "2017-05-03T12:00:00"}
+
+	actual, err := normalizeTimeFilter(filter, "", now)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"gte": "2017-05-03T00:00:00Z", "lte": "2017-05-03T12:00:00Z"}, actual)
+
+	// Days start at midnight of the time zone, which is still May 2nd in New York
+	for _, timeZone := range []string{"-04:00", "America/New_York"} {
+		actual, err = normalizeTimeFilter(filter, timeZone, now)
+		require.Nil(t, err, timeZone)
+		assert.Equal(t, map[string]string{"gte": "2017-05-02T04:00:00Z", "lte": "2017-05-03T16:00:00Z"}, actual, timeZone)
+	}
+
+	_, err = normalizeTimeFilter(filter, "Mars/Olympus_Mons", now)
+	assert.IsType(t, InvalidInputError{}, err)
+	_, err = normalizeTimeFilter(map[string]string{"gt": "garbage"}, "", now)
+	assert.IsType(t, InvalidInputError{}, err)
+}
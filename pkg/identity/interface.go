@@ -20,6 +20,8 @@
 package identity
 
 import (
+	"fmt"
+
 	policy "github.com/databus23/goslo.policy"
 	"github.com/gophercloud/gophercloud"
 )
@@ -38,8 +40,33 @@ type Identity interface {
 	Authenticate(credentials *gophercloud.AuthOptions) (policy.Context, error)
 	DomainName(id string) (string, error)
 	ProjectName(id string) (string, error)
+	ProjectDomainId(id string) (string, error)
+	DomainProjectIds(domainId string, subtree bool) ([]string, error)
 	UserName(id string) (string, error)
-	UserId(name string) (string, error)
 	RoleName(id string) (string, error)
 	GroupName(id string) (string, error)
+	//The lookups of IDs by name return a NameError if there is no object with that
+	//name, or several. Users, projects and groups can be looked up in a domain given
+	//by its name, since their names are only unique within a domain.
+	UserId(name, domainName string) (string, error)
+	ProjectId(name, domainName string) (string, error)
+	DomainId(name string) (string, error)
+	GroupId(name, domainName string) (string, error)
+	RoleId(name string) (string, error)
+}
+
+// NameError is returned when a name cannot be resolved to an ID, because there is no
+// object of that kind with that name, or because there are several in different domains.
+type NameError struct {
+	// "user", "project", "domain", "group" or "role"
+	Kind      string
+	Name      string
+	Ambiguous bool
+}
+
+func (e NameError) Error() string {
+	if e.Ambiguous {
+		return fmt.Sprintf("there are several %ss named \"%s\"", e.Kind, e.Name)
+	}
+	return fmt.Sprintf("no %s named \"%s\"", e.Kind, e.Name)
 }
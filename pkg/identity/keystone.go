@@ -21,12 +21,12 @@ package identity
 
 import (
 	"fmt"
+	"net/url"
 
 	policy "github.com/databus23/goslo.policy"
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
-	"github.com/pkg/errors"
 	"github.com/sapcc/hermes/pkg/util"
 	"github.com/spf13/viper"
 	"sync"
@@ -65,6 +65,13 @@ type keystoneNameId struct {
 	Name string `json:"name"`
 }
 
+//keystoneProject describes the name, id and domain of a Keystone project.
+//  The JSON mappings here are for parsing Keystone responses
+type keystoneProject struct {
+	keystoneNameId
+	DomainID string `json:"domain_id"`
+}
+
 func (d Keystone) keystoneClient() (*gophercloud.ServiceClient, error) {
 	if d.TokenRenewalMutex == nil {
 		d.TokenRenewalMutex = &sync.Mutex{}
@@ -177,26 +184,85 @@ func (d Keystone) ProjectName(id string) (string, error) {
 		return cachedName, nil
 	}
 
+	project, err := d.getProject(id)
+	return project.Name, err
+}
+
+func (d Keystone) ProjectDomainId(id string) (string, error) {
+	cachedId, hit := getFromCache(projectDomainCache, id)
+	if hit {
+		return cachedId, nil
+	}
+
+	project, err := d.getProject(id)
+	return project.DomainID, err
+}
+
+//getProject fetches a project from Keystone, and adds its name and domain to the caches.
+func (d Keystone) getProject(id string) (keystoneProject, error) {
 	client, err := d.keystoneClient()
 	if err != nil {
-		return "", err
+		return keystoneProject{}, err
 	}
 
 	var result gophercloud.Result
 	url := client.ServiceURL(fmt.Sprintf("projects/%s", id))
 	_, err = client.Get(url, &result.Body, nil)
 	if err != nil {
-		return "", err
+		return keystoneProject{}, err
 	}
 
 	var data struct {
-		Project keystoneNameId `json:"project"`
+		Project keystoneProject `json:"project"`
 	}
 	err = result.ExtractInto(&data)
 	if err == nil {
 		updateCache(projectNameCache, id, data.Project.Name)
+		updateCache(projectDomainCache, id, data.Project.DomainID)
+	}
+	return data.Project, err
+}
+
+//DomainProjectIds lists the projects in a domain. Without subtree, only the projects directly
+//  in the domain are listed, but not the projects nested in them.
+func (d Keystone) DomainProjectIds(domainId string, subtree bool) ([]string, error) {
+	client, err := d.keystoneClient()
+	if err != nil {
+		return nil, err
+	}
+
+	//projects directly in the domain have the domain as parent
+	query := url.Values{"parent_id": {domainId}}
+	if subtree {
+		query = url.Values{"domain_id": {domainId}}
+	}
+	nextURL := client.ServiceURL("projects") + "?" + query.Encode()
+	var ids []string
+	for nextURL != "" {
+		var result gophercloud.Result
+		_, err = client.Get(nextURL, &result.Body, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var data struct {
+			Projects []keystoneProject `json:"projects"`
+			Links    struct {
+				Next string `json:"next"`
+			} `json:"links"`
+		}
+		err = result.ExtractInto(&data)
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range data.Projects {
+			ids = append(ids, project.UUID)
+			updateCache(projectNameCache, project.UUID, project.Name)
+			updateCache(projectDomainCache, project.UUID, project.DomainID)
+		}
+		nextURL = data.Links.Next
 	}
-	return data.Project.Name, err
+	return ids, nil
 }
 
 func (d Keystone) UserName(id string) (string, error) {
@@ -223,48 +289,77 @@ func (d Keystone) UserName(id string) (string, error) {
 	err = result.ExtractInto(&data)
 	if err == nil {
 		updateCache(userNameCache, id, data.User.Name)
-		updateCache(userIdCache, data.User.Name, id)
 	}
 	return data.User.Name, err
 }
 
-func (d Keystone) UserId(name string) (string, error) {
-	cachedId, hit := getFromCache(userIdCache, name)
+func (d Keystone) UserId(name, domainName string) (string, error) {
+	return d.lookupId(userIdCache, "user", "users", name, domainName)
+}
+
+func (d Keystone) ProjectId(name, domainName string) (string, error) {
+	return d.lookupId(projectIdCache, "project", "projects", name, domainName)
+}
+
+func (d Keystone) DomainId(name string) (string, error) {
+	return d.lookupId(domainIdCache, "domain", "domains", name, "")
+}
+
+func (d Keystone) GroupId(name, domainName string) (string, error) {
+	return d.lookupId(groupIdCache, "group", "groups", name, domainName)
+}
+
+func (d Keystone) RoleId(name string) (string, error) {
+	return d.lookupId(roleIdCache, "role", "roles", name, "")
+}
+
+//lookupId finds the ID of the object of a Keystone collection, e.g. "users", that has the
+//  given name. With a domainName, only the objects in that domain are considered.
+func (d Keystone) lookupId(idCache *cache, kind, collection, name, domainName string) (string, error) {
+	cacheKey := name
+	if domainName != "" {
+		cacheKey = name + "@" + domainName
+	}
+	cachedId, hit := getFromCache(idCache, cacheKey)
 	if hit {
 		return cachedId, nil
 	}
 
+	query := url.Values{"name": {name}}
+	if domainName != "" {
+		domainId, err := d.DomainId(domainName)
+		if err != nil {
+			return "", err
+		}
+		query.Set("domain_id", domainId)
+	}
+
 	client, err := d.keystoneClient()
 	if err != nil {
 		return "", err
 	}
 
 	var result gophercloud.Result
-	url := client.ServiceURL(fmt.Sprintf("users?name=%s", name))
-	_, err = client.Get(url, &result.Body, nil)
+	_, err = client.Get(client.ServiceURL(collection)+"?"+query.Encode(), &result.Body, nil)
 	if err != nil {
 		return "", err
 	}
 
-	var data struct {
-		User []keystoneNameId `json:"user"`
+	var objects []keystoneNameId
+	err = result.ExtractIntoSlicePtr(&objects, collection)
+	if err != nil {
+		return "", err
 	}
-	err = result.ExtractInto(&data)
-	userId := ""
-	if err == nil {
-		switch len(data.User) {
-		case 0:
-			err = errors.Errorf("No user found with name %s", name)
-		case 1:
-			userId = data.User[0].UUID
-		default:
-			util.LogWarning("Multiple users found with name %s - returning the first one", name)
-			userId = data.User[0].UUID
-		}
-		updateCache(userIdCache, name, userId)
-		updateCache(userNameCache, userId, name)
+	switch len(objects) {
+	case 0:
+		return "", NameError{Kind: kind, Name: name}
+	case 1:
+		updateCache(idCache, cacheKey, objects[0].UUID)
+		return objects[0].UUID, nil
+	default:
+		util.LogDebug("Found %d %s with name %s", len(objects), collection, name)
+		return "", NameError{Kind: kind, Name: name, Ambiguous: true}
 	}
-	return userId, err
 }
 
 func (d Keystone) RoleName(id string) (string, error) {
@@ -334,9 +429,16 @@ func (d Keystone) updateCaches(token *keystoneToken, tokenStr string) {
 	if token.ProjectScope.ID != "" && token.ProjectScope.Name != "" {
 		updateCache(projectNameCache, token.ProjectScope.ID, token.ProjectScope.Name)
 	}
+	if token.ProjectScope.ID != "" && token.ProjectScope.Domain.ID != "" {
+		updateCache(projectDomainCache, token.ProjectScope.ID, token.ProjectScope.Domain.ID)
+	}
 	if token.User.ID != "" && token.User.Name != "" {
 		updateCache(userNameCache, token.User.ID, token.User.Name)
-		updateCache(userIdCache, token.User.Name, token.User.ID)
+	}
+	// user names are only unique within a domain, so the ID is only cached for the
+	// qualified name, which lookupId uses when a domain is given
+	if token.User.ID != "" && token.User.Name != "" && token.User.Domain.Name != "" {
+		updateCache(userIdCache, token.User.Name+"@"+token.User.Domain.Name, token.User.ID)
 	}
 	for _, role := range token.Roles {
 		if role.ID != "" && role.Name != "" {
@@ -20,10 +20,15 @@ type cache struct {
 var providerClient *gophercloud.ProviderClient
 var domainNameCache *cache
 var projectNameCache *cache
+var projectDomainCache *cache
 var userNameCache *cache
 var userIdCache *cache
 var roleNameCache *cache
 var groupNameCache *cache
+var projectIdCache *cache
+var domainIdCache *cache
+var groupIdCache *cache
+var roleIdCache *cache
 
 // Token cache
 type keystoneTokenCache struct {
@@ -44,10 +49,15 @@ var tokenCache *keystoneTokenCache
 func init() {
 	domainNameCache = &cache{m: make(map[string]string)}
 	projectNameCache = &cache{m: make(map[string]string)}
+	projectDomainCache = &cache{m: make(map[string]string)}
 	userNameCache = &cache{m: make(map[string]string)}
 	userIdCache = &cache{m: make(map[string]string)}
 	roleNameCache = &cache{m: make(map[string]string)}
 	groupNameCache = &cache{m: make(map[string]string)}
+	projectIdCache = &cache{m: make(map[string]string)}
+	domainIdCache = &cache{m: make(map[string]string)}
+	groupIdCache = &cache{m: make(map[string]string)}
+	roleIdCache = &cache{m: make(map[string]string)}
 	tokenCache = &keystoneTokenCache{
 		tMap:  make(map[string]*keystoneToken),
 		eMap:  make(map[time.Time][]string),
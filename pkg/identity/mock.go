@@ -33,12 +33,16 @@ func (d Mock) ProjectName(id string) (string, error) {
 	return "ceilometer-cadf-delete-me", nil
 }
 
-func (d Mock) UserName(id string) (string, error) {
-	return "I056593", nil
+func (d Mock) ProjectDomainId(id string) (string, error) {
+	return "39a253e16e4a4a3686edca72c8e101bc", nil
+}
+
+func (d Mock) DomainProjectIds(domainId string, subtree bool) ([]string, error) {
+	return []string{"ae63ddf2076d4342a56eb049e37a7621", "6a030751147a45c0863c3b5bde32c744"}, nil
 }
 
-func (d Mock) UserId(name string) (string, error) {
-	return "eb5cd8f904b06e8b2a6eb86c8b04c08e6efb89b92da77905cc8c475f30b0b812", nil
+func (d Mock) UserName(id string) (string, error) {
+	return "I056593", nil
 }
 
 func (d Mock) RoleName(id string) (string, error) {
@@ -49,6 +53,56 @@ func (d Mock) GroupName(id string) (string, error) {
 	return "admins", nil
 }
 
+// The objects whose IDs the Mock can look up by name. The user "admin" exists in two
+// domains, so that it can only be found with a domain.
+var mockObjects = []struct{ kind, domain, name, id string }{
+	{"user", "monsoon3", "I056593", "eb5cd8f904b06e8b2a6eb86c8b04c08e6efb89b92da77905cc8c475f30b0b812"},
+	{"user", "monsoon3", "admin", "a2f5e2b8c1d04a1e9d5b2c7f3e6a9d10"},
+	{"user", "ccadmin", "admin", "c5b2e9a8f7d64c1b8e3a2d1f0e9c8b7a"},
+	{"project", "monsoon3", "ceilometer-cadf-delete-me", "b3b70c8271a845709f9a03030e705da7"},
+	{"domain", "", "monsoon3", "39a253e16e4a4a3686edca72c8e101bc"},
+	{"domain", "", "ccadmin", "e1a5b8f2d3c94e6a8b7f0c2d4e6a8b0c"},
+	{"group", "monsoon3", "admins", "0e2c4a6b8d0f4e2a9c1b3d5f7a9c1e3b"},
+	{"role", "", "audit_viewer", "7f3a1c5e9b2d4f6a8c0e2b4d6f8a0c2e"},
+}
+
+func mockLookup(kind, name, domainName string) (string, error) {
+	var ids []string
+	for _, object := range mockObjects {
+		if object.kind == kind && object.name == name && (domainName == "" || object.domain == domainName) {
+			ids = append(ids, object.id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", NameError{Kind: kind, Name: name}
+	case 1:
+		return ids[0], nil
+	default:
+		return "", NameError{Kind: kind, Name: name, Ambiguous: true}
+	}
+}
+
+func (d Mock) UserId(name, domainName string) (string, error) {
+	return mockLookup("user", name, domainName)
+}
+
+func (d Mock) ProjectId(name, domainName string) (string, error) {
+	return mockLookup("project", name, domainName)
+}
+
+func (d Mock) DomainId(name string) (string, error) {
+	return mockLookup("domain", name, "")
+}
+
+func (d Mock) GroupId(name, domainName string) (string, error) {
+	return mockLookup("group", name, domainName)
+}
+
+func (d Mock) RoleId(name string) (string, error) {
+	return mockLookup("role", name, "")
+}
+
 func (d Mock) AuthOptions() *gophercloud.AuthOptions {
 	return &gophercloud.AuthOptions{
 		IdentityEndpoint: viper.GetString("Keystone.auth_url"),
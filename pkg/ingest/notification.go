@@ -0,0 +1,78 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// osloEnvelope is the wrapper that oslo.messaging (message format 2.0) puts
+// around notifications. The actual notification is a JSON string in it.
+type osloEnvelope struct {
+	Version string  `json:"oslo.version"`
+	Message *string `json:"oslo.message"`
+}
+
+// ParseNotification turns the body of an oslo.messaging notification into the
+// CADF event that it carries. Both enveloped (2.0) and bare (1.0) notifications
+// are accepted.
+func ParseNotification(body []byte) (*storage.EventDetail, error) {
+	var envelope osloEnvelope
+	err := json.Unmarshal(body, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("notification is not valid JSON: %v", err)
+	}
+	if envelope.Message != nil {
+		if envelope.Version != "2.0" {
+			return nil, fmt.Errorf("unsupported oslo.messaging version \"%s\"", envelope.Version)
+		}
+		body = []byte(*envelope.Message)
+	}
+
+	var event storage.EventDetail
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		return nil, fmt.Errorf("notification message is not valid JSON: %v", err)
+	}
+	if event.EventType == "" {
+		return nil, errors.New("notification has no event_type")
+	}
+	if event.Payload.ID == "" || event.Payload.EventTime == "" {
+		return nil, fmt.Errorf("payload of %s notification is not a CADF event", event.EventType)
+	}
+	return &event, nil
+}
+
+// TenantID returns the project or domain that the event belongs to, i.e. the
+// scope of the initiator.
+func TenantID(event *storage.EventDetail) (string, error) {
+	initiator := event.Payload.Initiator
+	if initiator.ProjectID != "" {
+		return initiator.ProjectID, nil
+	}
+	if initiator.DomainID != "" {
+		return initiator.DomainID, nil
+	}
+	return "", fmt.Errorf("cannot determine the tenant of event %s: initiator has neither project_id nor domain_id", event.Payload.ID)
+}
@@ -0,0 +1,81 @@
+package ingest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testNotification = `{
+	"publisher_id": "identity.keystone-2031324599-gujvn",
+	"event_type": "identity.project.deleted",
+	"payload": {
+		"observer": {
+			"typeURI": "service/security",
+			"id": "493f1d6d-af50-5a4b-813b-488ecdfb1010"
+		},
+		"typeURI": "http://schemas.dmtf.org/cloud/audit/1.0/event",
+		"initiator": {
+			"typeURI": "service/security/account/user",
+			"project_id": "6a030751147a45c0863c3b5bde32c744",
+			"user_id": "eb5cd8f904b06e8b2a6eb86c8b04c08e6efb89b92da77905cc8c475f30b0b812",
+			"host": {
+				"agent": "python-keystoneclient",
+				"address": "100.65.0.11"
+			},
+			"id": "4a70d16f08b05d038c1e5ee7a5ee554e"
+		},
+		"eventTime": "2017-05-02T12:02:46.726056+0000",
+		"action": "deleted.project",
+		"eventType": "activity",
+		"id": "d5eed458-6666-58ec-ad06-8d3cf6bafca1",
+		"outcome": "success",
+		"target": {
+			"typeURI": "data/security/project",
+			"id": "b3b70c8271a845709f9a03030e705da7"
+		}
+	},
+	"message_id": "5a32c2f3-2996-4f46-819c-6197cf06037e",
+	"priority": "info",
+	"timestamp": "2017-05-02 12:02:46.726619"
+}`
+
+// osloEnvelop wraps a notification like oslo.messaging does.
+func osloEnvelop(t *testing.T, notification string) []byte {
+	body, err := json.Marshal(map[string]string{
+		"oslo.version": "2.0",
+		"oslo.message": notification,
+	})
+	require.Nil(t, err)
+	return body
+}
+
+func Test_ParseNotification(t *testing.T) {
+	for _, body := range [][]byte{osloEnvelop(t, testNotification), []byte(testNotification)} {
+		event, err := ParseNotification(body)
+		require.Nil(t, err)
+		assert.Equal(t, "identity.project.deleted", event.EventType)
+		assert.Equal(t, "d5eed458-6666-58ec-ad06-8d3cf6bafca1", event.Payload.ID)
+		assert.Equal(t, "b3b70c8271a845709f9a03030e705da7", event.Payload.Target.ID)
+
+		tenantId, err := TenantID(event)
+		require.Nil(t, err)
+		assert.Equal(t, "6a030751147a45c0863c3b5bde32c744", tenantId)
+	}
+}
+
+func Test_ParseNotificationMalformed(t *testing.T) {
+	malformed := [][]byte{
+		[]byte(`not JSON`),
+		osloEnvelop(t, `not JSON either`),
+		[]byte(`{"oslo.version": "3.0", "oslo.message": "{}"}`),
+		// not a CADF event
+		osloEnvelop(t, `{"event_type": "compute.instance.create.end", "payload": {"instance_id": "foo"}}`),
+	}
+	for _, body := range malformed {
+		_, err := ParseNotification(body)
+		assert.NotNil(t, err, string(body))
+	}
+}
@@ -0,0 +1,272 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/sapcc/hermes/pkg/util"
+	"github.com/streadway/amqp"
+)
+
+// Config contains the settings of the ingestion worker, as configured in the
+// [amqp] section of the config file.
+type Config struct {
+	// AMQP URL of the RabbitMQ that the notifications are sent to
+	URL string
+	// Queue to consume notifications from, e.g. "notifications.info"
+	Queue string
+	// Whether Queue is durable. This needs to match how oslo.messaging declares it.
+	DurableQueue bool
+	// Exchanges that Queue is bound to, e.g. "keystone" and "nova"
+	Exchanges []string
+	// Queue that notifications which cannot be stored are moved to
+	DeadLetterQueue string
+	// Maximum number of unacknowledged notifications, which is also the maximum size of a bulk write
+	Prefetch int
+	// Maximum time that notifications are held back to fill up a bulk write
+	FlushInterval time.Duration
+}
+
+// Validate returns an error if the worker cannot run with the settings.
+func (c Config) Validate() error {
+	if c.Prefetch <= 0 {
+		return fmt.Errorf("prefetch must be positive, got %d", c.Prefetch)
+	}
+	if c.FlushInterval <= 0 {
+		return fmt.Errorf("flush_interval must be positive, got %s", c.FlushInterval)
+	}
+	return nil
+}
+
+// How long to wait before reconnecting after the connection to RabbitMQ was lost
+const reconnectDelay = 5 * time.Second
+
+// channel contains the methods of *amqp.Channel that the worker uses, so that
+// tests can replace RabbitMQ with an in-process stand-in.
+type channel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Worker consumes CADF notifications from RabbitMQ and writes them to the event storage.
+type Worker struct {
+	Config  Config
+	Storage storage.Storage
+	// If set, events are enriched with hermes.EnrichEvent before they are written, and the
+	// domains of their tenants are looked up (see tenantDomain)
+	Keystone identity.Identity
+}
+
+// Run ingests notifications until the process is terminated. When the connection
+// to RabbitMQ is lost, it is re-established after a short delay.
+func (w *Worker) Run() {
+	for {
+		err := w.connectAndConsume()
+		util.LogError("AMQP ingestion interrupted, reconnecting in %s: %s", reconnectDelay, err.Error())
+		time.Sleep(reconnectDelay)
+	}
+}
+
+func (w *Worker) connectAndConsume() error {
+	util.LogInfo("Connecting to RabbitMQ")
+	conn, err := amqp.Dial(w.Config.URL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return w.consume(ch)
+}
+
+// setup declares the queues and configures the prefetch window.
+func (w *Worker) setup(ch channel) error {
+	err := ch.Qos(w.Config.Prefetch, 0, false)
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDeclare(w.Config.Queue, w.Config.DurableQueue, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("cannot declare queue %s: %v", w.Config.Queue, err)
+	}
+	for _, exchange := range w.Config.Exchanges {
+		// oslo.messaging uses the queue name as routing key for notifications
+		err = ch.QueueBind(w.Config.Queue, w.Config.Queue, exchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("cannot bind queue %s to exchange %s: %v", w.Config.Queue, exchange, err)
+		}
+	}
+	_, err = ch.QueueDeclare(w.Config.DeadLetterQueue, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("cannot declare queue %s: %v", w.Config.DeadLetterQueue, err)
+	}
+	return nil
+}
+
+// consume processes deliveries in batches until the channel fails.
+func (w *Worker) consume(ch channel) error {
+	err := w.setup(ch)
+	if err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(w.Config.Queue, "hermes-ingest", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	util.LogInfo("Consuming notifications from queue %s", w.Config.Queue)
+
+	ticker := time.NewTicker(w.Config.FlushInterval)
+	defer ticker.Stop()
+	var batch []amqp.Delivery
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				// Unacknowledged deliveries are redelivered by RabbitMQ after the reconnect
+				return errors.New("delivery channel was closed")
+			}
+			batch = append(batch, d)
+			if len(batch) < w.Config.Prefetch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		err = w.process(ch, batch)
+		if err != nil {
+			return err
+		}
+		batch = nil
+	}
+}
+
+// process writes a batch of deliveries to the storage, and acknowledges them.
+func (w *Worker) process(ch channel, batch []amqp.Delivery) error {
+	var events []storage.TenantEvent
+	var accepted []amqp.Delivery
+	for _, d := range batch {
+		event, err := ParseNotification(d.Body)
+		var tenantId string
+		if err == nil {
+			if w.Keystone != nil {
+				hermes.EnrichEvent(event, w.Keystone)
+			}
+			tenantId, err = TenantID(event)
+		}
+		if err != nil {
+			err = w.deadLetter(ch, d, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		events = append(events, storage.TenantEvent{TenantID: tenantId, Event: event, DomainID: w.tenantDomain(event, tenantId)})
+		accepted = append(accepted, d)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	err := w.Storage.WriteEvents(events)
+	bulkErr, partial := err.(storage.BulkError)
+	if err != nil && !partial {
+		util.LogError("Cannot write %d events, requeueing them: %s", len(events), err.Error())
+		for _, d := range accepted {
+			d.Nack(false, true)
+		}
+		// Backing off through the reconnect avoids hammering a failing storage
+		return err
+	}
+	util.LogDebug("Wrote %d of %d events", len(events)-len(bulkErr.Items), len(events))
+
+	// Events that the storage rejected will be rejected again, so only the ones that
+	// failed for other reasons are requeued
+	var retryErr error
+	for i, d := range accepted {
+		itemErr, failed := bulkErr.Items[i]
+		switch {
+		case !failed:
+			err = d.Ack(false)
+		case itemErr.Retryable():
+			util.LogError("Cannot write event %s, requeueing it: %s", events[i].Event.Payload.ID, itemErr.Error())
+			err = d.Nack(false, true)
+			retryErr = bulkErr
+		default:
+			err = w.deadLetter(ch, d, itemErr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return retryErr
+}
+
+// tenantDomain returns the domain of the tenant that the event belongs to, or an empty
+// string if it is unknown. For project tenants, it is looked up in Keystone, since the
+// initiator's domain is the domain of the user, which may differ from the project's.
+func (w *Worker) tenantDomain(event *storage.EventDetail, tenantId string) string {
+	if tenantId != event.Payload.Initiator.ProjectID {
+		return tenantId
+	}
+	if w.Keystone == nil {
+		return ""
+	}
+	domainId, err := w.Keystone.ProjectDomainId(tenantId)
+	if err != nil {
+		util.LogError("Error looking up domain for project '%s': %s", tenantId, err.Error())
+		return ""
+	}
+	return domainId
+}
+
+// deadLetter moves a notification that cannot be stored to the dead-letter queue,
+// recording the reason in the x-hermes-error header.
+func (w *Worker) deadLetter(ch channel, d amqp.Delivery, reason error) error {
+	util.LogWarning("Moving notification to queue %s: %s", w.Config.DeadLetterQueue, reason.Error())
+	err := ch.Publish("", w.Config.DeadLetterQueue, false, false, amqp.Publishing{
+		Headers: amqp.Table{
+			"x-hermes-error":        reason.Error(),
+			"x-hermes-source-queue": w.Config.Queue,
+		},
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         d.Body,
+	})
+	if err != nil {
+		d.Nack(false, true)
+		return err
+	}
+	return d.Ack(false)
+}
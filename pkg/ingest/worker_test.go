@@ -0,0 +1,260 @@
+package ingest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChannel is an in-process stand-in for an AMQP channel. It also acts as
+// the Acknowledger of the deliveries it hands out.
+type fakeChannel struct {
+	deliveries chan amqp.Delivery
+	prefetch   int
+	declared   []string
+	bindings   []string
+	published  map[string][]amqp.Publishing
+	acked      []uint64
+	nacked     []uint64
+}
+
+func newFakeChannel() *fakeChannel {
+	return &fakeChannel{
+		deliveries: make(chan amqp.Delivery, 10),
+		published:  make(map[string][]amqp.Publishing),
+	}
+}
+
+func (c *fakeChannel) deliver(tag uint64, body []byte) {
+	c.deliveries <- amqp.Delivery{Acknowledger: c, DeliveryTag: tag, Body: body}
+}
+
+func (c *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	c.prefetch = prefetchCount
+	return nil
+}
+
+func (c *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.declared = append(c.declared, name)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.bindings = append(c.bindings, exchange+"->"+name)
+	return nil
+}
+
+func (c *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return c.deliveries, nil
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.published[key] = append(c.published[key], msg)
+	return nil
+}
+
+func (c *fakeChannel) Ack(tag uint64, multiple bool) error {
+	c.acked = append(c.acked, tag)
+	return nil
+}
+
+func (c *fakeChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	c.nacked = append(c.nacked, tag)
+	return nil
+}
+
+func (c *fakeChannel) Reject(tag uint64, requeue bool) error {
+	return c.Nack(tag, false, requeue)
+}
+
+// recordingStorage remembers the events written to it
+type recordingStorage struct {
+	storage.Memory
+	written []storage.TenantEvent
+	err     error
+}
+
+func (s *recordingStorage) WriteEvents(events []storage.TenantEvent) error {
+	bulkErr, partial := s.err.(storage.BulkError)
+	if s.err != nil && !partial {
+		return s.err
+	}
+	for i, event := range events {
+		if _, failed := bulkErr.Items[i]; !failed {
+			s.written = append(s.written, event)
+		}
+	}
+	return s.err
+}
+
+func testWorker(store storage.Storage) *Worker {
+	return &Worker{
+		Config: Config{
+			Queue:           "notifications.info",
+			Exchanges:       []string{"keystone"},
+			DeadLetterQueue: "notifications.info.dead",
+			Prefetch:        3,
+			FlushInterval:   time.Hour,
+		},
+		Storage: store,
+	}
+}
+
+func Test_ConfigValidate(t *testing.T) {
+	config := Config{Prefetch: 100, FlushInterval: time.Second}
+	assert.Nil(t, config.Validate())
+
+	for _, prefetch := range []int{0, -1} {
+		invalid := config
+		invalid.Prefetch = prefetch
+		assert.NotNil(t, invalid.Validate(), "prefetch %d", prefetch)
+	}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		invalid := config
+		invalid.FlushInterval = interval
+		assert.NotNil(t, invalid.Validate(), "flush interval %s", interval)
+	}
+}
+
+func Test_WorkerConsume(t *testing.T) {
+	store := &recordingStorage{}
+	ch := newFakeChannel()
+	ch.deliver(1, osloEnvelop(t, testNotification))
+	ch.deliver(2, []byte("garbage"))
+	ch.deliver(3, []byte(testNotification))
+	close(ch.deliveries)
+
+	err := testWorker(store).consume(ch)
+	require.NotNil(t, err)
+
+	assert.Equal(t, 3, ch.prefetch)
+	assert.Equal(t, []string{"notifications.info", "notifications.info.dead"}, ch.declared)
+	assert.Equal(t, []string{"keystone->notifications.info"}, ch.bindings)
+
+	require.Equal(t, 2, len(store.written))
+	assert.Equal(t, "6a030751147a45c0863c3b5bde32c744", store.written[0].TenantID)
+	assert.Equal(t, "d5eed458-6666-58ec-ad06-8d3cf6bafca1", store.written[0].Event.Payload.ID)
+
+	// The malformed message went to the dead-letter queue, and everything was acknowledged
+	require.Equal(t, 1, len(ch.published["notifications.info.dead"]))
+	deadLetter := ch.published["notifications.info.dead"][0]
+	assert.Equal(t, "garbage", string(deadLetter.Body))
+	assert.True(t, strings.Contains(deadLetter.Headers["x-hermes-error"].(string), "not valid JSON"))
+	assert.Equal(t, []uint64{2, 1, 3}, ch.acked)
+	assert.Empty(t, ch.nacked)
+}
+
+func Test_WorkerStorageFailure(t *testing.T) {
+	store := &recordingStorage{err: errors.New("ElasticSearch is down")}
+	ch := newFakeChannel()
+	ch.deliver(1, osloEnvelop(t, testNotification))
+	ch.deliver(2, osloEnvelop(t, testNotification))
+	ch.deliver(3, osloEnvelop(t, testNotification))
+
+	err := testWorker(store).consume(ch)
+	require.NotNil(t, err)
+	assert.Equal(t, "ElasticSearch is down", err.Error())
+
+	// Everything is requeued for another attempt
+	assert.Empty(t, ch.acked)
+	assert.Equal(t, []uint64{1, 2, 3}, ch.nacked)
+}
+
+func Test_WorkerPartialStorageFailure(t *testing.T) {
+	store := &recordingStorage{err: storage.BulkError{
+		Items: map[int]storage.ItemError{
+			1: {Status: 400, Reason: "mapper_parsing_exception: failed to parse"},
+			2: {Status: 429, Reason: "es_rejected_execution_exception: queue is full"},
+		},
+		Total: 3,
+	}}
+	ch := newFakeChannel()
+	ch.deliver(1, osloEnvelop(t, testNotification))
+	ch.deliver(2, osloEnvelop(t, testNotification))
+	ch.deliver(3, osloEnvelop(t, testNotification))
+
+	err := testWorker(store).consume(ch)
+	require.NotNil(t, err)
+	assert.IsType(t, storage.BulkError{}, err)
+
+	// The rejected event is dead-lettered, and only the one that may succeed later is requeued
+	assert.Equal(t, 1, len(store.written))
+	assert.Equal(t, []uint64{1, 2}, ch.acked)
+	assert.Equal(t, []uint64{3}, ch.nacked)
+	require.Equal(t, 1, len(ch.published["notifications.info.dead"]))
+	assert.True(t, strings.Contains(ch.published["notifications.info.dead"][0].Headers["x-hermes-error"].(string), "mapper_parsing_exception"))
+}
+
+func Test_WorkerFlushInterval(t *testing.T) {
+	store := &recordingStorage{}
+	ch := newFakeChannel()
+	worker := testWorker(store)
+	worker.Config.FlushInterval = 10 * time.Millisecond
+	ch.deliver(1, osloEnvelop(t, testNotification))
+
+	go func() {
+		// The batch is not full, so it is only written after the flush interval
+		time.Sleep(100 * time.Millisecond)
+		close(ch.deliveries)
+	}()
+	err := worker.consume(ch)
+	require.NotNil(t, err)
+	assert.Equal(t, 1, len(store.written))
+	assert.Equal(t, []uint64{1}, ch.acked)
+}
+
+func Test_WorkerEnrichment(t *testing.T) {
+	store := &recordingStorage{}
+	ch := newFakeChannel()
+	worker := testWorker(store)
+	worker.Config.Prefetch = 1
+	worker.Keystone = identity.Mock{}
+	ch.deliver(1, osloEnvelop(t, testNotification))
+	close(ch.deliveries)
+
+	err := worker.consume(ch)
+	require.NotNil(t, err)
+	require.Equal(t, 1, len(store.written))
+	initiator := store.written[0].Event.Payload.Initiator
+	assert.Equal(t, "39a253e16e4a4a3686edca72c8e101bc", initiator.DomainID)
+	assert.Equal(t, "ceilometer-cadf-delete-me", initiator.ProjectName)
+	assert.Equal(t, "ceilometer-cadf-delete-me", store.written[0].Event.Payload.Target.Name)
+}
+
+func Test_WorkerTenantDomain(t *testing.T) {
+	// the user of a project-scoped token may belong to another domain than the project
+	userDomain := strings.Replace(testNotification, `"project_id"`, `"domain_id": "user-domain", "project_id"`, 1)
+	domainScoped := strings.Replace(testNotification, `"project_id": "6a030751147a45c0863c3b5bde32c744"`, `"domain_id": "d1"`, 1)
+	tests := []struct {
+		notification string
+		keystone     identity.Identity
+		domainId     string
+	}{
+		{userDomain, identity.Mock{}, "39a253e16e4a4a3686edca72c8e101bc"},
+		{userDomain, nil, ""},
+		{domainScoped, nil, "d1"},
+	}
+	for _, test := range tests {
+		store := &recordingStorage{}
+		ch := newFakeChannel()
+		worker := testWorker(store)
+		worker.Config.Prefetch = 1
+		worker.Keystone = test.keystone
+		ch.deliver(1, []byte(test.notification))
+		close(ch.deliveries)
+
+		require.NotNil(t, worker.consume(ch))
+		require.Equal(t, 1, len(store.written))
+		assert.Equal(t, test.domainId, store.written[0].DomainID)
+		if test.notification == userDomain {
+			assert.Equal(t, "user-domain", store.written[0].Event.Payload.Initiator.DomainID)
+		}
+	}
+}
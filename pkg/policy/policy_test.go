@@ -94,6 +94,64 @@ func Test_Policy_ProjectNoProject(t *testing.T) {
 	assert.False(t, enforcer.Enforce("event:show", c))
 }
 
+func Test_Policy_ListGlobal(t *testing.T) {
+	enforcer := GetEnforcer()
+	c := policy.Context{
+		Roles: []string{
+			"cloud_audit_viewer",
+		},
+		Auth: map[string]string{
+			"project_id":          "7a09c05926ec452ca7992af4aa03c31d",
+			"project_domain_name": "ccadmin",
+		},
+		Request: map[string]string{},
+		Logger:  util.LogDebug,
+	}
+	assert.True(t, enforcer.Enforce("event:list_global", c))
+
+	// the role is not sufficient in another domain
+	c.Auth["project_domain_name"] = "monsoon3"
+	assert.False(t, enforcer.Enforce("event:list_global", c))
+	// nor with a domain-scoped token
+	c.Auth = map[string]string{"domain_id": "ca1b267e149d4e44bf53d28d1c8d6bc9", "domain_name": "ccadmin"}
+	assert.False(t, enforcer.Enforce("event:list_global", c))
+}
+
+func Test_Policy_AuditUpdate(t *testing.T) {
+	enforcer := GetEnforcer()
+	c := policy.Context{
+		Roles: []string{
+			"audit_admin",
+		},
+		Auth: map[string]string{
+			"project_id": "7a09c05926ec452ca7992af4aa03c31d",
+		},
+		Request: map[string]string{
+			"project_id": "7a09c05926ec452ca7992af4aa03c31d",
+		},
+		Logger: util.LogDebug,
+	}
+	assert.True(t, enforcer.Enforce("audit:update", c))
+	assert.True(t, enforcer.Enforce("audit:show", c))
+
+	// the tenant comes from the project_id parameter, which must be the project of the token
+	c.Request["project_id"] = "e9141fb24eee4b3e9f25ae69cda31132"
+	assert.False(t, enforcer.Enforce("audit:update", c))
+	assert.False(t, enforcer.Enforce("audit:show", c))
+
+	// viewers cannot change the configuration
+	c.Roles = []string{"audit_viewer"}
+	c.Request["project_id"] = "7a09c05926ec452ca7992af4aa03c31d"
+	assert.True(t, enforcer.Enforce("audit:show", c))
+	assert.False(t, enforcer.Enforce("audit:update", c))
+
+	// the configuration of a domain cannot be changed
+	c.Roles = []string{"audit_admin"}
+	c.Auth = map[string]string{"domain_id": "ca1b267e149d4e44bf53d28d1c8d6bc9"}
+	c.Request = map[string]string{"domain_id": "ca1b267e149d4e44bf53d28d1c8d6bc9", "project_id": ""}
+	assert.False(t, enforcer.Enforce("audit:update", c))
+}
+
 func TestPolicy(t *testing.T) {
 	var keystonePolicy map[string]string
 
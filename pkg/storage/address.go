@@ -0,0 +1,71 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// addressMatch translates Filter.InitiatorAddress, which is an IP address or an IPv4 CIDR
+//  range, into the addresses that it matches exactly, and into prefixes of the dotted
+//  notation, e.g. "10.0." for 10.0.0.0/16. Addresses are stored as text, so this works
+//  with all drivers and all events, without mapping them as IP addresses first.
+//  IPv6 addresses have several textual representations, so IPv6 ranges are not supported.
+func addressMatch(address string) (exact, prefixes []string, err error) {
+	if !strings.Contains(address, "/") {
+		if net.ParseIP(address) == nil {
+			return nil, nil, fmt.Errorf("\"%s\" is not a valid IP address", address)
+		}
+		return []string{address}, nil, nil
+	}
+
+	ip, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("\"%s\" is not a valid CIDR range", address)
+	}
+	network4 := network.IP.To4()
+	if ip.To4() == nil || network4 == nil {
+		return nil, nil, fmt.Errorf("CIDR range \"%s\" is not supported, only IPv4 ranges are", address)
+	}
+	ones, _ := network.Mask.Size()
+	// the octet in which the network part ends, and the values that it can have
+	last := 0
+	if ones > 0 {
+		last = (ones - 1) / 8
+	}
+	count := 1 << uint(8*(last+1)-ones)
+	for i := 0; i < count; i++ {
+		octets := make([]string, last+1)
+		for j := 0; j < last; j++ {
+			octets[j] = strconv.Itoa(int(network4[j]))
+		}
+		octets[last] = strconv.Itoa(int(network4[last]) + i)
+		value := strings.Join(octets, ".")
+		if last == 3 {
+			exact = append(exact, value)
+		} else {
+			prefixes = append(prefixes, value+".")
+		}
+	}
+	return exact, prefixes, nil
+}
@@ -0,0 +1,281 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/sapcc/hermes/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Every driver runs the storagetest suite, and is checked on the fixture that the API tests use.
+
+func testDriver(t *testing.T, newStorage storagetest.Factory) {
+	storagetest.Run(t, newStorage)
+	t.Run("Fixture", func(t *testing.T) {
+		checkFixture(t, newStorage(t))
+	})
+}
+
+func Test_MemoryConformance(t *testing.T) {
+	testDriver(t, func(t *testing.T) storage.Storage {
+		return storage.NewMemory()
+	})
+}
+
+func Test_SQLiteConformance(t *testing.T) {
+	testDriver(t, func(t *testing.T) storage.Storage {
+		s, err := storage.NewSQLite(":memory:")
+		require.Nil(t, err)
+		return s
+	})
+}
+
+// The tests against an actual database only run if HERMES_TEST_POSTGRES_DSN is set,
+// e.g. to "postgres://postgres@localhost/hermes_test?sslmode=disable". They drop the
+// events table.
+func Test_PostgresConformance(t *testing.T) {
+	dsn := os.Getenv("HERMES_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("HERMES_TEST_POSTGRES_DSN is not set")
+	}
+	testDriver(t, func(t *testing.T) storage.Storage {
+		p, err := storage.NewPostgres(dsn)
+		require.Nil(t, err)
+		require.Nil(t, storage.ResetPostgres(p))
+		return p
+	})
+}
+
+func Test_ElasticSearchConformance(t *testing.T) {
+	for _, version := range []string{"5.6.16", "6.8.23", "7.17.15", "8.11.1", "opensearch-2.11.0"} {
+		version := version
+		t.Run(version, func(t *testing.T) {
+			testDriver(t, elasticSearchFactory(version, "", true))
+		})
+	}
+	// all tenants of a domain share an index, so searches need to filter by tenant
+	t.Run("SharedIndex", func(t *testing.T) {
+		testDriver(t, elasticSearchFactory("8.11.1", "hermes-{domain}", true))
+	})
+	// without the index template, the indices get the dynamic mapping, like those of Logstash
+	for _, version := range []string{"7.17.15", "8.11.1"} {
+		version := version
+		t.Run("DynamicMapping/"+version, func(t *testing.T) {
+			testDriver(t, elasticSearchFactory(version, "", false))
+		})
+	}
+}
+
+func elasticSearchFactory(version, indexTemplate string, ensureSchema bool) storagetest.Factory {
+	return func(t *testing.T) storage.Storage {
+		fake := storagetest.NewFakeElasticSearch(version)
+		t.Cleanup(fake.Close)
+		es, err := storage.NewElasticSearch(storage.ElasticSearchConfig{URLs: []string{fake.URL}, IndexTemplate: indexTemplate})
+		require.Nil(t, err)
+		if ensureSchema {
+			require.Nil(t, es.EnsureSchema())
+		}
+		return es
+	}
+}
+
+// Events that Logstash wrote into the indices of the default template do not have the
+// tenant_id field, so they must be found by the index names, also when the list of
+// indices is too long for the request line.
+func Test_ElasticSearchLegacyDocuments(t *testing.T) {
+	for _, version := range []string{"5.6.16", "8.11.1"} {
+		t.Run(version, func(t *testing.T) {
+			fake := storagetest.NewFakeElasticSearch(version)
+			defer fake.Close()
+			es, err := storage.NewElasticSearch(storage.ElasticSearchConfig{URLs: []string{fake.URL}})
+			require.Nil(t, err)
+			require.Nil(t, es.EnsureSchema())
+
+			var tenantIds []string
+			var bulk bytes.Buffer
+			for i := 0; i < 100; i++ {
+				tenantId := fmt.Sprintf("%032x", i)
+				tenantIds = append(tenantIds, tenantId)
+				if i%10 != 0 {
+					continue
+				}
+				meta := map[string]interface{}{"_index": "audit-" + tenantId + "-2017.05.02", "_id": tenantId}
+				if version == "5.6.16" {
+					meta["_type"] = "logs"
+				}
+				action, _ := json.Marshal(map[string]interface{}{"index": meta})
+				fmt.Fprintf(&bulk, "%s\n", action)
+				fmt.Fprintf(&bulk, `{"@timestamp": "2017-05-02T10:00:00Z", "event_type": "identity.project.created", "message_id": "%s", "payload": {"eventTime": "2017-05-02T10:00:00.000000+0000", "action": "create"}}`+"\n", tenantId)
+			}
+			resp, err := http.Post(fake.URL+"/_bulk", "application/x-ndjson", &bulk)
+			require.Nil(t, err)
+			resp.Body.Close()
+			require.Equal(t, 200, resp.StatusCode)
+
+			week := map[string]string{"gte": "2017-04-28T00:00:00Z", "lt": "2017-05-05T00:00:00Z"}
+			filter := storage.Filter{IncludeTenants: tenantIds[1:], Time: week, Limit: 20}
+			page, err := es.GetEvents(&filter, tenantIds[0])
+			require.Nil(t, err)
+			assert.Equal(t, 10, page.Total)
+			require.Equal(t, 10, len(page.Events))
+			for _, event := range page.Events {
+				// the tenant comes from the index name
+				assert.Equal(t, event.MessageID, event.TenantID)
+			}
+
+			values, err := es.GetAttributes(&filter, tenantIds[0], "action", 10)
+			require.Nil(t, err)
+			assert.Equal(t, storage.AttributeValueList{{Value: "create", Count: 10}}, values)
+		})
+	}
+}
+
+// The domain in index names is the domain of the tenant, not that of the initiator.
+func Test_ElasticSearchWriteIndexDomain(t *testing.T) {
+	fake := storagetest.NewFakeElasticSearch("8.11.1")
+	defer fake.Close()
+	es, err := storage.NewElasticSearch(storage.ElasticSearchConfig{URLs: []string{fake.URL}, IndexTemplate: "audit-{domain}-{tenant}-{date}"})
+	require.Nil(t, err)
+	require.Nil(t, es.EnsureSchema())
+
+	event := func(id string) *storage.EventDetail {
+		var e storage.EventDetail
+		e.MessageID = "msg-" + id
+		e.Payload.ID = id
+		e.Payload.EventTime = "2017-05-02T10:00:00.000000+0000"
+		e.Payload.Initiator.ProjectID = "p1"
+		e.Payload.Initiator.DomainID = "user-domain"
+		return &e
+	}
+	require.Nil(t, es.WriteEvents([]storage.TenantEvent{
+		{TenantID: "p1", Event: event("a"), DomainID: "d1"},
+		{TenantID: "p1", Event: event("b")},
+	}))
+	assert.Equal(t, []string{"audit-d1-p1-2017.05.02", "audit-unknown-p1-2017.05.02"}, fake.Indices())
+}
+
+// The fake maps the keyword subfield like the index template of the driver does, or
+// like the dynamic mapping without one, and other subfields do not exist.
+func Test_FakeElasticSearchMappings(t *testing.T) {
+	for _, version := range []string{"5.6.16", "8.11.1"} {
+		for keyword, withTemplate := range map[string]bool{"raw": true, "keyword": false} {
+			t.Run(version+"/"+keyword, func(t *testing.T) {
+				fake := storagetest.NewFakeElasticSearch(version)
+				defer fake.Close()
+				if withTemplate {
+					es, err := storage.NewElasticSearch(storage.ElasticSearchConfig{URLs: []string{fake.URL}})
+					require.Nil(t, err)
+					require.Nil(t, es.EnsureSchema())
+				}
+				meta := map[string]interface{}{"_index": "audit-p1-2017.05.02", "_id": "a"}
+				if version == "5.6.16" {
+					meta["_type"] = "logs"
+				}
+				action, _ := json.Marshal(map[string]interface{}{"index": meta})
+				bulk := fmt.Sprintf("%s\n%s\n", action, `{"@timestamp": "2017-05-02T10:00:00Z", "event_type": "identity.project.created"}`)
+				resp, err := http.Post(fake.URL+"/_bulk", "application/x-ndjson", bytes.NewBufferString(bulk))
+				require.Nil(t, err)
+				resp.Body.Close()
+				require.Equal(t, 200, resp.StatusCode)
+
+				var mappings map[string]struct {
+					Mappings map[string]json.RawMessage `json:"mappings"`
+				}
+				resp, err = http.Get(fake.URL + "/audit-*/_mapping/field/event_type.raw,event_type.keyword")
+				require.Nil(t, err)
+				require.Nil(t, json.NewDecoder(resp.Body).Decode(&mappings))
+				resp.Body.Close()
+				fields := mappings["audit-p1-2017.05.02"].Mappings
+				if version == "5.6.16" {
+					var typed map[string]json.RawMessage
+					require.Nil(t, json.Unmarshal(fields["logs"], &typed))
+					fields = typed
+				}
+				require.Equal(t, 1, len(fields))
+				assert.Contains(t, fields, "event_type."+keyword)
+
+				for _, subfield := range []string{"raw", "keyword"} {
+					query := fmt.Sprintf(`{"query": {"term": {"event_type.%s": "identity.project.created"}}}`, subfield)
+					resp, err = http.Post(fake.URL+"/audit-*/_search", "application/json", bytes.NewBufferString(query))
+					require.Nil(t, err)
+					var result struct {
+						Hits struct {
+							Hits []interface{} `json:"hits"`
+						} `json:"hits"`
+					}
+					require.Nil(t, json.NewDecoder(resp.Body).Decode(&result))
+					resp.Body.Close()
+					if subfield == keyword {
+						assert.Equal(t, 1, len(result.Hits.Hits), subfield)
+					} else {
+						assert.Equal(t, 0, len(result.Hits.Hits), subfield)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Tenants and event counts in ../test/events.ndjson
+const (
+	fixtureProject1 = "ae63ddf2076d4342a56eb049e37a7621"
+	fixtureProject2 = "6a030751147a45c0863c3b5bde32c744"
+	fixtureDomain   = "39a253e16e4a4a3686edca72c8e101bc"
+)
+
+func writeFixture(t *testing.T, s storage.Storage) {
+	f, err := os.Open("../test/events.ndjson")
+	require.Nil(t, err)
+	defer f.Close()
+	events, err := storage.ReadFixture(f)
+	require.Nil(t, err)
+	require.Nil(t, s.WriteEvents(events))
+}
+
+// checkFixture checks the behavior on the fixture that the API tests use.
+func checkFixture(t *testing.T, s storage.Storage) {
+	writeFixture(t, s)
+
+	totals := map[string]int{"": 19, fixtureProject1: 16, fixtureProject2: 2, fixtureDomain: 1, "unknown": 0}
+	for tenantId, total := range totals {
+		page, err := s.GetEvents(&storage.Filter{Limit: 10}, tenantId)
+		require.Nil(t, err)
+		assert.Equal(t, total, page.Total, tenantId)
+	}
+
+	page, err := s.GetEvents(&storage.Filter{EventType: storage.Values("identity.project.deleted"), Offset: 10, Limit: 10}, "")
+	require.Nil(t, err)
+	assert.Equal(t, 14, page.Total)
+	assert.Equal(t, 4, len(page.Events))
+	assert.Nil(t, page.Next)
+
+	page, err = s.GetEvents(&storage.Filter{Source: storage.Values("compute"), Limit: 10, Sort: []storage.FieldOrder{{"time", "asc"}}}, "")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(page.Events))
+	assert.Equal(t, "compute.instance.create.end", page.Events[0].EventType)
+	assert.Equal(t, "compute.instance.delete.end", page.Events[1].EventType)
+
+	event, err := s.GetEvent("5a32c2f3-2996-4f46-819c-6197cf06037e", fixtureProject1)
+	require.Nil(t, err)
+	require.NotNil(t, event)
+	assert.Equal(t, "d5eed458-6666-58ec-ad06-8d3cf6bafca1", event.Payload.ID)
+	event, err = s.GetEvent("5a32c2f3-2996-4f46-819c-6197cf06037e", fixtureProject2)
+	assert.Nil(t, err)
+	assert.Nil(t, event)
+
+	sources, err := s.GetAttributes(&storage.Filter{}, "", "source", 10)
+	require.Nil(t, err)
+	assert.Equal(t, storage.AttributeValueList{{Value: "identity", Count: 17}, {Value: "compute", Count: 2}}, sources)
+	eventTypes, err := s.GetAttributes(&storage.Filter{}, fixtureProject2, "event_type", 10)
+	require.Nil(t, err)
+	assert.Equal(t, storage.AttributeValueList{
+		{Value: "compute.instance.create.end", Count: 1}, {Value: "compute.instance.delete.end", Count: 1},
+	}, eventTypes)
+}
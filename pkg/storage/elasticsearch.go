@@ -1,243 +1,401 @@
 package storage
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/sapcc/hermes/pkg/util"
-	"github.com/spf13/viper"
-	"gopkg.in/olivere/elastic.v5"
-	"strings"
+	"net/http"
+	"time"
 )
 
+// ElasticSearch stores the events in indices that are named by the configured index
+// template, by default daily indices per tenant. Use NewElasticSearch() to create it.
 type ElasticSearch struct {
-	esClient *elastic.Client
+	config     ElasticSearchConfig
+	indices    esIndices
+	httpClient *http.Client
+	conn       *esConnection
 }
 
-func (es *ElasticSearch) client() *elastic.Client {
-	// Lazy initialisation - don't connect to ElasticSearch until we need to
-	if es.esClient == nil {
-		es.init()
+func (es ElasticSearch) GetEvents(filter *Filter, tenantId string) (*EventPage, error) {
+	ctx, cancel := es.context()
+	defer cancel()
+	client, keyword, err := es.searchClient(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return es.esClient
-}
-
-func (es *ElasticSearch) init() {
-	util.LogDebug("Initiliasing ElasticSearch()")
+	search, err := eventSearch(filter, keyword)
+	if err != nil {
+		return nil, err
+	}
+	index, tenantFilter := es.indices.searchTarget(filter.tenants(tenantId), filter.Time, keyword)
+	util.LogDebug("Looking for events in index %s", index)
 
-	// Create a client
-	var err error
-	var url = viper.GetString("elasticsearch.url")
-	util.LogDebug("Using ElasticSearch URL: %s", url)
-	// Added disabling sniffing for Testing from Golang. This corrects a problem. Likely needs to be removed before prod deploy
-	es.esClient, err = elastic.NewClient(elastic.SetURL(url), elastic.SetSniff(false))
-	//es.esClient, err = elastic.NewClient(elastic.SetURL(url))
+	searchResult, err := client.search(ctx, index, restrictSearch(search, tenantFilter))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-}
 
-func (es ElasticSearch) GetEvents(filter *Filter, tenantId string) ([]*EventDetail, int, error) {
-	index := indexName(tenantId)
-	util.LogDebug("Looking for events in index %s", index)
+	util.LogDebug("Got %d hits", searchResult.Hits.Total)
 
-	query := elastic.NewBoolQuery()
-	if filter.Source != "" {
-		util.LogDebug("Filtering on Source %s", filter.Source)
-		query = query.Filter(elastic.NewMatchPhrasePrefixQuery("event_type", filter.Source))
-	}
-	if filter.ResourceType != "" {
-		query = query.Filter(elastic.NewMatchPhrasePrefixQuery("payload.target.typeURI", filter.ResourceType))
-	}
-	if filter.ResourceId != "" {
-		query = query.Filter(elastic.NewTermQuery("payload.target.id.raw", filter.ResourceId))
-	}
-	if filter.UserId != "" {
-		query = query.Filter(elastic.NewPrefixQuery("payload.initiator.user_id.raw", filter.UserId))
-	}
-	if filter.EventType != "" {
-		query = query.Filter(elastic.NewMatchPhrasePrefixQuery("event_type", filter.EventType))
-	}
-	if filter.Time != nil && len(filter.Time) > 0 {
-		for key, value := range filter.Time {
-			timeField := "payload.eventTime"
-			switch key {
-			case "lt":
-				query = query.Filter(elastic.NewRangeQuery(timeField).Lt(value))
-			case "lte":
-				query = query.Filter(elastic.NewRangeQuery(timeField).Lte(value))
-			case "gt":
-				query = query.Filter(elastic.NewRangeQuery(timeField).Gt(value))
-			case "gte":
-				query = query.Filter(elastic.NewRangeQuery(timeField).Gte(value))
-			}
+	//Construct EventDetail array from search results
+	page := EventPage{Total: int(searchResult.Hits.Total)}
+	var lastHit *esHit
+	for i, hit := range searchResult.Hits.Hits {
+		de, err := es.eventFromHit(hit)
+		if err != nil {
+			return nil, err
 		}
+		page.Events = append(page.Events, de)
+		lastHit = &searchResult.Hits.Hits[i]
 	}
-	//Mapping from RequestSort parameter
-	esFieldMapping := map[string]string{
-		"time":          "payload.eventTime",
-		"source":        "publisher_id",
-		"resource_type": "payload.target.typeURI",
-		"resource_name": "payload.target.id.raw",
-		"event_type":    "event_type",
+	offset := filter.Offset
+	if filter.Cursor != nil {
+		offset = filter.Cursor.Offset
+	}
+	if lastHit != nil && int(offset)+len(page.Events) < page.Total {
+		page.Next = &Cursor{
+			Offset:     offset + uint(len(page.Events)),
+			SortValues: lastHit.Sort,
+		}
 	}
 
-	esSearch := es.client().Search().
-		Index(index).
-		Query(query)
-
-	if filter.Sort != nil {
-		for _, fieldOrder := range filter.Sort {
-			switch fieldOrder.Order {
-			case "asc":
-				esSearch = esSearch.Sort(esFieldMapping[fieldOrder.Fieldname], true)
-			case "desc":
-				esSearch = esSearch.Sort(esFieldMapping[fieldOrder.Fieldname], false)
+	// the facets are aggregations of the same search
+	if len(filter.Facets) > 0 {
+		page.Facets = make(map[string]AttributeValueList)
+		for i, facet := range filter.Facets {
+			agg, found := searchResult.Aggregations[facetAggregationName(i)]
+			if !found {
+				return nil, fmt.Errorf("ElasticSearch returned no aggregation for %s", facet)
 			}
+			page.Facets[facet] = attributeValuesFromAggregation(facet, agg, filter.FacetLimit)
 		}
 	}
+	return &page, nil
+}
 
-	esSearch = esSearch.
-		Sort("@timestamp", false).
-		From(int(filter.Offset)).Size(int(filter.Limit))
-
-	searchResult, err := esSearch.Do(context.Background()) // execute
+func (es ElasticSearch) GetEvent(eventId string, tenantId string) (*EventDetail, error) {
+	ctx, cancel := es.context()
+	defer cancel()
+	client, keyword, err := es.searchClient(ctx)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
+	index, tenantFilter := es.indices.searchTarget(singleTenant(tenantId), nil, keyword)
+	util.LogDebug("Looking for event %s in index %s", eventId, index)
 
-	util.LogDebug("Got %d hits", searchResult.TotalHits())
+	searchResult, err := client.search(ctx, index, restrictSearch(eventByIdSearch(eventId, keyword), tenantFilter))
+	if err != nil {
+		return nil, err
+	}
 
-	//Construct EventDetail array from search results
-	var events []*EventDetail
-	for _, hit := range searchResult.Hits.Hits {
-		var de EventDetail
-		err := json.Unmarshal(*hit.Source, &de)
-		if err != nil {
-			return nil, 0, err
-		}
-		events = append(events, &de)
+	if len(searchResult.Hits.Hits) > 0 {
+		return es.eventFromHit(searchResult.Hits.Hits[0])
 	}
-	total := searchResult.TotalHits()
+	return nil, nil
+}
 
-	return events, int(total), nil
+// singleTenant returns the tenant as list for searchTarget, which is empty for all tenants.
+func singleTenant(tenantId string) []string {
+	if tenantId == "" {
+		return nil
+	}
+	return []string{tenantId}
 }
 
-func (es ElasticSearch) GetEvent(eventId string, tenantId string) (*EventDetail, error) {
-	index := indexName(tenantId)
-	util.LogDebug("Looking for event %s in index %s", eventId, index)
+// eventFromHit parses an event from a search hit, with the tenant that it belongs to.
+func (es ElasticSearch) eventFromHit(hit esHit) (*EventDetail, error) {
+	var de EventDetail
+	doc := eventDocument{EventDetail: &de}
+	err := json.Unmarshal(hit.Source, &doc)
+	if err != nil {
+		return nil, err
+	}
+	de.TenantID = doc.TenantID
+	if de.TenantID == "" {
+		de.TenantID = es.indices.tenantFromIndex(hit.Index)
+	}
+	return &de, nil
+}
 
-	query := elastic.NewTermQuery("message_id.raw", eventId)
-	esSearch := es.client().Search().
-		Index(index).
-		Query(query)
+// GetAttributes counts the values of the attribute among the matching events with a
+// terms aggregation on its keyword subfield.
+func (es ElasticSearch) GetAttributes(filter *Filter, tenantId string, attribute string, limit uint) (AttributeValueList, error) {
+	ctx, cancel := es.context()
+	defer cancel()
+	client, keyword, err := es.searchClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	search, err := attributeSearch(filter, attribute, limit, keyword)
+	if err != nil {
+		return nil, err
+	}
+	index, tenantFilter := es.indices.searchTarget(filter.tenants(tenantId), filter.Time, keyword)
+	util.LogDebug("Looking for values of %s in index %s", attribute, index)
 
-	searchResult, err := esSearch.Do(context.Background())
+	searchResult, err := client.search(ctx, index, restrictSearch(search, tenantFilter))
 	if err != nil {
 		return nil, err
 	}
-	total := searchResult.TotalHits()
 
-	if total > 0 {
-		hit := searchResult.Hits.Hits[0]
-		var de EventDetail
-		err := json.Unmarshal(*hit.Source, &de)
-		return &de, err
+	termsAggRes, found := searchResult.Aggregations["attributes"]
+	if !found {
+		return nil, fmt.Errorf("ElasticSearch returned no aggregation for %s", attribute)
 	}
-	return nil, nil
+	util.LogDebug("Number of Buckets: %d", len(termsAggRes.Buckets))
+	return attributeValuesFromAggregation(attribute, termsAggRes, limit), nil
 }
 
-//Return all unique attributes
-//Possible queries, event_type, dns, identity, etc..
-func (es ElasticSearch) GetAttributes(queryName string, tenantId string) ([]string, error) {
-	index := indexName(tenantId)
-
-	util.LogDebug("Looking for unique attributes for %s in index %s", queryName, index)
-
-	//Mapping for attributes based on return values to API
-	//Source in this case is not the cadf source, but instead the first part of event_type
-	esFieldMapping := map[string]string{
-		"time":          "payload.eventTime",
-		"source":        "event_type",
-		"resource_type": "payload.target.typeURI",
-		"resource_name": "payload.target.id",
-		"event_type":    "event_type",
+// GetHistogram counts the matching events with a date_histogram aggregation, with a
+// terms aggregation in each bucket if the histogram is split by a field.
+func (es ElasticSearch) GetHistogram(filter *Filter, tenantId string, interval time.Duration, splitBy string) ([]HistogramBucket, error) {
+	ctx, cancel := es.context()
+	defer cancel()
+	client, keyword, err := es.searchClient(ctx)
+	if err != nil {
+		return nil, err
 	}
+	index, tenantFilter := es.indices.searchTarget(filter.tenants(tenantId), filter.Time, keyword)
+	util.LogDebug("Counting events by %s in index %s", interval, index)
 
-	var esName string
-	util.LogDebug("Mapped Queryname: %s", esFieldMapping[queryName])
-	//Append .raw onto queryName, in Elasticsearch. Aggregations turned on for .raw
-	if val, ok := esFieldMapping[queryName]; ok {
-		esName = val+".raw"
-	} else {
-		esName = queryName+".raw"
+	search, err := histogramSearch(filter, interval, splitBy, client.version.fixedIntervals(), keyword)
+	if err != nil {
+		return nil, err
+	}
+	searchResult, err := client.search(ctx, index, restrictSearch(search, tenantFilter))
+	if err != nil {
+		return nil, err
 	}
 
-	queryAgg := elastic.NewTermsAggregation().Field(esName)
+	histogram, found := searchResult.Aggregations["histogram"]
+	if !found {
+		return nil, errors.New("ElasticSearch returned no aggregation for the histogram")
+	}
+	_, split := HistogramFields[splitBy]
+	buckets := []HistogramBucket{}
+	for _, b := range histogram.Buckets {
+		key, ok := b.Key.(float64)
+		if !ok {
+			return nil, fmt.Errorf("ElasticSearch returned an invalid histogram key %v", b.Key)
+		}
+		bucket := HistogramBucket{
+			Time:  time.Unix(0, int64(key)*int64(time.Millisecond)).UTC(),
+			Count: b.DocCount,
+		}
+		if split {
+			bucket.Counts = make(map[string]int)
+			if b.Values != nil {
+				for _, v := range b.Values.Buckets {
+					bucket.Counts[fmt.Sprint(v.Key)] = v.DocCount
+				}
+			}
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
 
-	esSearch := es.client().Search().Index(index).Aggregation("attributes", queryAgg)
-	searchResult, err := esSearch.Do(context.Background())
+// GetTop ranks the values of the field by the number of matching events with a terms
+// aggregation, which can contain another terms aggregation for splitting the counts.
+func (es ElasticSearch) GetTop(filter *Filter, tenantId string, field string, limit uint, splitBy string) ([]TopValue, error) {
+	ctx, cancel := es.context()
+	defer cancel()
+	client, keyword, err := es.searchClient(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	if searchResult.Hits == nil {
-		util.LogDebug("expected Hits != nil; got: nil")
+	search, err := topSearch(filter, field, limit, splitBy, keyword)
+	if err != nil {
+		return nil, err
 	}
+	index, tenantFilter := es.indices.searchTarget(filter.tenants(tenantId), filter.Time, keyword)
+	util.LogDebug("Ranking values of %s in index %s", field, index)
 
-	agg := searchResult.Aggregations
-	if agg == nil {
-		util.LogDebug("expected Aggregations, got nil")
+	searchResult, err := client.search(ctx, index, restrictSearch(search, tenantFilter))
+	if err != nil {
+		return nil, err
 	}
 
-	termsAggRes, found := agg.Terms("attributes")
+	top, found := searchResult.Aggregations["top"]
 	if !found {
-		util.LogDebug("Term %s not found in Aggregation", esName)
+		return nil, fmt.Errorf("ElasticSearch returned no aggregation for %s", field)
 	}
-	if termsAggRes == nil {
-		util.LogDebug("termsAggRes is nil")
+	_, split := HistogramFields[splitBy]
+	values := []TopValue{}
+	for _, b := range top.Buckets {
+		value := TopValue{Value: fmt.Sprint(b.Key), Count: b.DocCount}
+		if value.Value == "" {
+			continue
+		}
+		if split {
+			value.Counts = make(map[string]int)
+			if b.Values != nil {
+				for _, v := range b.Values.Buckets {
+					value.Counts[fmt.Sprint(v.Key)] = v.DocCount
+				}
+			}
+		}
+		values = append(values, value)
 	}
-	util.LogDebug("Number of Buckets: %d", len(termsAggRes.Buckets))
+	return sortTopValues(values, limit), nil
+}
 
-	var unique []string
-	for _, bucket := range termsAggRes.Buckets {
-		util.LogDebug("key: %s count: %d", bucket.Key, bucket.DocCount)
-		//attributes = append(attributes, bucket.KeyAsString)
-		if queryName == "source" {
-			source := strings.SplitN(bucket.Key.(string), ".", 2)[0]
-			unique = append(unique, source)
-		} else {
-			unique = append(unique, bucket.Key.(string))
+// WriteEvents indexes the given events with a single bulk request. Each event goes into
+// the index of its tenant and domain, and with dated index names, of the event time. The
+// CADF event ID is used as document ID, so that writing an event again replaces the
+// existing document. Data streams cannot replace documents, so events that were already
+// written to a data stream are skipped.
+func (es ElasticSearch) WriteEvents(events []TenantEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	bulkErr := BulkError{Items: make(map[int]ItemError), Total: len(events)}
+	var items []esBulkItem
+	// position of each bulk item in events, since invalid events are skipped
+	var positions []int
+	for i, te := range events {
+		if te.Event == nil || te.Event.Payload.ID == "" {
+			// without an ID, ElasticSearch would generate one, and the event could be duplicated
+			bulkErr.Items[i] = ItemError{Status: 400, Reason: "event has no CADF event ID"}
+			continue
+		}
+		t, err := eventTime(te.Event)
+		if err != nil {
+			bulkErr.Items[i] = ItemError{Status: 400, Reason: err.Error()}
+			continue
 		}
+		positions = append(positions, i)
+		items = append(items, esBulkItem{
+			Index:  es.indices.writeIndex(te.TenantID, te.DomainID, t),
+			ID:     te.Event.Payload.ID,
+			Create: es.indices.mode == IndexModeDataStream,
+			Document: eventDocument{
+				EventDetail: te.Event,
+				Timestamp:   t.Format(time.RFC3339Nano),
+				TenantID:    te.TenantID,
+			},
+		})
+	}
+	if len(items) == 0 {
+		return bulkErr
 	}
 
-	unique = SliceUniqMap(unique)
-	return unique, nil
-}
-
-//Ensure unique slice values for Attributes
-func SliceUniqMap(s []string) []string {
-	seen := make(map[string]struct{}, len(s))
-	j := 0
-	for _, v := range s {
-		if _, ok := seen[v]; ok {
+	util.LogDebug("Writing %d events", len(items))
+	ctx, cancel := es.context()
+	defer cancel()
+	client, err := es.client(ctx)
+	if err != nil {
+		return err
+	}
+	bulkResult, err := client.bulk(ctx, items)
+	if err != nil {
+		return err
+	}
+	for j, item := range bulkResult.Items {
+		if j >= len(positions) {
+			break
+		}
+		i := positions[j]
+		result, ok := item["index"]
+		if !ok {
+			result, ok = item["create"]
+		}
+		if !ok || (result.Status >= 200 && result.Status <= 299) {
+			continue
+		}
+		if result.Status == http.StatusConflict && es.indices.mode == IndexModeDataStream {
+			// the event was written before
 			continue
 		}
-		seen[v] = struct{}{}
-		s[j] = v
-		j++
+		itemErr := ItemError{Status: result.Status}
+		if result.Error != nil {
+			itemErr.Reason = fmt.Sprintf("%s: %s", result.Error.Type, result.Error.Reason)
+		}
+		bulkErr.Items[i] = itemErr
+	}
+	if len(bulkErr.Items) > 0 {
+		return bulkErr
 	}
-	return s[:j]
+	return nil
+}
+
+// EnsureSchema installs the index template for the audit indices. It maps every string
+// to a text field with a .raw keyword subfield, which the term queries, sorting and
+// aggregations use, and maps the event times as dates. Indices that were created without
+// it, e.g. by Logstash, are searched in their .keyword subfields instead.
+func (es ElasticSearch) EnsureSchema() error {
+	util.LogDebug("Installing index template %s", eventTemplateName)
+	var mappings esQuery
+	err := json.Unmarshal([]byte(eventMappings), &mappings)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := es.context()
+	defer cancel()
+	client, err := es.client(ctx)
+	if err != nil {
+		return err
+	}
+	return client.putTemplate(ctx, eventTemplateName, es.indices.pattern(), mappings, es.indices.mode == IndexModeDataStream)
+}
+
+// eventDocument is what is stored in ElasticSearch for each event. The @timestamp field,
+//  which the default sort order is based on, used to be added by Logstash. The tenant is
+//  only needed for searching when the index names do not contain it.
+type eventDocument struct {
+	*EventDetail
+	Timestamp string `json:"@timestamp"`
+	TenantID  string `json:"tenant_id"`
 }
 
 func (es ElasticSearch) MaxLimit() uint {
-	return uint(viper.GetInt("elasticsearch.max_result_window"))
+	return es.config.MaxResultWindow
 }
 
-func indexName(tenantId string) string {
-	index := "audit-*"
-	if tenantId != "" {
-		index = fmt.Sprintf("audit-%s-*", tenantId)
+// Document type of the events written by Hermes, where ElasticSearch still has mapping types
+const eventDocType = "event"
+
+// Name of the index template installed by EnsureSchema
+const eventTemplateName = "hermes-audit"
+
+// Mappings of the audit indices, which the esClient wraps into an index template
+var eventMappings = `{
+	"dynamic_templates": [{
+		"strings": {
+			"match_mapping_type": "string",
+			"mapping": {
+				"type": "text",
+				"fields": {
+					"raw": {"type": "keyword", "ignore_above": 256}
+				}
+			}
+		}
+	}],
+	"properties": {
+		"@timestamp": {"type": "date"},
+		"payload": {
+			"properties": {
+				"eventTime": {
+					"type": "date",
+					"format": "strict_date_optional_time||yyyy-MM-dd'T'HH:mm:ss.SSSSSSZ"
+				}
+			}
+		}
+	}
+}`
+
+// Formats of payload.eventTime, as generated by pycadf (the first) or other sources
+var eventTimeFormats = []string{"2006-01-02T15:04:05.999999-0700", time.RFC3339Nano}
+
+// eventTime returns the time of the event. Events without a valid time are rejected
+//  rather than stored at the current time, since the time is part of where they are stored,
+//  so that an event that is received again would be stored a second time.
+func eventTime(event *EventDetail) (time.Time, error) {
+	t, ok := parseTime(event.Payload.EventTime, eventTimeFormats)
+	if !ok {
+		return time.Time{}, fmt.Errorf("cannot parse eventTime \"%s\"", event.Payload.EventTime)
 	}
-	return index
+	return t.UTC(), nil
 }
@@ -0,0 +1,706 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/hermes/pkg/util"
+)
+
+// ElasticSearchConfig contains the connection settings of the ElasticSearch driver,
+// as configured in the [elasticsearch] section of the config file.
+type ElasticSearchConfig struct {
+	// Nodes to connect to. With sniffing, the other nodes of the cluster are discovered from them.
+	URLs []string
+	// Credentials for basic authentication
+	Username string
+	Password string
+	// API key for the "Authorization: ApiKey" header, either as "id:api_key" or already base64-encoded
+	APIKey string
+	// PEM file with the CA certificates that the nodes' certificates are checked against,
+	// instead of the system's CAs
+	CACertFile string
+	// PEM files with the client certificate and key, for clusters that require TLS client authentication
+	ClientCertFile string
+	ClientKeyFile  string
+	// Whether to discover the nodes of the cluster from the seed nodes in URLs
+	Sniff bool
+	// How long a node that cannot be reached is skipped before it is tried again. Zero
+	// disables this, so that requests go to all nodes in turn regardless of failures.
+	HealthcheckInterval time.Duration
+	// Maximum duration of a single request, including retries. Zero means no timeout.
+	RequestTimeout time.Duration
+	// Number of times that a request is retried after a connection failure, or when the cluster is overloaded
+	MaxRetries int
+	// Waiting time before the first retry, which doubles with each further retry up to RetryMaxBackoff
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	// index.max_result_window of the audit indices
+	MaxResultWindow uint
+	// Name of the indices, aliases or data streams that events are written to, with the
+	// placeholders {tenant}, {domain} and {date}. Defaults to DefaultIndexTemplate.
+	IndexTemplate string
+	// One of the IndexMode constants, which says what IndexTemplate names. Defaults to IndexModeIndex.
+	IndexMode string
+}
+
+// NewElasticSearch returns an ElasticSearch driver with the given settings. It only
+// checks the settings, and connects to the cluster when the first request is made,
+// which is when the version of the cluster is determined.
+func NewElasticSearch(config ElasticSearchConfig) (ElasticSearch, error) {
+	es := ElasticSearch{config: config, conn: &esConnection{}}
+	if len(config.URLs) == 0 {
+		return es, errors.New("no ElasticSearch URL configured")
+	}
+	for _, u := range config.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return es, fmt.Errorf("invalid ElasticSearch URL \"%s\"", u)
+		}
+	}
+	if config.APIKey != "" && config.Username != "" {
+		return es, errors.New("ElasticSearch username and API key cannot be used together")
+	}
+	var err error
+	es.indices, err = newESIndices(config.IndexTemplate, config.IndexMode)
+	if err != nil {
+		return es, err
+	}
+	es.httpClient, err = config.httpClient()
+	return es, err
+}
+
+// httpClient builds the HTTP client for the TLS and API key settings.
+func (config ElasticSearchConfig) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if config.CACertFile != "" {
+		pem, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ElasticSearch CA certificates: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACertFile)
+		}
+	}
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load ElasticSearch client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client := &http.Client{Transport: transport}
+	if config.APIKey != "" {
+		apiKey := config.APIKey
+		if strings.Contains(apiKey, ":") {
+			apiKey = base64.StdEncoding.EncodeToString([]byte(apiKey))
+		}
+		client.Transport = apiKeyTransport{apiKey: apiKey, next: transport}
+	}
+	return client, nil
+}
+
+// apiKeyTransport adds the API key to every request.
+type apiKeyTransport struct {
+	apiKey string
+	next   http.RoundTripper
+}
+
+func (t apiKeyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "ApiKey "+t.apiKey)
+	return t.next.RoundTrip(r)
+}
+
+// esConnection holds the client, which is created on first use. It is shared by all copies
+//  of an ElasticSearch value, since the driver methods have value receivers.
+type esConnection struct {
+	mutex  sync.Mutex
+	client *esClient
+}
+
+// client returns the client, and connects to the cluster if that did not happen yet.
+//  If the connection fails, the next request tries again.
+func (es ElasticSearch) client(ctx context.Context) (*esClient, error) {
+	if es.conn == nil {
+		return nil, errors.New("ElasticSearch driver was not set up with NewElasticSearch()")
+	}
+	es.conn.mutex.Lock()
+	defer es.conn.mutex.Unlock()
+	if es.conn.client != nil {
+		return es.conn.client, nil
+	}
+
+	util.LogDebug("Connecting to ElasticSearch at %s", strings.Join(es.config.URLs, ", "))
+	client, err := connectElasticSearch(ctx, es.config, es.httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to ElasticSearch: %v", err)
+	}
+	util.LogInfo("Connected to %s", client.version)
+	es.conn.client = client
+	return client, nil
+}
+
+// searchClient returns the client together with the suffix of the keyword subfields in
+//  the indices, which searches need.
+func (es ElasticSearch) searchClient(ctx context.Context) (*esClient, string, error) {
+	client, err := es.client(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	keyword, err := client.keywordSuffix(ctx, es.indices.pattern())
+	return client, keyword, err
+}
+
+// context returns the context for a request, which ends after the configured timeout.
+func (es ElasticSearch) context() (context.Context, context.CancelFunc) {
+	if es.config.RequestTimeout > 0 {
+		return context.WithTimeout(context.Background(), es.config.RequestTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// esVersion identifies the software and major version of the cluster.
+type esVersion struct {
+	// "elasticsearch" or "opensearch"
+	Distribution string
+	Major, Minor int
+}
+
+func (v esVersion) String() string {
+	name := "ElasticSearch"
+	if v.Distribution == "opensearch" {
+		name = "OpenSearch"
+	}
+	return fmt.Sprintf("%s %d.%d", name, v.Major, v.Minor)
+}
+
+func parseVersion(number, distribution string) (esVersion, error) {
+	v := esVersion{Distribution: "elasticsearch"}
+	if distribution == "opensearch" {
+		v.Distribution = distribution
+	}
+	parts := strings.SplitN(number, ".", 3)
+	var err error
+	v.Major, err = strconv.Atoi(parts[0])
+	if err == nil && len(parts) > 1 {
+		v.Minor, err = strconv.Atoi(parts[1])
+	}
+	if err != nil {
+		return v, fmt.Errorf("cannot parse version \"%s\"", number)
+	}
+	if v.Distribution == "elasticsearch" && v.Major < 5 {
+		return v, fmt.Errorf("%s is not supported, at least ElasticSearch 5 is required", v)
+	}
+	return v, nil
+}
+
+// typeless returns whether indices have no mapping types, which is the case since
+//  ElasticSearch 7 and in all versions of OpenSearch.
+func (v esVersion) typeless() bool {
+	return v.Distribution == "opensearch" || v.Major >= 7
+}
+
+// composableTemplates returns whether the _index_template API is available, which
+//  replaces the legacy _template API since ElasticSearch 7.8.
+func (v esVersion) composableTemplates() bool {
+	return v.Distribution == "opensearch" || v.Major > 7 || (v.Major == 7 && v.Minor >= 8)
+}
+
+// dataStreams returns whether the cluster supports data streams, which is the case since
+//  ElasticSearch 7.9 and in all versions of OpenSearch.
+func (v esVersion) dataStreams() bool {
+	return v.Distribution == "opensearch" || v.Major > 7 || (v.Major == 7 && v.Minor >= 9)
+}
+
+// fixedIntervals returns whether the date_histogram aggregation takes fixed intervals as
+//  "fixed_interval", which replaces "interval" since ElasticSearch 7.2, and in all versions
+//  of OpenSearch.
+func (v esVersion) fixedIntervals() bool {
+	return v.Distribution == "opensearch" || v.Major > 7 || (v.Major == 7 && v.Minor >= 2)
+}
+
+// esClient sends requests to the nodes of an ElasticSearch or OpenSearch cluster, and
+// adapts them to the version of the cluster.
+type esClient struct {
+	config     ElasticSearchConfig
+	httpClient *http.Client
+	version    esVersion
+	mutex      sync.Mutex
+	nodes      []*esNode
+	next       int
+	// Suffix of the keyword subfields of strings, once known, see keywordSuffix
+	keyword string
+}
+
+type esNode struct {
+	url string
+	// When the node could last not be reached, or zero if it is available
+	failedAt time.Time
+}
+
+// connectElasticSearch probes the version of the cluster, and discovers its nodes if sniffing is enabled.
+func connectElasticSearch(ctx context.Context, config ElasticSearchConfig, httpClient *http.Client) (*esClient, error) {
+	c := &esClient{config: config, httpClient: httpClient}
+	for _, u := range config.URLs {
+		c.nodes = append(c.nodes, &esNode{url: strings.TrimSuffix(u, "/")})
+	}
+
+	var root struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	err := c.request(ctx, "GET", "/", nil, &root)
+	if err != nil {
+		return nil, err
+	}
+	c.version, err = parseVersion(root.Version.Number, root.Version.Distribution)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Sniff {
+		err = c.sniff(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// sniff replaces the nodes with the HTTP addresses that the nodes of the cluster publish.
+func (c *esClient) sniff(ctx context.Context) error {
+	var info struct {
+		Nodes map[string]struct {
+			HTTP struct {
+				PublishAddress string `json:"publish_address"`
+			} `json:"http"`
+		} `json:"nodes"`
+	}
+	err := c.request(ctx, "GET", "/_nodes/http", nil, &info)
+	if err != nil {
+		return fmt.Errorf("cannot discover nodes: %v", err)
+	}
+	scheme := "http"
+	if u, err := url.Parse(c.config.URLs[0]); err == nil {
+		scheme = u.Scheme
+	}
+	var nodes []*esNode
+	for _, node := range info.Nodes {
+		// The address is either "ip:port" or "hostname/ip:port"
+		address := node.HTTP.PublishAddress
+		if address == "" {
+			continue
+		}
+		address = address[strings.LastIndex(address, "/")+1:]
+		nodes = append(nodes, &esNode{url: scheme + "://" + address})
+	}
+	if len(nodes) == 0 {
+		return errors.New("no nodes with HTTP enabled found")
+	}
+	util.LogDebug("Discovered %d ElasticSearch nodes", len(nodes))
+	c.mutex.Lock()
+	c.nodes = nodes
+	c.mutex.Unlock()
+	return nil
+}
+
+// pickNode returns the next node that is not skipped because it could not be reached recently.
+//  If all nodes are skipped, the one that failed first is tried again.
+func (c *esClient) pickNode() *esNode {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var oldest *esNode
+	for range c.nodes {
+		node := c.nodes[c.next%len(c.nodes)]
+		c.next++
+		if node.failedAt.IsZero() || time.Since(node.failedAt) >= c.config.HealthcheckInterval {
+			return node
+		}
+		if oldest == nil || node.failedAt.Before(oldest.failedAt) {
+			oldest = node
+		}
+	}
+	return oldest
+}
+
+func (c *esClient) setFailed(node *esNode, failed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if failed {
+		node.failedAt = time.Now()
+	} else {
+		node.failedAt = time.Time{}
+	}
+}
+
+// esError is an error response of the cluster.
+type esError struct {
+	Status int
+	Type   string
+	Reason string
+}
+
+func (e esError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("ElasticSearch returned status %d", e.Status)
+	}
+	return fmt.Sprintf("ElasticSearch returned status %d: %s: %s", e.Status, e.Type, e.Reason)
+}
+
+func parseError(status int, body []byte) esError {
+	e := esError{Status: status}
+	var response struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &response) != nil || response.Error == nil {
+		return e
+	}
+	var details struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}
+	if json.Unmarshal(response.Error, &details) == nil {
+		e.Type, e.Reason = details.Type, details.Reason
+	} else {
+		json.Unmarshal(response.Error, &e.Reason)
+	}
+	return e
+}
+
+// retryable returns whether the request may succeed on another attempt.
+func (e esError) retryable() bool {
+	return e.Status == 429 || e.Status == 502 || e.Status == 503 || e.Status == 504
+}
+
+// backoff returns how long to wait before the given retry, or false if no more retries are allowed.
+func (config ElasticSearchConfig) backoff(retry int) (time.Duration, bool) {
+	if retry > config.MaxRetries {
+		return 0, false
+	}
+	wait := config.RetryInitialBackoff
+	for i := 1; i < retry && wait < config.RetryMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > config.RetryMaxBackoff {
+		wait = config.RetryMaxBackoff
+	}
+	return wait, true
+}
+
+// request sends a request with a JSON body (unless body is nil or already encoded as
+// []byte), and decodes the JSON response into result. Requests are retried on another
+// node when a node cannot be reached, or when the cluster is overloaded.
+func (c *esClient) request(ctx context.Context, method, path string, body, result interface{}) error {
+	var payload []byte
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		payload = b
+		contentType = "application/x-ndjson"
+	default:
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	for retry := 0; ; retry++ {
+		node := c.pickNode()
+		responseBody, err := c.requestNode(ctx, node, method, path, payload, contentType)
+		if err == nil {
+			if result == nil {
+				return nil
+			}
+			return json.Unmarshal(responseBody, result)
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if e, ok := err.(esError); ok && !e.retryable() {
+			return err
+		}
+		wait, ok := c.config.backoff(retry + 1)
+		if !ok {
+			return err
+		}
+		util.LogDebug("Retrying %s %s in %s (retry %d of %d): %s", method, path, wait, retry+1, c.config.MaxRetries, err.Error())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *esClient) requestNode(ctx context.Context, node *esNode, method, path string, payload []byte, contentType string) ([]byte, error) {
+	req, err := http.NewRequest(method, node.url+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if payload != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.config.Username != "" {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.setFailed(node, true)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	c.setFailed(node, false)
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, parseError(resp.StatusCode, responseBody)
+	}
+	return responseBody, nil
+}
+
+// Suffix of the keyword subfields that the index template of EnsureSchema maps strings to,
+//  and that the dynamic mapping of ElasticSearch (since 5.0) and OpenSearch maps them to
+const (
+	templateKeywordSuffix = ".raw"
+	dynamicKeywordSuffix  = ".keyword"
+)
+
+// keywordSuffix returns the suffix of the keyword subfields of strings, which term queries,
+//  sorting and aggregations use: ".raw" in indices that the index template of EnsureSchema
+//  applies to, and ".keyword" in indices that got the dynamic mapping instead, like those
+//  written by Logstash without that template. It is read from the mapping of the indices
+//  matching the pattern on the first search that finds any, and the suffix of the index
+//  template is used until then.
+func (c *esClient) keywordSuffix(ctx context.Context, pattern string) (string, error) {
+	c.mutex.Lock()
+	keyword := c.keyword
+	c.mutex.Unlock()
+	if keyword != "" {
+		return keyword, nil
+	}
+
+	// the indices with or without mapping types, see esVersion.typeless
+	var indices map[string]struct {
+		Mappings map[string]json.RawMessage `json:"mappings"`
+	}
+	path := fmt.Sprintf("/%s/_mapping/field/message_id%s,message_id%s", url.PathEscape(pattern), templateKeywordSuffix, dynamicKeywordSuffix)
+	err := c.request(ctx, "GET", path, nil, &indices)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the mapping of the indices: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, index := range indices {
+		fields := index.Mappings
+		if !c.version.typeless() {
+			fields = make(map[string]json.RawMessage)
+			for _, typeMappings := range index.Mappings {
+				var typeFields map[string]json.RawMessage
+				if json.Unmarshal(typeMappings, &typeFields) == nil {
+					for field, mapping := range typeFields {
+						fields[field] = mapping
+					}
+				}
+			}
+		}
+		for _, suffix := range []string{templateKeywordSuffix, dynamicKeywordSuffix} {
+			if _, found := fields["message_id"+suffix]; found {
+				counts[suffix]++
+				break
+			}
+		}
+	}
+
+	switch {
+	case counts[templateKeywordSuffix] > 0:
+		keyword = templateKeywordSuffix
+		if counts[dynamicKeywordSuffix] > 0 {
+			util.LogWarning("%d of the indices matching %s do not have the index template %s, so events in them are not found by field values", counts[dynamicKeywordSuffix], pattern, eventTemplateName)
+		}
+	case counts[dynamicKeywordSuffix] > 0:
+		keyword = dynamicKeywordSuffix
+		util.LogInfo("The indices matching %s do not have the index template %s, using the %s subfields of their dynamic mapping", pattern, eventTemplateName, dynamicKeywordSuffix)
+	default:
+		// no indices yet, so the mapping is read again on the next search
+		return templateKeywordSuffix, nil
+	}
+	c.mutex.Lock()
+	c.keyword = keyword
+	c.mutex.Unlock()
+	return keyword, nil
+}
+
+// Maximum length of the list of indices in the path of a search. ElasticSearch limits the
+//  request line to 4 KiB by default, so searches in more indices are sent to _msearch,
+//  which takes the indices in the body.
+const maxIndexListLength = 3000
+
+// search runs a search on the indices matching the given pattern.
+func (c *esClient) search(ctx context.Context, index string, search *esSearchRequest) (*esSearchResult, error) {
+	if c.version.typeless() {
+		// Otherwise, the total is only exact up to 10000
+		search.TrackTotalHits = true
+	}
+	var result esSearchResult
+	if len(index) <= maxIndexListLength {
+		err := c.request(ctx, "POST", "/"+url.PathEscape(index)+"/_search", search, &result)
+		return &result, err
+	}
+
+	header, err := json.Marshal(esQuery{"index": index})
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(search)
+	if err != nil {
+		return nil, err
+	}
+	payload := append(append(append(header, '\n'), body...), '\n')
+	var response struct {
+		Responses []json.RawMessage `json:"responses"`
+	}
+	err = c.request(ctx, "POST", "/_msearch", payload, &response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Responses) != 1 {
+		return nil, fmt.Errorf("ElasticSearch returned %d responses to a single search", len(response.Responses))
+	}
+	// errors of the search are reported in its response, with the status of the search
+	var status struct {
+		Status int `json:"status"`
+	}
+	if json.Unmarshal(response.Responses[0], &status) == nil && status.Status >= 300 {
+		return nil, parseError(status.Status, response.Responses[0])
+	}
+	err = json.Unmarshal(response.Responses[0], &result)
+	return &result, err
+}
+
+// esBulkItem is a document to be indexed with a bulk request.
+type esBulkItem struct {
+	Index string
+	ID    string
+	// Whether the document may only be created, but not replaced, which data streams require
+	Create   bool
+	Document interface{}
+}
+
+// docType returns the mapping type of the documents, which is only needed before ElasticSearch 7.
+func (c *esClient) docType() string {
+	if c.version.typeless() {
+		return ""
+	}
+	return eventDocType
+}
+
+// bulk indexes the documents.
+func (c *esClient) bulk(ctx context.Context, items []esBulkItem) (*esBulkResult, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		action := map[string]string{"_index": item.Index, "_id": item.ID}
+		if docType := c.docType(); docType != "" {
+			action["_type"] = docType
+		}
+		op := "index"
+		if item.Create {
+			op = "create"
+		}
+		line, err := json.Marshal(map[string]interface{}{op: action})
+		if err != nil {
+			return nil, err
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+		line, err = json.Marshal(item.Document)
+		if err != nil {
+			return nil, err
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+	var result esBulkResult
+	err := c.request(ctx, "POST", "/_bulk", body.Bytes(), &result)
+	return &result, err
+}
+
+// putTemplate installs an index template with the given mappings for the indices matching the pattern.
+//  With dataStream, the matching data streams are created automatically, which only composable
+//  templates support.
+func (c *esClient) putTemplate(ctx context.Context, name, pattern string, mappings esQuery, dataStream bool) error {
+	if dataStream && !c.version.dataStreams() {
+		return fmt.Errorf("%s does not support data streams", c.version)
+	}
+	var path string
+	var template esQuery
+	switch {
+	case c.version.composableTemplates():
+		path = "/_index_template/" + name
+		template = esQuery{
+			"index_patterns": []string{pattern},
+			"template":       esQuery{"mappings": mappings},
+			// higher than the priority of the built-in templates, e.g. "logs-*-*" with 100
+			"priority": 200,
+		}
+		if dataStream {
+			template["data_stream"] = esQuery{}
+		}
+	case c.version.typeless():
+		path = "/_template/" + name
+		template = esQuery{"index_patterns": []string{pattern}, "mappings": mappings}
+	case c.version.Major == 6:
+		path = "/_template/" + name
+		template = esQuery{"index_patterns": []string{pattern}, "mappings": esQuery{eventDocType: mappings}}
+	default:
+		path = "/_template/" + name
+		template = esQuery{"template": pattern, "mappings": esQuery{"_default_": mappings}}
+	}
+	return c.request(ctx, "PUT", path, template, nil)
+}
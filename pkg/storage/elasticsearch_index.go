@@ -0,0 +1,241 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Modes of ElasticSearchConfig.IndexMode
+const (
+	// Events are written to the indices named by the index template, which ElasticSearch creates as needed.
+	IndexModeIndex = "index"
+	// The index template names write aliases, which are managed outside of Hermes, e.g. with rollover.
+	IndexModeAlias = "alias"
+	// The index template names data streams, which ElasticSearch 7.9 or later and OpenSearch create as needed.
+	IndexModeDataStream = "data_stream"
+)
+
+// DefaultIndexTemplate is the index naming used by Hermes originally: daily indices per tenant.
+const DefaultIndexTemplate = "audit-{tenant}-{date}"
+
+// Format of {date} in index names
+const indexDateFormat = "2006.01.02"
+
+// Maximum number of date patterns that a search is narrowed to, so that the request line stays short
+const maxIndexPatterns = 32
+
+var indexPlaceholderRx = regexp.MustCompile(`\{[^}]*\}`)
+
+// Adjacent wildcards, which are merged, so that e.g. all indices of the default template are "audit-*"
+var adjacentWildcardsRx = regexp.MustCompile(`\*[-_.]?\*`)
+
+func mergeWildcards(pattern string) string {
+	for adjacentWildcardsRx.MatchString(pattern) {
+		pattern = adjacentWildcardsRx.ReplaceAllString(pattern, "*")
+	}
+	return pattern
+}
+
+// esIndices resolves the index names that events are written to and searched in.
+type esIndices struct {
+	template string
+	mode     string
+}
+
+func newESIndices(template, mode string) (esIndices, error) {
+	if template == "" {
+		template = DefaultIndexTemplate
+	}
+	if mode == "" {
+		mode = IndexModeIndex
+	}
+	x := esIndices{template, mode}
+	for _, placeholder := range indexPlaceholderRx.FindAllString(template, -1) {
+		switch placeholder {
+		case "{tenant}", "{domain}", "{date}":
+		default:
+			return x, fmt.Errorf("unknown placeholder %s in ElasticSearch index template \"%s\"", placeholder, template)
+		}
+	}
+	if strings.ToLower(template) != template || strings.ContainsAny(template, `*?"<>|\/, #:`) {
+		return x, fmt.Errorf("ElasticSearch index template \"%s\" is not a valid index name", template)
+	}
+	switch mode {
+	case IndexModeIndex:
+	case IndexModeAlias, IndexModeDataStream:
+		// the date is in the names of the backing indices instead
+		if strings.Contains(template, "{date}") {
+			return x, fmt.Errorf("ElasticSearch index template cannot contain {date} with index mode \"%s\"", mode)
+		}
+	default:
+		return x, fmt.Errorf("unknown ElasticSearch index mode \"%s\"", mode)
+	}
+	return x, nil
+}
+
+func (x esIndices) resolve(tenantId, domainId, date string) string {
+	return strings.NewReplacer("{tenant}", tenantId, "{domain}", domainId, "{date}", date).Replace(x.template)
+}
+
+// writeIndex returns the index, alias or data stream that an event of the tenant from the given time is written to.
+func (x esIndices) writeIndex(tenantId, domainId string, t time.Time) string {
+	if domainId == "" {
+		domainId = "unknown"
+	}
+	return x.resolve(tenantId, domainId, t.UTC().Format(indexDateFormat))
+}
+
+// pattern returns the pattern matching all indices that are written to, for the index template of EnsureSchema.
+func (x esIndices) pattern() string {
+	pattern := x.resolve("*", "*", "*")
+	if x.mode == IndexModeAlias {
+		// the backing indices, e.g. audit-000001 for the alias audit
+		pattern += "*"
+	}
+	return mergeWildcards(pattern)
+}
+
+// searchTarget returns the indices to search for events of the tenants, or of all tenants if
+//  there are none, together with a filter that restricts the search to the tenants where the
+//  index names do not. The domain is not known when searching, so all domains are searched.
+//  When the index names contain the date, the search is narrowed to the indices of the days
+//  that the time filter overlaps.
+//  Where the index names contain the tenant, they are the only restriction, however long the
+//  list of indices gets (see esClient.search), because events that were not written by
+//  WriteEvents, e.g. by Logstash, do not have the tenant_id field. The filter uses the keyword
+//  subfield with the given suffix.
+func (x esIndices) searchTarget(tenantIds []string, timeFilter map[string]string, keyword string) (string, esQuery) {
+	dates := []string{"*"}
+	if strings.Contains(x.template, "{date}") {
+		dates = datePatterns(timeFilter)
+	}
+	patterns := func(tenantIds []string) string {
+		var result []string
+		for _, tenantId := range tenantIds {
+			for _, date := range dates {
+				result = append(result, mergeWildcards(x.resolve(tenantId, "*", date)))
+			}
+		}
+		return strings.Join(result, ",")
+	}
+
+	if len(tenantIds) == 0 {
+		return patterns([]string{"*"}), nil
+	}
+	if strings.Contains(x.template, "{tenant}") {
+		return patterns(tenantIds), nil
+	}
+	// the events are found by the tenant_id field that WriteEvents adds
+	return patterns([]string{"*"}), esTerms("tenant_id"+keyword, stringValues(tenantIds))
+}
+
+// tenantFromIndex returns the tenant from the name of the index that a document was found in,
+//  for events that were written without the tenant_id field, or "" if the index names do not
+//  contain the tenant.
+func (x esIndices) tenantFromIndex(index string) string {
+	parts := strings.SplitN(x.template, "{tenant}", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	var prefix []string
+	for _, literal := range indexPlaceholderRx.Split(parts[0], -1) {
+		prefix = append(prefix, regexp.QuoteMeta(literal))
+	}
+	// backing indices of data streams start with ".ds-"
+	rx := regexp.MustCompile(`^(?:\.ds-)?` + strings.Join(prefix, `.*?`) + `([^-_.]+)`)
+	match := rx.FindStringSubmatch(index)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// datePatterns returns patterns for {date} that match the indices of the days that the
+//  time filter overlaps, plus the day before and after: whole years and months as "2017.*"
+//  and "2017.05.*", and single days as "2017.05.02*". Without a lower bound, it matches all
+//  dates. The patterns end in "*", so that indices that do not exist are skipped instead of
+//  failing the search.
+func datePatterns(timeFilter map[string]string) []string {
+	// values that only ElasticSearch understands are searched in all indices
+	bounds, err := parseTimeFilter(timeFilter)
+	if err != nil {
+		return []string{"*"}
+	}
+	var from, to time.Time
+	for op, t := range bounds {
+		t = t.UTC()
+		switch op {
+		case "gt", "gte":
+			if from.IsZero() || t.After(from) {
+				from = t
+			}
+		case "lt", "lte":
+			if op == "lt" {
+				t = t.Add(-time.Nanosecond)
+			}
+			if to.IsZero() || t.Before(to) {
+				to = t
+			}
+		}
+	}
+	if from.IsZero() {
+		return []string{"*"}
+	}
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	if to.Before(from) {
+		// nothing matches anyway
+		return []string{from.Format(indexDateFormat) + "*"}
+	}
+	// Logstash named the indices by @timestamp, i.e. the time when it received the event,
+	// so an event can be in the index of another day than its eventTime, e.g. shortly before
+	// midnight or when the clocks differ. The same covers events that are slightly ahead
+	// of the clock of Hermes.
+	from = from.AddDate(0, 0, -1)
+	to = to.AddDate(0, 0, 1)
+
+	// if there are too many single days, partially covered months are searched as a whole
+	for _, roundDays := range []bool{false, true} {
+		var patterns []string
+		for day := from; !day.After(to); {
+			switch {
+			case day.Month() == time.January && day.Day() == 1 && !day.AddDate(1, 0, -1).After(to):
+				patterns = append(patterns, day.Format("2006")+".*")
+				day = day.AddDate(1, 0, 0)
+			case day.Day() == 1 && !day.AddDate(0, 1, -1).After(to), roundDays:
+				patterns = append(patterns, day.Format("2006.01")+".*")
+				day = time.Date(day.Year(), day.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			default:
+				patterns = append(patterns, day.Format(indexDateFormat)+"*")
+				day = day.AddDate(0, 0, 1)
+			}
+		}
+		if len(patterns) <= maxIndexPatterns {
+			return patterns
+		}
+	}
+	return []string{"*"}
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ESIndices_Names(t *testing.T) {
+	day := time.Date(2017, 5, 2, 23, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	tests := []struct {
+		template, mode string
+		// expected results
+		write, pattern, searchTenant, searchAll string
+		tenantFilter                            bool
+	}{
+		{"", "", "audit-p1-2017.05.02", "audit-*", "audit-p1-*", "audit-*", false},
+		{"audit-{domain}-{tenant}-{date}", "index", "audit-d1-p1-2017.05.02", "audit-*", "audit-*-p1-*", "audit-*", false},
+		{"hermes-{domain}", "index", "hermes-d1", "hermes-*", "hermes-*", "hermes-*", true},
+		{"audit-{tenant}", "alias", "audit-p1", "audit-*", "audit-p1", "audit-*", false},
+		{"audit", "data_stream", "audit", "audit", "audit", "audit", true},
+	}
+	for _, test := range tests {
+		x, err := newESIndices(test.template, test.mode)
+		require.Nil(t, err)
+		assert.Equal(t, test.write, x.writeIndex("p1", "d1", day), test.template)
+		assert.Equal(t, test.pattern, x.pattern(), test.template)
+		index, filter := x.searchTarget([]string{"p1"}, nil, ".raw")
+		assert.Equal(t, test.searchTenant, index, test.template)
+		assert.Equal(t, test.tenantFilter, filter != nil, test.template)
+		index, filter = x.searchTarget(nil, nil, ".raw")
+		assert.Equal(t, test.searchAll, index, test.template)
+		assert.Nil(t, filter, test.template)
+	}
+
+	x, _ := newESIndices("audit-{domain}", "index")
+	assert.Equal(t, "audit-unknown", x.writeIndex("p1", "", day))
+}
+
+func Test_ESIndices_Invalid(t *testing.T) {
+	for _, config := range [][2]string{
+		{"audit-{project}-{date}", "index"},
+		{"Audit-{tenant}", "index"},
+		{"audit-*", "index"},
+		{"audit-{tenant}-{date}", "alias"},
+		{"audit-{tenant}-{date}", "data_stream"},
+		{"audit-{tenant}", "rollover"},
+	} {
+		_, err := newESIndices(config[0], config[1])
+		assert.NotNil(t, err, "%v", config)
+	}
+}
+
+func Test_ESIndices_DatePatterns(t *testing.T) {
+	tests := []struct {
+		filter   map[string]string
+		expected []string
+	}{
+		{nil, []string{"*"}},
+		{map[string]string{"lt": "2017-05-02"}, []string{"*"}},
+		{map[string]string{"gte": "yesterday"}, []string{"*"}},
+		{map[string]string{"gte": "2017-05-02", "lt": "2017-05-03"}, []string{"2017.05.01*", "2017.05.02*", "2017.05.03*"}},
+		{map[string]string{"gt": "2017-05-02T10:00:00", "lte": "2017-05-03T10:00:00"}, []string{"2017.05.01*", "2017.05.02*", "2017.05.03*", "2017.05.04*"}},
+		// times are converted to UTC, like the event times in the index names
+		{map[string]string{"gte": "2017-05-02T01:00:00.000000+0200", "lte": "2017-05-02T10:00:00.000000+0000"}, []string{"2017.04.30*", "2017.05.01*", "2017.05.02*", "2017.05.03*"}},
+		{map[string]string{"gte": "2017-04-30", "lte": "2017-05-31"}, []string{"2017.04.29*", "2017.04.30*", "2017.05.*", "2017.06.01*"}},
+		{map[string]string{"gte": "2017-01-01", "lte": "2017-12-31"}, []string{"2016.12.31*", "2017.*", "2018.01.01*"}},
+		// too many days for single patterns
+		{map[string]string{"gte": "2017-04-10", "lte": "2017-06-20"}, []string{"2017.04.*", "2017.05.*", "2017.06.*"}},
+		// empty range
+		{map[string]string{"gte": "2017-05-03", "lte": "2017-05-02"}, []string{"2017.05.03*"}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, datePatterns(test.filter), fmt.Sprint(test.filter))
+	}
+
+	x, _ := newESIndices("", "")
+	index, _ := x.searchTarget([]string{"p1"}, map[string]string{"gte": "2017-05-02", "lte": "2017-05-03"}, ".raw")
+	assert.Equal(t, "audit-p1-2017.05.01*,audit-p1-2017.05.02*,audit-p1-2017.05.03*,audit-p1-2017.05.04*", index)
+	index, _ = x.searchTarget(nil, map[string]string{"gte": "2017-05-02", "lt": "2017-05-03"}, ".raw")
+	assert.Equal(t, "audit-*-2017.05.01*,audit-*-2017.05.02*,audit-*-2017.05.03*", index)
+}
+
+func Test_ESIndices_SeveralTenants(t *testing.T) {
+	x, _ := newESIndices("", "")
+	index, filter := x.searchTarget([]string{"d1", "p1", "p2"}, map[string]string{"gte": "2017-05-02", "lt": "2017-05-03"}, ".raw")
+	assert.Equal(t, "audit-d1-2017.05.01*,audit-d1-2017.05.02*,audit-d1-2017.05.03*,"+
+		"audit-p1-2017.05.01*,audit-p1-2017.05.02*,audit-p1-2017.05.03*,"+
+		"audit-p2-2017.05.01*,audit-p2-2017.05.02*,audit-p2-2017.05.03*", index)
+	assert.Nil(t, filter)
+
+	// Even with too many indices for the request line, the index names select the tenants,
+	// since only the events written by Hermes have the tenant_id field
+	var tenantIds []string
+	for i := 0; i < 200; i++ {
+		tenantIds = append(tenantIds, fmt.Sprintf("%032x", i))
+	}
+	index, filter = x.searchTarget(tenantIds, nil, ".raw")
+	assert.Equal(t, 200, len(strings.Split(index, ",")))
+	assert.Nil(t, filter)
+}
+
+func Test_ESIndices_TenantFromIndex(t *testing.T) {
+	tests := []struct{ template, index, tenant string }{
+		{"audit-{tenant}-{date}", "audit-ae63ddf2076d4342a56eb049e37a7621-2017.05.02", "ae63ddf2076d4342a56eb049e37a7621"},
+		{"audit-{domain}-{tenant}-{date}", "audit-d1-p1-2017.05.02", "p1"},
+		{"audit-{tenant}", ".ds-audit-p1-2017.05.02-000001", "p1"},
+		{"audit-{tenant}", "logs-2017.05.02", ""},
+		{"hermes-{domain}", "hermes-d1", ""},
+	}
+	for _, test := range tests {
+		x, err := newESIndices(test.template, "")
+		require.Nil(t, err)
+		assert.Equal(t, test.tenant, x.tenantFromIndex(test.index), test.template)
+	}
+}
+
+func Test_ElasticSearch_DataStream(t *testing.T) {
+	var bulkBody []byte
+	var template map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `{"version": {"number": "8.11.1"}}`)
+		case "/_index_template/hermes-audit":
+			require.Nil(t, json.NewDecoder(r.Body).Decode(&template))
+			fmt.Fprint(w, `{"acknowledged": true}`)
+		case "/_bulk":
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(r.Body)
+			bulkBody = buf.Bytes()
+			fmt.Fprint(w, `{"errors": true, "items": [
+				{"create": {"_index": ".ds-audit-p1-2017.05.02-000001", "_id": "a", "status": 201}},
+				{"create": {"_index": ".ds-audit-p1-2017.05.02-000001", "_id": "b", "status": 409,
+					"error": {"type": "version_conflict_engine_exception", "reason": "document already exists"}}}
+			]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	es, err := NewElasticSearch(ElasticSearchConfig{URLs: []string{server.URL}, IndexTemplate: "audit-{tenant}", IndexMode: IndexModeDataStream})
+	require.Nil(t, err)
+	require.Nil(t, es.EnsureSchema())
+	assert.Equal(t, map[string]interface{}{}, template["data_stream"])
+	assert.Equal(t, []interface{}{"audit-*"}, template["index_patterns"])
+
+	// Events that are already in the data stream are not an error
+	err = es.WriteEvents([]TenantEvent{
+		{TenantID: "p1", Event: testEvent("a", "identity.project.deleted", "data/security/project", "12:00:00")},
+		{TenantID: "p1", Event: testEvent("b", "identity.project.deleted", "data/security/project", "12:00:00")},
+	})
+	assert.Nil(t, err)
+	scanner := bufio.NewScanner(bytes.NewReader(bulkBody))
+	require.True(t, scanner.Scan())
+	var action map[string]map[string]string
+	require.Nil(t, json.Unmarshal(scanner.Bytes(), &action))
+	assert.Equal(t, map[string]map[string]string{"create": {"_index": "audit-p1", "_id": "a"}}, action)
+	require.True(t, scanner.Scan())
+	var document map[string]interface{}
+	require.Nil(t, json.Unmarshal(scanner.Bytes(), &document))
+	assert.Equal(t, "p1", document["tenant_id"])
+}
+
+func Test_ElasticSearch_DataStreamUnsupported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version": {"number": "6.8.23"}}`)
+	}))
+	defer server.Close()
+	es, err := NewElasticSearch(ElasticSearchConfig{URLs: []string{server.URL}, IndexTemplate: "audit", IndexMode: IndexModeDataStream})
+	require.Nil(t, err)
+	assert.NotNil(t, es.EnsureSchema())
+}
@@ -0,0 +1,423 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// This file builds the requests of the ElasticSearch driver in the query DSL, and
+// parses the responses. It only uses what all supported versions of ElasticSearch
+// and OpenSearch have in common; the differences are handled by the esClient.
+
+// esQuery is a part of a request body in the query DSL.
+type esQuery map[string]interface{}
+
+func esBoolFilter(filters []esQuery) esQuery {
+	if len(filters) == 0 {
+		return esQuery{"match_all": esQuery{}}
+	}
+	return esQuery{"bool": esQuery{"filter": filters}}
+}
+
+func esMatchPhrasePrefix(field, text string) esQuery {
+	return esQuery{"match_phrase_prefix": esQuery{field: esQuery{"query": text}}}
+}
+
+func esTerm(field, value string) esQuery {
+	return esQuery{"term": esQuery{field: value}}
+}
+
+func esTerms(field string, values []interface{}) esQuery {
+	return esQuery{"terms": esQuery{field: values}}
+}
+
+func stringValues(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
+
+func esMatchPhrase(field, text string) esQuery {
+	return esQuery{"match_phrase": esQuery{field: esQuery{"query": text}}}
+}
+
+// esWildcard builds a wildcard query for a pattern where only "*" is a wildcard.
+func esWildcard(field, pattern string) esQuery {
+	pattern = strings.NewReplacer(`\`, `\\`, `?`, `\?`).Replace(pattern)
+	return esQuery{"wildcard": esQuery{field: esQuery{"value": pattern}}}
+}
+
+func esPrefix(field, value string) esQuery {
+	return esQuery{"prefix": esQuery{field: value}}
+}
+
+func esRange(field, op, value string) esQuery {
+	return esQuery{"range": esQuery{field: esQuery{op: value}}}
+}
+
+func esSort(field string, ascending bool) esQuery {
+	order := "desc"
+	if ascending {
+		order = "asc"
+	}
+	return esQuery{field: esQuery{"order": order}}
+}
+
+// esSearchRequest is the body of a _search request.
+type esSearchRequest struct {
+	Query        esQuery            `json:"query"`
+	Sort         []esQuery          `json:"sort,omitempty"`
+	From         int                `json:"from,omitempty"`
+	Size         int                `json:"size"`
+	SearchAfter  []interface{}      `json:"search_after,omitempty"`
+	Aggregations map[string]esQuery `json:"aggregations,omitempty"`
+	// Set by the esClient where needed, so that totals above 10000 are exact
+	TrackTotalHits bool `json:"track_total_hits,omitempty"`
+}
+
+// restrictSearch adds a filter to the query of a search, unless it is nil.
+func restrictSearch(search *esSearchRequest, filter esQuery) *esSearchRequest {
+	if filter != nil {
+		search.Query = esQuery{"bool": esQuery{"filter": []esQuery{search.Query, filter}}}
+	}
+	return search
+}
+
+// Mapping from the API's sort fields to fields in the index
+//  Text fields cannot be sorted on, so the keyword subfields of the strings are used.
+var esSortFields = map[string]string{
+	"time":          "payload.eventTime",
+	"source":        "publisher_id",
+	"resource_type": "payload.target.typeURI",
+	"resource_name": "payload.target.id",
+	"event_type":    "event_type",
+}
+
+// esSortField returns the field in the index that a sort field of the API sorts on.
+func esSortField(fieldname, keyword string) string {
+	if fieldname == "time" {
+		return esSortFields[fieldname]
+	}
+	return esSortFields[fieldname] + keyword
+}
+
+// eventSearch builds the search for GetEvents. Field values are compared with the keyword
+//  subfields, whose suffix is given by esClient.keywordSuffix.
+func eventSearch(filter *Filter, keyword string) (*esSearchRequest, error) {
+	err := filter.checkValues()
+	if err != nil {
+		return nil, err
+	}
+	var filters []esQuery
+	for _, field := range filterFields {
+		v := field.values(filter)
+		switch len(v.Include) {
+		case 0:
+		case 1:
+			filters = append(filters, esValueQuery(field, v.Include[0], keyword))
+		default:
+			var operands []esQuery
+			for _, value := range v.Include {
+				operands = append(operands, esValueQuery(field, value, keyword))
+			}
+			filters = append(filters, esQuery{"bool": esQuery{"should": operands, "minimum_should_match": 1}})
+		}
+		if len(v.Exclude) > 0 {
+			var operands []esQuery
+			for _, value := range v.Exclude {
+				operands = append(operands, esValueQuery(field, value, keyword))
+			}
+			filters = append(filters, esQuery{"bool": esQuery{"must_not": operands}})
+		}
+	}
+	for _, op := range []string{"lt", "lte", "gt", "gte"} {
+		if value, ok := filter.Time[op]; ok {
+			filters = append(filters, esRange("payload.eventTime", op, value))
+		}
+	}
+	if filter.Query != nil {
+		filters = append(filters, esQueryFor(filter.Query, keyword))
+	}
+
+	search := &esSearchRequest{Query: esBoolFilter(filters), Size: int(filter.Limit)}
+	for _, fieldOrder := range filter.Sort {
+		switch fieldOrder.Order {
+		case "asc":
+			search.Sort = append(search.Sort, esSort(esSortField(fieldOrder.Fieldname, keyword), true))
+		case "desc":
+			search.Sort = append(search.Sort, esSort(esSortField(fieldOrder.Fieldname, keyword), false))
+		}
+	}
+	// message_id is unique, so sorting on it last gives a stable order, which search_after depends on
+	search.Sort = append(search.Sort, esSort("@timestamp", false), esSort("message_id"+keyword, true))
+
+	if filter.Cursor != nil {
+		search.SearchAfter = filter.Cursor.SortValues
+	} else {
+		search.From = int(filter.Offset)
+	}
+
+	// aggregations count all matching events, not only those on the page
+	for i, facet := range filter.Facets {
+		agg, err := attributeAggregation(facet, filter.FacetLimit, keyword)
+		if err != nil {
+			return nil, err
+		}
+		if search.Aggregations == nil {
+			search.Aggregations = make(map[string]esQuery)
+		}
+		search.Aggregations[facetAggregationName(i)] = agg
+	}
+	return search, nil
+}
+
+// facetAggregationName names the aggregation of the i-th facet in the search of GetEvents.
+func facetAggregationName(i int) string {
+	return fmt.Sprintf("facet_%d", i)
+}
+
+// esValueQuery matches a value of a ValueFilter, see filterFields.
+func esValueQuery(field filterField, value, keyword string) esQuery {
+	switch {
+	case isWildcard(value):
+		return esWildcard(field.path+keyword, value)
+	case field.match == valuePrefix:
+		return esPrefix(field.path+keyword, value)
+	case field.match == valuePhrasePrefix:
+		return esMatchPhrasePrefix(field.path, value)
+	case field.match == valueAddress:
+		// checked by Filter.checkValues
+		exact, prefixes, _ := addressMatch(value)
+		var operands []esQuery
+		if len(exact) > 0 {
+			operands = append(operands, esTerms(field.path+keyword, stringValues(exact)))
+		}
+		for _, prefix := range prefixes {
+			operands = append(operands, esPrefix(field.path+keyword, prefix))
+		}
+		return esQuery{"bool": esQuery{"should": operands, "minimum_should_match": 1}}
+	}
+	return esTerm(field.path+keyword, value)
+}
+
+// esQueryFor translates a query of Filter.Query. Field values are compared with the
+//  keyword subfields, while text is searched in the text fields.
+func esQueryFor(query Query, keyword string) esQuery {
+	switch query := query.(type) {
+	case QueryAnd:
+		var operands []esQuery
+		for _, operand := range query {
+			operands = append(operands, esQueryFor(operand, keyword))
+		}
+		return esQuery{"bool": esQuery{"filter": operands}}
+	case QueryOr:
+		var operands []esQuery
+		for _, operand := range query {
+			operands = append(operands, esQueryFor(operand, keyword))
+		}
+		return esQuery{"bool": esQuery{"should": operands, "minimum_should_match": 1}}
+	case QueryNot:
+		return esQuery{"bool": esQuery{"must_not": []esQuery{esQueryFor(query.Operand, keyword)}}}
+	case QueryMatch:
+		field := QueryFields[query.Field] + keyword
+		if query.Wildcard {
+			return esWildcard(field, query.Value)
+		}
+		return esTerm(field, query.Value)
+	case QueryText:
+		var operands []esQuery
+		for _, path := range queryPaths() {
+			operands = append(operands, esMatchPhrase(path, query.Text))
+		}
+		return esQuery{"bool": esQuery{"should": operands, "minimum_should_match": 1}}
+	}
+	return esQuery{"match_all": esQuery{}}
+}
+
+// eventByIdSearch builds the search for GetEvent.
+func eventByIdSearch(eventId, keyword string) *esSearchRequest {
+	return &esSearchRequest{Query: esTerm("message_id"+keyword, eventId), Size: 1}
+}
+
+// attributeSearch builds the search for GetAttributes, which counts the values of an
+//  attribute among the matching events.
+func attributeSearch(filter *Filter, attribute string, limit uint, keyword string) (*esSearchRequest, error) {
+	agg, err := attributeAggregation(attribute, limit, keyword)
+	if err != nil {
+		return nil, err
+	}
+	search, err := eventSearch(filter, keyword)
+	if err != nil {
+		return nil, err
+	}
+	// only the aggregation is needed, not the events
+	search.Size, search.From, search.Sort, search.SearchAfter = 0, 0, nil, nil
+	search.Aggregations = map[string]esQuery{"attributes": agg}
+	return search, nil
+}
+
+// attributeAggregation builds the terms aggregation on the keyword subfield of an
+//  attribute, see attributeValuesFromAggregation.
+func attributeAggregation(attribute string, limit uint, keyword string) (esQuery, error) {
+	path, err := attributePath(attribute, limit)
+	if err != nil {
+		return nil, err
+	}
+	// the values of "source" are added up from the most frequent event types
+	size := limit
+	if attribute == "source" {
+		size = MaxAttributeLimit
+	}
+	return esQuery{"terms": esQuery{"field": path + keyword, "size": size}}, nil
+}
+
+// attributeValuesFromAggregation returns the attribute values counted by an attributeAggregation.
+func attributeValuesFromAggregation(attribute string, agg esTermsAggregation, limit uint) AttributeValueList {
+	counts := make(map[string]int64)
+	for _, bucket := range agg.Buckets {
+		counts[fmt.Sprint(bucket.Key)] = int64(bucket.DocCount)
+	}
+	return attributeValues(attribute, counts, limit)
+}
+
+// histogramSearch builds the search for GetHistogram. Depending on the version, the
+//  date_histogram aggregation takes its interval as "fixed_interval" or as "interval".
+func histogramSearch(filter *Filter, interval time.Duration, splitBy string, fixedInterval bool, keyword string) (*esSearchRequest, error) {
+	err := checkInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+	search, err := eventSearch(filter, keyword)
+	if err != nil {
+		return nil, err
+	}
+	// only the aggregation is needed, not the events
+	search.Size, search.From, search.Sort, search.SearchAfter = 0, 0, nil, nil
+
+	intervalParam := "interval"
+	if fixedInterval {
+		intervalParam = "fixed_interval"
+	}
+	histogram := esQuery{"date_histogram": esQuery{
+		"field":         "payload.eventTime",
+		intervalParam:   fmt.Sprintf("%dms", interval/time.Millisecond),
+		"min_doc_count": 1,
+	}}
+	if path, ok := HistogramFields[splitBy]; ok {
+		histogram["aggregations"] = map[string]esQuery{
+			"values": {"terms": esQuery{"field": path + keyword, "size": MaxHistogramValues}},
+		}
+	}
+	search.Aggregations = map[string]esQuery{"histogram": histogram}
+	return search, nil
+}
+
+// topSearch builds the search for GetTop, which counts the values of a keyword field with
+//  a terms aggregation, and within each of its buckets the values of the splitBy field.
+func topSearch(filter *Filter, field string, limit uint, splitBy string, keyword string) (*esSearchRequest, error) {
+	path, err := topPath(field, limit)
+	if err != nil {
+		return nil, err
+	}
+	search, err := eventSearch(filter, keyword)
+	if err != nil {
+		return nil, err
+	}
+	// only the aggregation is needed, not the events
+	search.Size, search.From, search.Sort, search.SearchAfter = 0, 0, nil, nil
+
+	// one more value than needed, in case that one of them is empty
+	terms := esQuery{"terms": esQuery{"field": path + keyword, "size": limit + 1}}
+	if splitPath, ok := HistogramFields[splitBy]; ok {
+		terms["aggregations"] = map[string]esQuery{
+			"values": {"terms": esQuery{"field": splitPath + keyword, "size": MaxHistogramValues}},
+		}
+	}
+	search.Aggregations = map[string]esQuery{"top": terms}
+	return search, nil
+}
+
+// esSearchResult is the response to a _search request.
+type esSearchResult struct {
+	Hits struct {
+		Total esTotal `json:"total"`
+		Hits  []esHit `json:"hits"`
+	} `json:"hits"`
+	Aggregations map[string]esTermsAggregation `json:"aggregations"`
+}
+
+type esHit struct {
+	Index  string          `json:"_index"`
+	ID     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+	Sort   []interface{}   `json:"sort"`
+}
+
+// esTermsAggregation is the result of a terms or date_histogram aggregation. The keys of
+//  a date_histogram are the start times of its buckets in milliseconds since the epoch.
+type esTermsAggregation struct {
+	Buckets []struct {
+		Key      interface{} `json:"key"`
+		DocCount int         `json:"doc_count"`
+		// The terms aggregation of histogramSearch or topSearch within the bucket, if any
+		Values *esTermsAggregation `json:"values"`
+	} `json:"buckets"`
+}
+
+// esTotal is the total number of hits, which is a number up to ElasticSearch 6, and an
+//  object with the number in "value" since ElasticSearch 7.
+type esTotal int
+
+func (t *esTotal) UnmarshalJSON(buf []byte) error {
+	var number int
+	if json.Unmarshal(buf, &number) == nil {
+		*t = esTotal(number)
+		return nil
+	}
+	var object struct {
+		Value    *int   `json:"value"`
+		Relation string `json:"relation"`
+	}
+	err := json.Unmarshal(buf, &object)
+	if err != nil || object.Value == nil {
+		return errors.New("cannot parse the total number of hits")
+	}
+	*t = esTotal(*object.Value)
+	return nil
+}
+
+// esBulkResult is the response to a _bulk request.
+type esBulkResult struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
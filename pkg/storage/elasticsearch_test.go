@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordedRequest is a request received by the recordedElasticSearch.
+type recordedRequest struct {
+	method, path string
+	body         []byte
+}
+
+// recordedElasticSearch answers requests with the responses that were recorded from
+// a cluster of the given version in fixtures/<version>/.
+type recordedElasticSearch struct {
+	version  string
+	requests []recordedRequest
+}
+
+func (f *recordedElasticSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.requests = append(f.requests, recordedRequest{r.Method, r.URL.Path, body})
+
+	var fixture string
+	switch {
+	case r.URL.Path == "/":
+		fixture = "root.json"
+	case r.URL.Path == "/_bulk":
+		fixture = "bulk.json"
+	case strings.Contains(r.URL.Path, "/_mapping/field/"):
+		fixture = "mapping.json"
+	case strings.HasPrefix(r.URL.Path, "/_template/"), strings.HasPrefix(r.URL.Path, "/_index_template/"):
+		fmt.Fprint(w, `{"acknowledged": true}`)
+		return
+	case strings.HasSuffix(r.URL.Path, "/_search") && bytes.Contains(body, []byte(`"aggregations"`)):
+		fixture = "search-attributes.json"
+	case strings.HasSuffix(r.URL.Path, "/_search"):
+		fixture = "search.json"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	buf, err := ioutil.ReadFile("fixtures/" + f.version + "/" + fixture)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// lastRequest returns the last request whose path has the given suffix, with the JSON body decoded.
+func (f *recordedElasticSearch) lastRequest(t *testing.T, pathSuffix string) (string, map[string]interface{}) {
+	for i := len(f.requests) - 1; i >= 0; i-- {
+		r := f.requests[i]
+		if strings.HasSuffix(r.path, pathSuffix) {
+			var body map[string]interface{}
+			if len(r.body) > 0 && r.path != "/_bulk" {
+				require.Nil(t, json.Unmarshal(r.body, &body))
+			}
+			return r.path, body
+		}
+	}
+	t.Fatalf("no request to %s", pathSuffix)
+	return "", nil
+}
+
+func elasticSearchWithRecording(t *testing.T, version string) (ElasticSearch, *recordedElasticSearch, func()) {
+	f := &recordedElasticSearch{version: version}
+	server := httptest.NewServer(f)
+	es, err := NewElasticSearch(ElasticSearchConfig{URLs: []string{server.URL}})
+	require.Nil(t, err)
+	return es, f, server.Close
+}
+
+var recordedVersions = []struct {
+	fixtures string
+	version  string
+	// mapping type of the documents, or "" if there are none
+	docType string
+	// where the index template is installed, and where the mappings are in it
+	templatePath, patternKey, mappingsPath string
+}{
+	{"elasticsearch-5.6", "ElasticSearch 5.6", "event", "/_template/hermes-audit", "template", "mappings._default_"},
+	{"elasticsearch-6.8", "ElasticSearch 6.8", "event", "/_template/hermes-audit", "index_patterns", "mappings.event"},
+	{"elasticsearch-7.17", "ElasticSearch 7.17", "", "/_index_template/hermes-audit", "index_patterns", "template.mappings"},
+	{"elasticsearch-8.11", "ElasticSearch 8.11", "", "/_index_template/hermes-audit", "index_patterns", "template.mappings"},
+	{"opensearch-2.11", "OpenSearch 2.11", "", "/_index_template/hermes-audit", "index_patterns", "template.mappings"},
+}
+
+// jsonPath returns the value at a dot-separated path in decoded JSON.
+func jsonPath(value interface{}, path string) interface{} {
+	for _, key := range strings.Split(path, ".") {
+		object, _ := value.(map[string]interface{})
+		value = object[key]
+	}
+	return value
+}
+
+func Test_ElasticSearch_Versions(t *testing.T) {
+	for _, v := range recordedVersions {
+		t.Run(v.fixtures, func(t *testing.T) {
+			es, f, closeServer := elasticSearchWithRecording(t, v.fixtures)
+			defer closeServer()
+
+			// The template is adapted to the version
+			require.Nil(t, es.EnsureSchema())
+			client, err := es.client(context.Background())
+			require.Nil(t, err)
+			assert.Equal(t, v.version, client.version.String())
+			path, template := f.lastRequest(t, "/hermes-audit")
+			assert.Equal(t, v.templatePath, path)
+			pattern := jsonPath(template, v.patternKey)
+			if v.patternKey == "index_patterns" {
+				assert.Equal(t, []interface{}{"audit-*"}, pattern)
+			} else {
+				assert.Equal(t, "audit-*", pattern)
+			}
+			mappings := jsonPath(template, v.mappingsPath)
+			assert.Equal(t, "date", jsonPath(mappings, "properties.payload.properties.eventTime.type"))
+			buf, _ := json.Marshal(mappings)
+			assert.Contains(t, string(buf), `"raw":{"ignore_above":256,"type":"keyword"}`)
+
+			checkRecordedWrite(t, es, f, v.docType)
+			checkRecordedSearch(t, es, f, v.docType == "", ".raw")
+		})
+	}
+}
+
+// Indices that were created without the index template, e.g. by Logstash, have the
+// keyword subfields of the dynamic mapping.
+func Test_ElasticSearch_DynamicMapping(t *testing.T) {
+	for _, fixtures := range []string{"elasticsearch-7.17-dynamic", "elasticsearch-8.11-dynamic"} {
+		t.Run(fixtures, func(t *testing.T) {
+			es, f, closeServer := elasticSearchWithRecording(t, fixtures)
+			defer closeServer()
+			checkRecordedSearch(t, es, f, true, ".keyword")
+
+			// The mapping is only read once
+			var mappingRequests int
+			for _, r := range f.requests {
+				if strings.Contains(r.path, "/_mapping/field/") {
+					mappingRequests++
+					assert.Equal(t, "/audit-*/_mapping/field/message_id.raw,message_id.keyword", r.path)
+				}
+			}
+			assert.Equal(t, 1, mappingRequests)
+		})
+	}
+}
+
+func checkRecordedWrite(t *testing.T, es ElasticSearch, f *recordedElasticSearch, docType string) {
+	err := es.WriteEvents([]TenantEvent{
+		{TenantID: "tenant1", Event: testEvent("a", "identity.project.deleted", "data/security/project", "12:00:00")},
+		{TenantID: "tenant1", Event: testEvent("b", "identity.project.deleted", "data/security/project", "12:00:00")},
+		{TenantID: "tenant2", Event: testEvent("c", "identity.project.deleted", "data/security/project", "12:00:00")},
+	})
+
+	// Each event is indexed with its CADF event ID into the daily index of its tenant
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(f.requests[len(f.requests)-1].body))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.Equal(t, 6, len(lines))
+	action := lines[0]["index"].(map[string]interface{})
+	assert.Equal(t, "audit-tenant1-2017.05.02", action["_index"])
+	assert.Equal(t, "a", action["_id"])
+	if docType == "" {
+		assert.NotContains(t, action, "_type")
+	} else {
+		assert.Equal(t, docType, action["_type"])
+	}
+	assert.Equal(t, "2017-05-02T12:00:00Z", lines[1]["@timestamp"])
+	assert.Equal(t, "identity.project.deleted", lines[1]["event_type"])
+	assert.Equal(t, "audit-tenant2-2017.05.02", lines[4]["index"].(map[string]interface{})["_index"])
+
+	// Failed items are reported individually
+	require.IsType(t, BulkError{}, err)
+	bulkErr := err.(BulkError)
+	assert.Equal(t, 3, bulkErr.Total)
+	require.Equal(t, 2, len(bulkErr.Items))
+	assert.False(t, bulkErr.Items[1].Retryable())
+	assert.Equal(t, "mapper_parsing_exception: failed to parse [payload.eventTime]", bulkErr.Items[1].Reason)
+	assert.True(t, bulkErr.Items[2].Retryable())
+}
+
+func checkRecordedSearch(t *testing.T, es ElasticSearch, f *recordedElasticSearch, trackTotalHits bool, keyword string) {
+	page, err := es.GetEvents(&Filter{Limit: 3, Source: Values("identity"), Time: map[string]string{"gte": "2017-05-02", "lt": "2017-05-04"}}, "tenant1")
+	require.Nil(t, err)
+	assert.Equal(t, 42, page.Total)
+	assert.Equal(t, []string{"c", "a", "b"}, eventIds(page))
+	require.NotNil(t, page.Next)
+	assert.Equal(t, uint(3), page.Next.Offset)
+	assert.Equal(t, []interface{}{float64(1493722800000), "msg-b"}, page.Next.SortValues)
+
+	path, search := f.lastRequest(t, "/_search")
+	// Only the daily indices in the time range are searched
+	assert.Equal(t, "/audit-tenant1-2017.05.01*,audit-tenant1-2017.05.02*,audit-tenant1-2017.05.03*,audit-tenant1-2017.05.04*/_search", path)
+	assert.Equal(t, float64(3), search["size"])
+	filters := jsonPath(search, "query.bool.filter").([]interface{})
+	require.Equal(t, 3, len(filters))
+	assert.Equal(t, "identity", jsonPath(filters[0], "match_phrase_prefix.event_type.query"))
+	assert.Equal(t, map[string]interface{}{"lt": "2017-05-04"}, jsonPath(filters[1], "range").(map[string]interface{})["payload.eventTime"])
+	assert.Equal(t, map[string]interface{}{"gte": "2017-05-02"}, jsonPath(filters[2], "range").(map[string]interface{})["payload.eventTime"])
+	if trackTotalHits {
+		assert.Equal(t, true, search["track_total_hits"])
+	} else {
+		assert.NotContains(t, search, "track_total_hits")
+	}
+	sort := search["sort"].([]interface{})
+	require.Equal(t, 2, len(sort))
+	assert.Contains(t, sort[1], "message_id"+keyword)
+
+	// The next page continues after the sort values of the last event
+	_, err = es.GetEvents(&Filter{Limit: 3, Cursor: page.Next}, "tenant1")
+	require.Nil(t, err)
+	_, search = f.lastRequest(t, "/_search")
+	assert.Equal(t, []interface{}{float64(1493722800000), "msg-b"}, search["search_after"])
+	assert.NotContains(t, search, "from")
+
+	event, err := es.GetEvent("msg-c", "tenant1")
+	require.Nil(t, err)
+	require.NotNil(t, event)
+	assert.Equal(t, "compute.instance.create.end", event.EventType)
+	_, search = f.lastRequest(t, "/_search")
+	assert.Equal(t, "msg-c", jsonPath(search, "query.term").(map[string]interface{})["message_id"+keyword])
+
+	sources, err := es.GetAttributes(&Filter{}, "", "source", 10)
+	require.Nil(t, err)
+	assert.Equal(t, AttributeValueList{{"identity", 32}, {"compute", 10}}, sources)
+	path, search = f.lastRequest(t, "/_search")
+	assert.Equal(t, "/audit-*/_search", path)
+	assert.Equal(t, "event_type"+keyword, jsonPath(search, "aggregations.attributes.terms.field"))
+	assert.Equal(t, float64(MaxAttributeLimit), jsonPath(search, "aggregations.attributes.terms.size"))
+	assert.Equal(t, float64(0), search["size"])
+}
+
+func Test_ElasticSearch_UnsupportedVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version": {"number": "2.4.6"}}`)
+	}))
+	defer server.Close()
+	es, err := NewElasticSearch(ElasticSearchConfig{URLs: []string{server.URL}})
+	require.Nil(t, err)
+	err = es.EnsureSchema()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "ElasticSearch 2.4 is not supported")
+}
+
+func Test_ElasticSearch_Config(t *testing.T) {
+	invalid := []ElasticSearchConfig{
+		{},
+		{URLs: []string{"localhost:9200"}},
+		{URLs: []string{"http://localhost:9200"}, Username: "hermes", APIKey: "id:key"},
+		{URLs: []string{"http://localhost:9200"}, CACertFile: "does-not-exist.pem"},
+		{URLs: []string{"http://localhost:9200"}, ClientCertFile: "cert.pem"},
+	}
+	for _, config := range invalid {
+		_, err := NewElasticSearch(config)
+		assert.NotNil(t, err, fmt.Sprintf("%+v", config))
+	}
+}
+
+func Test_ElasticSearch_Auth(t *testing.T) {
+	var authorization []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"version": {"number": "7.17.9"}, "acknowledged": true}`)
+	}))
+	defer server.Close()
+
+	configs := []ElasticSearchConfig{
+		{URLs: []string{server.URL}, APIKey: "id:key"},
+		{URLs: []string{server.URL}, APIKey: "aWQ6a2V5"},
+		{URLs: []string{server.URL}, Username: "hermes", Password: "secret"},
+	}
+	for _, config := range configs {
+		es, err := NewElasticSearch(config)
+		require.Nil(t, err)
+		require.Nil(t, es.EnsureSchema())
+	}
+	// each client probes the version, then installs the template
+	assert.Equal(t, []string{
+		"ApiKey aWQ6a2V5", "ApiKey aWQ6a2V5",
+		"ApiKey aWQ6a2V5", "ApiKey aWQ6a2V5",
+		"Basic aGVybWVzOnNlY3JldA==", "Basic aGVybWVzOnNlY3JldA==",
+	}, authorization)
+}
+
+func Test_ElasticSearch_Unavailable(t *testing.T) {
+	// Nothing listens on this port, so the requests fail instead of crashing the process
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	es, err := NewElasticSearch(ElasticSearchConfig{
+		URLs:                []string{server.URL},
+		HealthcheckInterval: time.Minute,
+		MaxRetries:          2,
+		RetryInitialBackoff: time.Millisecond,
+		RetryMaxBackoff:     time.Millisecond,
+	})
+	require.Nil(t, err)
+	_, err = es.GetEvents(&Filter{Limit: 10}, "tenant1")
+	assert.NotNil(t, err)
+	_, err = es.GetAttributes(&Filter{}, "tenant1", "source", 10)
+	assert.NotNil(t, err)
+
+	_, err = ElasticSearch{}.GetEvent("msg-a", "tenant1")
+	assert.NotNil(t, err)
+}
+
+func Test_ElasticSearch_Failover(t *testing.T) {
+	var requests int
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"version": {"number": "8.11.1"}, "acknowledged": true}`)
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	es, err := NewElasticSearch(ElasticSearchConfig{
+		URLs:                []string{down.URL, up.URL},
+		HealthcheckInterval: time.Minute,
+		MaxRetries:          1,
+	})
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, es.EnsureSchema())
+	}
+	// After the first failure, the node that is down is skipped
+	assert.Equal(t, 4, requests)
+}
+
+func Test_ElasticSearch_Sniff(t *testing.T) {
+	var discovered []string
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		discovered = append(discovered, r.URL.Path)
+		fmt.Fprint(w, `{"acknowledged": true}`)
+	}))
+	defer node.Close()
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `{"version": {"number": "7.17.15"}}`)
+		case "/_nodes/http":
+			fmt.Fprintf(w, `{"nodes": {"n1": {"http": {"publish_address": "es-1.example.com/%s"}}}}`, strings.TrimPrefix(node.URL, "http://"))
+		default:
+			t.Errorf("unexpected request to the seed node: %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer seed.Close()
+
+	es, err := NewElasticSearch(ElasticSearchConfig{URLs: []string{seed.URL}, Sniff: true})
+	require.Nil(t, err)
+	require.Nil(t, es.EnsureSchema())
+	assert.Equal(t, []string{"/_index_template/hermes-audit"}, discovered)
+}
+
+func Test_ElasticSearch_Backoff(t *testing.T) {
+	config := ElasticSearchConfig{MaxRetries: 3, RetryInitialBackoff: 100 * time.Millisecond, RetryMaxBackoff: 250 * time.Millisecond}
+	var waits []time.Duration
+	for retry := 1; ; retry++ {
+		wait, ok := config.backoff(retry)
+		if !ok {
+			break
+		}
+		waits = append(waits, wait)
+	}
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond}, waits)
+}
+
+func Test_ElasticSearch_Total(t *testing.T) {
+	var result esSearchResult
+	require.Nil(t, json.Unmarshal([]byte(`{"hits": {"total": 12, "hits": []}}`), &result))
+	assert.Equal(t, esTotal(12), result.Hits.Total)
+	require.Nil(t, json.Unmarshal([]byte(`{"hits": {"total": {"value": 10000, "relation": "gte"}, "hits": []}}`), &result))
+	assert.Equal(t, esTotal(10000), result.Hits.Total)
+	assert.NotNil(t, json.Unmarshal([]byte(`{"hits": {"total": "many"}}`), &result))
+}
@@ -0,0 +1,11 @@
+package storage
+
+// ResetPostgres drops the events table, including all partitions, and creates it again.
+func ResetPostgres(p *Postgres) error {
+	_, err := p.db.Exec(`DROP TABLE events CASCADE`)
+	if err != nil {
+		return err
+	}
+	p.dialect = newPostgresDialect()
+	return p.EnsureSchema()
+}
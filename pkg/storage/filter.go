@@ -0,0 +1,103 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import "strings"
+
+// ValueFilter selects events by the value of a field of the Filter: the value must match
+//  any of the Include values, if there are any, and none of the Exclude values. How a
+//  value matches depends on the field (see filterFields), except that values containing
+//  "*" are patterns for the whole value, in which "*" stands for any sequence of characters.
+type ValueFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Values returns a ValueFilter that includes the given values.
+func Values(values ...string) ValueFilter {
+	return ValueFilter{Include: values}
+}
+
+// IsEmpty returns whether the ValueFilter matches all events.
+func (v ValueFilter) IsEmpty() bool {
+	return len(v.Include) == 0 && len(v.Exclude) == 0
+}
+
+// isWildcard returns whether a value of a ValueFilter is a pattern.
+func isWildcard(value string) bool {
+	return strings.Contains(value, "*")
+}
+
+// How the values of a ValueFilter match the field
+type valueMatch int
+
+const (
+	// The value is equal to the field
+	valueExact valueMatch = iota
+	// The value is a prefix of the field, respecting case
+	valuePrefix
+	// The terms of the value appear in the field, the last one as prefix (see matchPhrasePrefix)
+	valuePhrasePrefix
+	// The field is an IP address that the value matches, see addressMatch
+	valueAddress
+)
+
+// filterField describes one of the ValueFilters of Filter.
+type filterField struct {
+	// path of the field in the event
+	path   string
+	match  valueMatch
+	values func(f *Filter) ValueFilter
+}
+
+// The ValueFilters of Filter, in the order in which the drivers apply them
+var filterFields = []filterField{
+	{"event_type", valuePhrasePrefix, func(f *Filter) ValueFilter { return f.Source }},
+	{"payload.target.typeURI", valuePhrasePrefix, func(f *Filter) ValueFilter { return f.ResourceType }},
+	{"payload.target.id", valueExact, func(f *Filter) ValueFilter { return f.ResourceId }},
+	{"payload.initiator.user_id", valuePrefix, func(f *Filter) ValueFilter { return f.UserId }},
+	{"event_type", valuePhrasePrefix, func(f *Filter) ValueFilter { return f.EventType }},
+	{"payload.outcome", valueExact, func(f *Filter) ValueFilter { return f.Outcome }},
+	{"payload.action", valueExact, func(f *Filter) ValueFilter { return f.Action }},
+	{"payload.initiator.project_id", valueExact, func(f *Filter) ValueFilter { return f.InitiatorProjectId }},
+	{"payload.initiator.domain_id", valueExact, func(f *Filter) ValueFilter { return f.InitiatorDomainId }},
+	{"payload.observer.id", valueExact, func(f *Filter) ValueFilter { return f.ObserverId }},
+	{"payload.observer.typeURI", valuePhrasePrefix, func(f *Filter) ValueFilter { return f.ObserverType }},
+	{"payload.initiator.host.address", valueAddress, func(f *Filter) ValueFilter { return f.InitiatorAddress }},
+}
+
+// checkValues returns an InvalidFilterError if a ValueFilter of the filter has a value that
+//  cannot be matched.
+func (f *Filter) checkValues() error {
+	for _, field := range filterFields {
+		if field.match != valueAddress {
+			continue
+		}
+		v := field.values(f)
+		for _, value := range append(append([]string{}, v.Include...), v.Exclude...) {
+			if !isWildcard(value) {
+				if _, _, err := addressMatch(value); err != nil {
+					return InvalidFilterError{"initiator_address: " + err.Error()}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -19,15 +19,98 @@
 
 package storage
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
 // Storage is an interface that wraps the underlying event storage mechanism.
 // Because it is an interface, the real implementation can be mocked away in unit tests.
 type Storage interface {
 
 	/********** requests to ElasticSearch **********/
-	GetEvents(filter *Filter, tenantId string) ([]*EventDetail, int, error)
+	GetEvents(filter *Filter, tenantId string) (*EventPage, error)
 	GetEvent(eventId string, tenantId string) (*EventDetail, error)
-	GetAttributes(queryName string, tenantId string) ([]string, error)
+	// GetAttributes returns the most frequent values of one of the AttributeFields among
+	// the events matching the filter, at most limit (up to MaxAttributeLimit) of them.
+	GetAttributes(filter *Filter, tenantId string, attribute string, limit uint) (AttributeValueList, error)
+	// GetHistogram counts the events matching the filter in buckets of the given interval,
+	// and if splitBy is one of the HistogramFields, also by the value of that field.
+	GetHistogram(filter *Filter, tenantId string, interval time.Duration, splitBy string) ([]HistogramBucket, error)
+	// GetTop ranks the values of one of the TopFields among the events matching the filter
+	// by the number of events that have them, at most limit (up to MaxTopLimit) of them.
+	// If splitBy is one of the HistogramFields, the events are also counted by that field.
+	GetTop(filter *Filter, tenantId string, field string, limit uint, splitBy string) ([]TopValue, error)
 	MaxLimit() uint
+
+	/********** writes to ElasticSearch **********/
+	// WriteEvents stores the events. An event that is stored already (as identified by its
+	// CADF event ID) is replaced, so events can safely be written again after a failure.
+	// If only some of the events could not be written, the error is a BulkError.
+	WriteEvents(events []TenantEvent) error
+	// EnsureSchema creates or updates the index templates and mappings that the queries depend on.
+	EnsureSchema() error
+}
+
+// BulkError is returned by WriteEvents if some of the events could not be written.
+type BulkError struct {
+	// Errors of the failed events, by the position of the event in the WriteEvents argument
+	Items map[int]ItemError
+	// Number of events in the WriteEvents argument
+	Total int
+}
+
+func (e BulkError) Error() string {
+	if len(e.Items) == 0 {
+		return fmt.Sprintf("all %d events were written", e.Total)
+	}
+	first := -1
+	for i := range e.Items {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	return fmt.Sprintf("%d of %d events could not be written, first error: %s",
+		len(e.Items), e.Total, e.Items[first].Error())
+}
+
+// InvalidFilterError is returned by the search methods if the Filter has a value that
+// cannot be matched, which is an error of the request rather than of the storage.
+type InvalidFilterError struct {
+	Message string
+}
+
+func (e InvalidFilterError) Error() string {
+	return e.Message
+}
+
+// ItemError describes why a single event could not be written.
+type ItemError struct {
+	// HTTP status code: 4xx if the event was rejected, 5xx if the storage failed
+	Status int
+	Reason string
+}
+
+func (e ItemError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.Status, e.Reason)
+}
+
+// Retryable returns whether writing the event again might succeed. Rejected events
+//  will be rejected again, except when the storage rejects them because it is overloaded.
+func (e ItemError) Retryable() bool {
+	return e.Status == 429 || e.Status >= 500
+}
+
+// TenantEvent is an event together with the tenant (project or domain) that it belongs to,
+//  which determines where it is stored.
+type TenantEvent struct {
+	TenantID string
+	Event    *EventDetail
+	// Domain of the tenant, i.e. the tenant itself if it is a domain, or empty if unknown.
+	//  This is not necessarily the domain of the initiator, e.g. of users in other domains.
+	DomainID string
 }
 
 // FieldOrder maps the sort Fieldname and Order
@@ -38,25 +121,181 @@ type FieldOrder struct {
 
 // This Filter is similar to hermes.Filter, but using IDs instead of names
 type Filter struct {
-	Source       string
-	ResourceType string
-	ResourceId   string
-	UserId       string
-	EventType    string
-	Time         map[string]string
-	Offset       uint
-	Limit        uint
-	Sort         []FieldOrder
+	Source       ValueFilter
+	ResourceType ValueFilter
+	ResourceId   ValueFilter
+	UserId       ValueFilter
+	EventType    ValueFilter
+	Outcome      ValueFilter
+	Action       ValueFilter
+	// Project or domain of the initiator, which can differ from the tenant that the event belongs to
+	InitiatorProjectId ValueFilter
+	InitiatorDomainId  ValueFilter
+	ObserverId         ValueFilter
+	ObserverType       ValueFilter
+	// IP addresses or IPv4 CIDR ranges of the initiator's host. Other values are rejected
+	// with an InvalidFilterError, unless they contain wildcards.
+	InitiatorAddress ValueFilter
+	Time             map[string]string
+	Offset           uint
+	Limit            uint
+	Sort             []FieldOrder
+	// If Cursor is set, the events following the cursor position are returned, and Offset is ignored
+	Cursor *Cursor
+	// Further tenants whose events are returned together with those of the requested tenant,
+	//  e.g. the projects of a domain
+	IncludeTenants []string
+	// Further condition that the events must match, or nil
+	Query Query
+	// Attributes (see AttributeFields) whose values are counted among all matching events
+	//  like by GetAttributes, with at most FacetLimit values each, see EventPage.Facets
+	Facets     []string
+	FacetLimit uint
 }
 
-// Thanks to the tool at https://mholt.github.io/json-to-go/
+// checkFacets returns an error if a facet of the filter is not one of the AttributeFields,
+//  or if the FacetLimit is out of range.
+func (f *Filter) checkFacets() error {
+	for _, facet := range f.Facets {
+		if _, err := attributePath(facet, f.FacetLimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenants returns the tenants whose events are requested, or nil for all tenants.
+func (f *Filter) tenants(tenantId string) []string {
+	if tenantId == "" {
+		return nil
+	}
+	return append([]string{tenantId}, f.IncludeTenants...)
+}
+
+// Cursor marks a position in a sorted list of events, namely the position after a given event.
+//  It allows paging beyond MaxLimit(), because only the sort values of that event are needed to find
+//  the next page (ElasticSearch's search_after), instead of counting through all preceding events.
+type Cursor struct {
+	// Number of events preceding the cursor position
+	Offset uint `json:"offset"`
+	// Sort values of the last event preceding the cursor position, in the order of the search's sort fields
+	SortValues []interface{} `json:"after"`
+}
+
+// EventPage is the result of GetEvents
+type EventPage struct {
+	Events []*EventDetail
+	// Total number of events matching the filter, not only the ones on this page
+	Total int
+	// Position after the last event on this page, or nil if there are no more events
+	Next *Cursor
+	// Most frequent values of the Filter.Facets among all matching events, by attribute
+	Facets map[string]AttributeValueList
+}
 
-//  The JSON annotations are for parsing the result from ElasticSearch
-type eventListWithTotal struct {
-	Total  int           `json:"total"`
-	Events []EventDetail `json:"events"`
+// HistogramBucket is a time interval of the result of GetHistogram. The buckets start at
+//  multiples of the interval since the epoch (in UTC), and only buckets that contain events
+//  are returned, in ascending order.
+type HistogramBucket struct {
+	Time  time.Time
+	Count int
+	// Number of events by the value of the field that the histogram is split by, where
+	//  events without that field are only counted in Count. Only the MaxHistogramValues
+	//  most frequent values of each bucket are included.
+	Counts map[string]int
 }
 
+// MaxHistogramValues is the number of values by which the buckets of a histogram are
+//  split at most. It keeps the number of buckets that ElasticSearch computes low.
+const MaxHistogramValues = 100
+
+// checkInterval returns an error if the interval of GetHistogram is not a positive number of milliseconds.
+func checkInterval(interval time.Duration) error {
+	if interval < time.Millisecond || interval%time.Millisecond != 0 {
+		return fmt.Errorf("invalid histogram interval %s", interval)
+	}
+	return nil
+}
+
+// limitCounts reduces the counts of a HistogramBucket to the MaxHistogramValues most
+//  frequent values, preferring the smaller value among equal counts like ElasticSearch does.
+func limitCounts(counts map[string]int) {
+	if len(counts) <= MaxHistogramValues {
+		return
+	}
+	values := make([]string, 0, len(counts))
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	for _, value := range values[MaxHistogramValues:] {
+		delete(counts, value)
+	}
+}
+
+// HistogramFields maps the fields that histograms can be split by onto their paths in the event.
+var HistogramFields = map[string]string{
+	"event_type": "event_type",
+	"outcome":    "payload.outcome",
+}
+
+// TopValue is a value of a field as ranked by GetTop, most frequent first and, among
+//  equal counts, ordered by value.
+type TopValue struct {
+	Value string
+	Count int
+	// Number of events by the value of the field that GetTop splits by, like HistogramBucket.Counts
+	Counts map[string]int
+}
+
+// TopFields maps the fields by which GetTop ranks values onto their paths in the event.
+var TopFields = map[string]string{
+	"initiator.user_id":      "payload.initiator.user_id",
+	"action":                 "payload.action",
+	"target.id":              "payload.target.id",
+	"initiator.host.address": "payload.initiator.host.address",
+}
+
+// MaxTopLimit is the maximum number of values that GetTop returns.
+const MaxTopLimit = 100
+
+// topPath returns the path of a field in the event, or an error if it is not one of the
+//  TopFields, or if the limit of GetTop is out of range.
+func topPath(field string, limit uint) (string, error) {
+	path, ok := TopFields[field]
+	if !ok {
+		return "", fmt.Errorf("invalid field name \"%s\"", field)
+	}
+	if limit == 0 || limit > MaxTopLimit {
+		return "", fmt.Errorf("limit %d is not between 1 and %d", limit, MaxTopLimit)
+	}
+	return path, nil
+}
+
+// sortTopValues orders the values of GetTop and keeps the limit first of them.
+func sortTopValues(values []TopValue, limit uint) []TopValue {
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+	if uint(len(values)) > limit {
+		values = values[:limit]
+	}
+	for _, value := range values {
+		limitCounts(value.Counts)
+	}
+	return values
+}
+
+// Thanks to the tool at https://mholt.github.io/json-to-go/
+
 // EventDetail contains the CADF payload, enhanced with names for IDs
 //  The JSON annotations are for parsing the result from ElasticSearch AND for generating the Hermes API response
 type EventDetail struct {
@@ -105,11 +344,93 @@ type EventDetail struct {
 	MessageID string `json:"message_id"`
 	Priority  string `json:"priority"`
 	Timestamp string `json:"timestamp"`
+	// Tenant that the event belongs to, which the storage drivers fill in. It is not part of
+	//  the event itself.
+	TenantID string `json:"-"`
 }
 
+// AttributeValueList is the result of GetAttributes, ordered by descending count and then by value
 type AttributeValueList []AttributeValue
 
+// AttributeValue is a value of an attribute, with the number of events that have it
 type AttributeValue struct {
 	Value string `json:"value"`
-	count int64  `json:"count"` // Removing export due to desire to not include it in JSON return
+	Count int64  `json:"count"`
+}
+
+// AttributeFields maps the attributes of GetAttributes onto their paths in the event: the
+//  names of the API's filter parameters, and the QueryFields except for the unique event ID.
+//  The values of "source" are the first part of the event type, and "resource_name" is
+//  the target ID, since names are looked up in Keystone.
+var AttributeFields = map[string]string{
+	"source":                 "event_type",
+	"resource_type":          "payload.target.typeURI",
+	"resource_name":          "payload.target.id",
+	"resource_id":            "payload.target.id",
+	"event_type":             "event_type",
+	"outcome":                "payload.outcome",
+	"action":                 "payload.action",
+	"initiator_project_id":   "payload.initiator.project_id",
+	"initiator_domain_id":    "payload.initiator.domain_id",
+	"initiator_address":      "payload.initiator.host.address",
+	"observer_id":            "payload.observer.id",
+	"observer_type":          "payload.observer.typeURI",
+	"publisher_id":           "publisher_id",
+	"initiator.id":           "payload.initiator.id",
+	"initiator.typeURI":      "payload.initiator.typeURI",
+	"initiator.user_id":      "payload.initiator.user_id",
+	"initiator.project_id":   "payload.initiator.project_id",
+	"initiator.domain_id":    "payload.initiator.domain_id",
+	"initiator.host.address": "payload.initiator.host.address",
+	"initiator.host.agent":   "payload.initiator.host.agent",
+	"target.id":              "payload.target.id",
+	"target.typeURI":         "payload.target.typeURI",
+	"target.name":            "payload.target.name",
+	"observer.id":            "payload.observer.id",
+	"observer.typeURI":       "payload.observer.typeURI",
+}
+
+// MaxAttributeLimit is the maximum number of values that GetAttributes returns.
+const MaxAttributeLimit = 1000
+
+// attributePath returns the path of an attribute in the event, or an error if it is not
+//  one of the AttributeFields, or if the limit of GetAttributes is out of range.
+func attributePath(attribute string, limit uint) (string, error) {
+	path, ok := AttributeFields[attribute]
+	if !ok {
+		return "", fmt.Errorf("invalid attribute name \"%s\"", attribute)
+	}
+	if limit == 0 || limit > MaxAttributeLimit {
+		return "", fmt.Errorf("limit %d is not between 1 and %d", limit, MaxAttributeLimit)
+	}
+	return path, nil
+}
+
+// attributeValues returns the limit most frequent values of an attribute, given the
+//  number of events by the value of its field. Values of "source" are derived from
+//  the event types, whose counts are added up.
+func attributeValues(attribute string, counts map[string]int64, limit uint) AttributeValueList {
+	merged := make(map[string]int64, len(counts))
+	for value, count := range counts {
+		if attribute == "source" {
+			value = strings.SplitN(value, ".", 2)[0]
+		}
+		if value != "" {
+			merged[value] += count
+		}
+	}
+	values := AttributeValueList{}
+	for value, count := range merged {
+		values = append(values, AttributeValue{Value: value, Count: count})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+	if uint(len(values)) > limit {
+		values = values[:limit]
+	}
+	return values
 }
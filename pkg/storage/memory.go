@@ -0,0 +1,672 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Memory is a storage driver that keeps events in memory. It applies filters,
+// sorting and paging the way the ElasticSearch driver does, so it can stand in
+// for ElasticSearch in tests and local development. The events either come
+// from a fixture file (see NewMemoryFromFile), or are written to it.
+type Memory struct {
+	mutex *sync.RWMutex
+	// by CADF event ID
+	events map[string]memoryEvent
+}
+
+// memoryEvent is a stored event, together with its generic JSON form (see eventObject),
+// in which the filters and aggregations look up fields by their path.
+type memoryEvent struct {
+	TenantEvent
+	object interface{}
+}
+
+// NewMemory returns an empty Memory storage.
+func NewMemory() Memory {
+	return Memory{mutex: &sync.RWMutex{}, events: make(map[string]memoryEvent)}
+}
+
+// NewMemoryFromFile returns a Memory storage containing the events from the given
+// fixture file (see Load).
+func NewMemoryFromFile(path string) (Memory, error) {
+	m := NewMemory()
+	f, err := os.Open(path)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	err = m.Load(f)
+	if err != nil {
+		return m, fmt.Errorf("cannot load events from %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// fixtureEvent is an event in a fixture file. The tenant is optional.
+type fixtureEvent struct {
+	TenantID string `json:"tenant_id"`
+	EventDetail
+}
+
+// Load adds the events from a fixture (see ReadFixture) to the storage. Unlike
+// WriteEvents, it also accepts events without a valid time.
+func (m Memory) Load(r io.Reader) error {
+	events, err := ReadFixture(r)
+	if err != nil {
+		return err
+	}
+	return m.write(events, false)
+}
+
+// ReadFixture reads the events from a fixture. The fixture is either a JSON array
+// of events, an object with the events in its "events" field, or a sequence of
+// events (e.g. NDJSON, one event per line). Events without a "tenant_id" field
+// belong to the project or domain of their initiator, like events ingested from
+// RabbitMQ.
+func ReadFixture(r io.Reader) ([]TenantEvent, error) {
+	var events []TenantEvent
+	decoder := json.NewDecoder(r)
+	for {
+		var value json.RawMessage
+		err := decoder.Decode(&value)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var fixtures []fixtureEvent
+		var wrapped struct {
+			Events *[]fixtureEvent `json:"events"`
+		}
+		switch {
+		case strings.HasPrefix(string(value), "["):
+			err = json.Unmarshal(value, &fixtures)
+		case json.Unmarshal(value, &wrapped) == nil && wrapped.Events != nil:
+			fixtures = *wrapped.Events
+		default:
+			fixtures = make([]fixtureEvent, 1)
+			err = json.Unmarshal(value, &fixtures[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range fixtures {
+			f := &fixtures[i]
+			if f.TenantID == "" {
+				f.TenantID = f.Payload.Initiator.ProjectID
+			}
+			if f.TenantID == "" {
+				f.TenantID = f.Payload.Initiator.DomainID
+			}
+			events = append(events, TenantEvent{TenantID: f.TenantID, Event: &f.EventDetail})
+		}
+	}
+}
+
+// WriteEvents stores copies of the events. Events without a CADF event ID or a valid
+// time are rejected, like in the other drivers.
+func (m Memory) WriteEvents(events []TenantEvent) error {
+	return m.write(events, true)
+}
+
+func (m Memory) write(events []TenantEvent, checkTime bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	bulkErr := BulkError{Items: make(map[int]ItemError), Total: len(events)}
+	for i, te := range events {
+		if te.Event == nil || te.Event.Payload.ID == "" {
+			bulkErr.Items[i] = ItemError{Status: 400, Reason: "event has no CADF event ID"}
+			continue
+		}
+		if _, err := eventTime(te.Event); checkTime && err != nil {
+			bulkErr.Items[i] = ItemError{Status: 400, Reason: err.Error()}
+			continue
+		}
+		event := *te.Event
+		event.TenantID = te.TenantID
+		object, err := eventObject(&event)
+		if err != nil {
+			bulkErr.Items[i] = ItemError{Status: 400, Reason: err.Error()}
+			continue
+		}
+		m.events[event.Payload.ID] = memoryEvent{TenantEvent{TenantID: te.TenantID, Event: &event}, object}
+	}
+	if len(bulkErr.Items) > 0 {
+		return bulkErr
+	}
+	return nil
+}
+
+// EnsureSchema does nothing, since the Memory storage has no schema
+func (m Memory) EnsureSchema() error {
+	return nil
+}
+
+// MaxLimit returns the default of ElasticSearch's max_result_window
+func (m Memory) MaxLimit() uint {
+	return 10000
+}
+
+func (m Memory) GetEvents(filter *Filter, tenantId string) (*EventPage, error) {
+	err := filter.checkFacets()
+	if err != nil {
+		return nil, err
+	}
+	matching, err := m.matchingEvents(filter, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	sortEvents(matching, filter.Sort)
+
+	offset := filter.Offset
+	if filter.Cursor != nil {
+		offset = filter.Cursor.Offset
+	}
+	page := EventPage{Total: len(matching)}
+	if len(filter.Facets) > 0 {
+		page.Facets = make(map[string]AttributeValueList)
+		for _, facet := range filter.Facets {
+			page.Facets[facet], err = countValues(matching, facet, filter.FacetLimit)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i := int(offset); i < len(matching) && len(page.Events) < int(filter.Limit); i++ {
+		event := *matching[i].Event
+		page.Events = append(page.Events, &event)
+	}
+	if len(page.Events) > 0 && int(offset)+len(page.Events) < page.Total {
+		last := page.Events[len(page.Events)-1]
+		page.Next = &Cursor{
+			Offset:     offset + uint(len(page.Events)),
+			SortValues: []interface{}{last.Payload.EventTime, last.MessageID},
+		}
+	}
+	return &page, nil
+}
+
+func (m Memory) GetEvent(eventId string, tenantId string) (*EventDetail, error) {
+	for _, e := range m.tenantEvents(tenantId) {
+		if e.Event.MessageID == eventId {
+			result := *e.Event
+			return &result, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetAttributes counts the values of the attribute among the matching events, like the
+// terms aggregation of ElasticSearch does.
+func (m Memory) GetAttributes(filter *Filter, tenantId string, attribute string, limit uint) (AttributeValueList, error) {
+	_, err := attributePath(attribute, limit)
+	if err != nil {
+		return nil, err
+	}
+	events, err := m.matchingEvents(filter, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	return countValues(events, attribute, limit)
+}
+
+// countValues returns the most frequent values of an attribute among the events.
+func countValues(events []memoryEvent, attribute string, limit uint) (AttributeValueList, error) {
+	path, err := attributePath(attribute, limit)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64)
+	for _, e := range events {
+		counts[pathValue(e.object, path)]++
+	}
+	return attributeValues(attribute, counts, limit), nil
+}
+
+// GetHistogram counts the matching events by time like ElasticSearch's date_histogram
+// aggregation does.
+func (m Memory) GetHistogram(filter *Filter, tenantId string, interval time.Duration, splitBy string) ([]HistogramBucket, error) {
+	err := checkInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+	events, err := m.matchingEvents(filter, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	splitPath, split := HistogramFields[splitBy]
+
+	buckets := make(map[int64]*HistogramBucket)
+	for _, e := range events {
+		t, ok := parseTime(e.Event.Payload.EventTime, eventTimeFormats)
+		if !ok {
+			continue
+		}
+		start := histogramBucketStart(t, interval)
+		bucket, ok := buckets[start.UnixNano()]
+		if !ok {
+			bucket = &HistogramBucket{Time: start}
+			if split {
+				bucket.Counts = make(map[string]int)
+			}
+			buckets[start.UnixNano()] = bucket
+		}
+		bucket.Count++
+		if split {
+			if value := pathValue(e.object, splitPath); value != "" {
+				bucket.Counts[value]++
+			}
+		}
+	}
+
+	result := make([]HistogramBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		limitCounts(bucket.Counts)
+		result = append(result, *bucket)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result, nil
+}
+
+func (m Memory) GetTop(filter *Filter, tenantId string, field string, limit uint, splitBy string) ([]TopValue, error) {
+	path, err := topPath(field, limit)
+	if err != nil {
+		return nil, err
+	}
+	events, err := m.matchingEvents(filter, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	splitPath, split := HistogramFields[splitBy]
+
+	values := make(map[string]*TopValue)
+	for _, e := range events {
+		value := pathValue(e.object, path)
+		if value == "" {
+			continue
+		}
+		topValue, ok := values[value]
+		if !ok {
+			topValue = &TopValue{Value: value}
+			if split {
+				topValue.Counts = make(map[string]int)
+			}
+			values[value] = topValue
+		}
+		topValue.Count++
+		if split {
+			if splitValue := pathValue(e.object, splitPath); splitValue != "" {
+				topValue.Counts[splitValue]++
+			}
+		}
+	}
+
+	result := make([]TopValue, 0, len(values))
+	for _, value := range values {
+		result = append(result, *value)
+	}
+	return sortTopValues(result, limit), nil
+}
+
+// histogramBucketStart returns the start of the histogram bucket that contains t.
+func histogramBucketStart(t time.Time, interval time.Duration) time.Time {
+	ns := t.UnixNano()
+	offset := ns % int64(interval)
+	if offset < 0 {
+		offset += int64(interval)
+	}
+	return time.Unix(0, ns-offset).UTC()
+}
+
+// matchingEvents returns the events of the tenant that match the filter, in no particular order.
+func (m Memory) matchingEvents(filter *Filter, tenantId string) ([]memoryEvent, error) {
+	timeRange, err := parseTimeFilter(filter.Time)
+	if err != nil {
+		return nil, err
+	}
+	err = filter.checkValues()
+	if err != nil {
+		return nil, err
+	}
+	var matching []memoryEvent
+	for _, e := range m.tenantEvents(filter.tenants(tenantId)...) {
+		if filterMatches(filter, timeRange, e) {
+			matching = append(matching, e)
+		}
+	}
+	return matching, nil
+}
+
+// tenantEvents returns the events of the tenants, or of all tenants if none or only "" is given.
+func (m Memory) tenantEvents(tenantIds ...string) []memoryEvent {
+	all := len(tenantIds) == 0 || (len(tenantIds) == 1 && tenantIds[0] == "")
+	wanted := make(map[string]bool)
+	for _, id := range tenantIds {
+		wanted[id] = true
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var events []memoryEvent
+	for _, e := range m.events {
+		if all || wanted[e.TenantID] {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// timeRange is the parsed form of Filter.Time
+type timeRange map[string]time.Time
+
+// Formats of time filter values that are accepted besides eventTimeFormats
+var timeFilterFormats = []string{"2006-01-02T15:04:05", "2006-01-02"}
+
+func parseTimeFilter(filter map[string]string) (timeRange, error) {
+	result := make(timeRange)
+	for op, value := range filter {
+		t, ok := parseTime(value, append(eventTimeFormats, timeFilterFormats...))
+		if !ok {
+			return nil, fmt.Errorf("cannot parse time \"%s\"", value)
+		}
+		result[op] = t
+	}
+	return result, nil
+}
+
+func parseTime(value string, formats []string) (time.Time, bool) {
+	for _, format := range formats {
+		t, err := time.Parse(format, value)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// filterMatches applies the filter like the query that the ElasticSearch driver builds.
+func filterMatches(filter *Filter, timeRange timeRange, e memoryEvent) bool {
+	p := e.Event.Payload
+	for _, field := range filterFields {
+		v := field.values(filter)
+		value := pathValue(e.object, field.path)
+		if len(v.Include) > 0 && !matchAnyValue(field, value, v.Include) {
+			return false
+		}
+		if matchAnyValue(field, value, v.Exclude) {
+			return false
+		}
+	}
+	if len(timeRange) > 0 {
+		t, ok := parseTime(p.EventTime, eventTimeFormats)
+		if !ok {
+			return false
+		}
+		for op, bound := range timeRange {
+			switch {
+			case op == "lt" && !t.Before(bound),
+				op == "lte" && t.After(bound),
+				op == "gt" && !t.After(bound),
+				op == "gte" && t.Before(bound):
+				return false
+			}
+		}
+	}
+	if filter.Query != nil && !queryMatches(filter.Query, e.object) {
+		return false
+	}
+	return true
+}
+
+// queryMatches evaluates a query of Filter.Query on the event as returned by eventObject.
+func queryMatches(query Query, object interface{}) bool {
+	switch query := query.(type) {
+	case QueryAnd:
+		for _, operand := range query {
+			if !queryMatches(operand, object) {
+				return false
+			}
+		}
+		return true
+	case QueryOr:
+		for _, operand := range query {
+			if queryMatches(operand, object) {
+				return true
+			}
+		}
+		return false
+	case QueryNot:
+		return !queryMatches(query.Operand, object)
+	case QueryMatch:
+		value := pathValue(object, QueryFields[query.Field])
+		if query.Wildcard {
+			return wildcardRegexp(query.Value).MatchString(value)
+		}
+		return value == query.Value
+	case QueryText:
+		for _, path := range queryPaths() {
+			if matchPhrase(pathValue(object, path), query.Text) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// matchAnyValue returns whether the value of the field matches any of the values of its ValueFilter.
+func matchAnyValue(field filterField, value string, filterValues []string) bool {
+	for _, filterValue := range filterValues {
+		var matches bool
+		switch {
+		case isWildcard(filterValue):
+			matches = wildcardRegexp(filterValue).MatchString(value)
+		case field.match == valuePrefix:
+			matches = strings.HasPrefix(value, filterValue)
+		case field.match == valuePhrasePrefix:
+			matches = matchPhrasePrefix(value, filterValue)
+		case field.match == valueAddress:
+			matches = matchAddress(value, filterValue)
+		default:
+			matches = value == filterValue
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddress returns whether the address matches a value of Filter.InitiatorAddress, comparing them as text like the other drivers do.
+func matchAddress(value, address string) bool {
+	exact, prefixes, _ := addressMatch(address)
+	for _, e := range exact {
+		if value == e {
+			return true
+		}
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardRegexp returns a regular expression for a pattern where only "*" is a wildcard.
+func wildcardRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile(`^(?s:` + strings.Join(parts, ".*") + `)$`)
+}
+
+// matchPhrase mimics ElasticSearch's match_phrase query on a text field: the terms of
+//  the query must appear in the field in the same order.
+func matchPhrase(field, query string) bool {
+	fieldTerms := analyze(field)
+	queryTerms := analyze(query)
+	if len(queryTerms) == 0 {
+		return false
+	}
+	for start := 0; start+len(queryTerms) <= len(fieldTerms); start++ {
+		matches := true
+		for i, term := range queryTerms {
+			if fieldTerms[start+i] != term {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPhrasePrefix mimics ElasticSearch's match_phrase_prefix query on a text field:
+//  the terms of the query must appear in the field in the same order, with the last one
+//  only being a prefix.
+func matchPhrasePrefix(field, query string) bool {
+	fieldTerms := analyze(field)
+	queryTerms := analyze(query)
+	if len(queryTerms) == 0 {
+		return true
+	}
+	last := len(queryTerms) - 1
+	for start := 0; start+last < len(fieldTerms); start++ {
+		matches := true
+		for i, term := range queryTerms[:last] {
+			if fieldTerms[start+i] != term {
+				matches = false
+				break
+			}
+		}
+		if matches && strings.HasPrefix(fieldTerms[start+last], queryTerms[last]) {
+			return true
+		}
+	}
+	return false
+}
+
+// analyze splits text into lowercase terms, approximating ElasticSearch's standard
+//  analyzer: dots and underscores only separate terms at their ends, so that
+//  "identity.project.deleted" is a single term while "data/security" are two.
+func analyze(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != '_'
+	})
+	var terms []string
+	for _, word := range words {
+		word = strings.Trim(word, "._")
+		if word != "" {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// Mapping from the API's sort fields to the fields of the event
+var memorySortFields = map[string]func(e *EventDetail) string{
+	"time":          func(e *EventDetail) string { return e.Payload.EventTime },
+	"source":        func(e *EventDetail) string { return e.PublisherID },
+	"resource_type": func(e *EventDetail) string { return e.Payload.Target.TypeURI },
+	"resource_name": func(e *EventDetail) string { return e.Payload.Target.ID },
+	"event_type":    func(e *EventDetail) string { return e.EventType },
+}
+
+// sortEvents sorts like the ElasticSearch driver: by the requested fields, then by
+// time (newest first) and finally by message ID.
+func sortEvents(events []memoryEvent, order []FieldOrder) {
+	compareTime := func(a, b *EventDetail) int {
+		ta, _ := parseTime(a.Payload.EventTime, eventTimeFormats)
+		tb, _ := parseTime(b.Payload.EventTime, eventTimeFormats)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		a, b := events[i].Event, events[j].Event
+		for _, fo := range order {
+			value, ok := memorySortFields[fo.Fieldname]
+			if !ok || (fo.Order != "asc" && fo.Order != "desc") {
+				continue
+			}
+			var cmp int
+			if fo.Fieldname == "time" {
+				cmp = compareTime(a, b)
+			} else {
+				cmp = strings.Compare(value(a), value(b))
+			}
+			if fo.Order == "desc" {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		if cmp := compareTime(a, b); cmp != 0 {
+			return cmp > 0
+		}
+		return a.MessageID < b.MessageID
+	})
+}
+
+// eventObject returns the event as generic JSON value, in which fields can be looked up by their path.
+func eventObject(event *EventDetail) (interface{}, error) {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal(buf, &value)
+	return value, err
+}
+
+// pathValue returns the string at a dotted path in a JSON value, or "" if there is none.
+func pathValue(value interface{}, path string) string {
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return ""
+}
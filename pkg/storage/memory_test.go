@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MemoryStorage_FromFile(t *testing.T) {
+	m, err := NewMemoryFromFile("../test/events.ndjson")
+	require.Nil(t, err)
+	page, err := m.GetEvents(&Filter{Limit: 3}, "")
+	require.Nil(t, err)
+	assert.Equal(t, 19, page.Total)
+	assert.Equal(t, "2017-05-03T09:45:12.500000+0000", page.Events[0].Payload.EventTime)
+	require.NotNil(t, page.Next)
+	assert.Equal(t, uint(3), page.Next.Offset)
+
+	_, err = NewMemoryFromFile("../test/does-not-exist.ndjson")
+	assert.NotNil(t, err)
+}
+
+func Test_MemoryStorage_FixtureFormats(t *testing.T) {
+	event := `{"event_type": "identity.project.deleted", "payload": {"id": "%s", "initiator": {"project_id": "p1"}}, "message_id": "%s"}`
+	fixtures := []string{
+		// a single JSON array
+		"[" + strings.Replace(event, "%s", "a", -1) + "," + strings.Replace(event, "%s", "b", -1) + "]",
+		// an object with an "events" field, like the result of the old mock
+		`{"total": 24, "events": [` + strings.Replace(event, "%s", "a", -1) + "," + strings.Replace(event, "%s", "b", -1) + "]}",
+		// NDJSON, with an explicit tenant in the second line
+		strings.Replace(event, "%s", "a", -1) + "\n" +
+			strings.Replace(strings.Replace(event, "%s", "b", -1), `"event_type"`, `"tenant_id": "p2", "event_type"`, 1) + "\n",
+	}
+	for _, fixture := range fixtures {
+		m := NewMemory()
+		require.Nil(t, m.Load(strings.NewReader(fixture)), fixture)
+		event, err := m.GetEvent("a", "p1")
+		require.Nil(t, err)
+		assert.NotNil(t, event, fixture)
+		page, err := m.GetEvents(&Filter{Limit: 10}, "")
+		require.Nil(t, err)
+		assert.Equal(t, 2, page.Total, fixture)
+	}
+
+	// not JSON
+	assert.NotNil(t, NewMemory().Load(strings.NewReader(`{"event_type": `)))
+}
@@ -0,0 +1,184 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	// Registers the "postgres" driver with database/sql
+	_ "github.com/lib/pq"
+)
+
+// Postgres is a storage driver that keeps the events as JSONB in PostgreSQL (11 or
+//  later), in a table that is partitioned by month of the event time.
+type Postgres struct {
+	sqlStorage
+}
+
+// NewPostgres connects to the database described by the given DSN (as configured
+// in postgres.dsn), and creates the schema if necessary.
+func NewPostgres(dsn string) (*Postgres, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot connect to postgres database: %v", err)
+	}
+	p := &Postgres{sqlStorage{db: db, dialect: newPostgresDialect()}}
+	err = p.EnsureSchema()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create postgres schema: %v", err)
+	}
+	return p, nil
+}
+
+// postgresSchema returns the statements that create the events table. The indexes are
+// created on the partitioned table, so that Postgres creates them on each partition. They
+// cover the filters of GetEvents:
+//   - events_body (GIN) serves the containment queries for the target ID
+//   - the trigram indexes (GIN) serve the phrase prefix queries on event_type and the
+//     typeURIs, which also match after a slash, i.e. with a leading wildcard
+//   - events_user_id serves the prefix queries on the initiator user_id
+//   - events_tenant_time serves the time range of a tenant
+// The expression indexes are built with jsonText, since Postgres only uses them for
+// queries with the very same expression.
+func postgresSchema() []string {
+	d := postgresDialect{}
+	return []string{
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`CREATE TABLE IF NOT EXISTS events (
+			id         TEXT        NOT NULL,
+			tenant_id  TEXT        NOT NULL,
+			message_id TEXT        NOT NULL,
+			event_time TIMESTAMPTZ NOT NULL,
+			body       JSONB       NOT NULL,
+			PRIMARY KEY (id, event_time)
+		) PARTITION BY RANGE (event_time)`,
+		`CREATE INDEX IF NOT EXISTS events_tenant_time ON events (tenant_id, event_time)`,
+		`CREATE INDEX IF NOT EXISTS events_message_id ON events (message_id)`,
+		`CREATE INDEX IF NOT EXISTS events_body ON events USING GIN (body jsonb_path_ops)`,
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS events_event_type ON events USING GIN (lower(%s) gin_trgm_ops)`,
+			d.jsonText("event_type")),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS events_target_type ON events USING GIN (lower(%s) gin_trgm_ops)`,
+			d.jsonText("payload.target.typeURI")),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS events_observer_type ON events USING GIN (lower(%s) gin_trgm_ops)`,
+			d.jsonText("payload.observer.typeURI")),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS events_user_id ON events (%s text_pattern_ops)`,
+			d.jsonText("payload.initiator.user_id")),
+	}
+}
+
+// EnsureSchema creates the partitioned events table and its indexes if they do not
+// exist yet. The monthly partitions are created when events are written to them.
+func (p Postgres) EnsureSchema() error {
+	for _, statement := range postgresSchema() {
+		_, err := p.db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type postgresDialect struct {
+	// Names of the partitions that are known to exist
+	partitions *sync.Map
+}
+
+func newPostgresDialect() postgresDialect {
+	return postgresDialect{partitions: &sync.Map{}}
+}
+
+func (postgresDialect) placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (postgresDialect) jsonText(path string) string {
+	return fmt.Sprintf("(body#>>'{%s}')", strings.Replace(path, ".", ",", -1))
+}
+
+func (postgresDialect) jsonEquals(path, value string) (string, interface{}) {
+	// Nest the value into a document like {"payload":{"target":{"id":value}}}, so
+	// that the containment query can use the GIN index
+	keys := strings.Split(path, ".")
+	var document interface{} = value
+	for i := len(keys) - 1; i >= 0; i-- {
+		document = map[string]interface{}{keys[i]: document}
+	}
+	buf, _ := json.Marshal(document)
+	return "body @> %s::jsonb", string(buf)
+}
+
+func (postgresDialect) hasPrefix(expr, prefix string) (string, interface{}) {
+	return expr + ` LIKE %s ESCAPE '\'`, likeEscape(prefix) + "%"
+}
+
+func (postgresDialect) matchesWildcard(expr, pattern string) (string, interface{}) {
+	return expr + ` LIKE %s ESCAPE '\'`, strings.Replace(likeEscape(pattern), "*", "%", -1)
+}
+
+func (postgresDialect) timeArg(t time.Time) interface{} {
+	return t
+}
+
+func (postgresDialect) timeBucket(interval time.Duration) string {
+	ms := int64(interval / time.Millisecond)
+	return fmt.Sprintf("CAST(floor(extract(epoch FROM event_time) * 1000 / %d) * %d AS BIGINT)", ms, ms)
+}
+
+// partitionName returns the name of the partition that holds the events of the month of t.
+func partitionName(t time.Time) string {
+	return "events_" + t.UTC().Format("2006_01")
+}
+
+// prepareWrite creates the partition for the month of the event if necessary.
+func (d postgresDialect) prepareWrite(db *sql.DB, eventTime time.Time) error {
+	t := eventTime.UTC()
+	name := partitionName(t)
+	if _, exists := d.partitions.Load(name); exists {
+		return nil
+	}
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	_, err := db.Exec(fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s PARTITION OF events FOR VALUES FROM ('%s') TO ('%s')`,
+		name, start.Format(time.RFC3339), start.AddDate(0, 1, 0).Format(time.RFC3339)))
+	if err != nil {
+		return err
+	}
+	d.partitions.Store(name, true)
+	return nil
+}
+
+func (d postgresDialect) writeEvent(tx *sql.Tx, te TenantEvent, eventTime time.Time, body []byte) error {
+	_, err := tx.Exec(`INSERT INTO events (id, tenant_id, message_id, event_time, body) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id, event_time) DO UPDATE
+		SET tenant_id = EXCLUDED.tenant_id, message_id = EXCLUDED.message_id, body = EXCLUDED.body`,
+		te.Event.Payload.ID, te.TenantID, te.Event.MessageID, eventTime, string(body))
+	return err
+}
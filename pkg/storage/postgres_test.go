@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PostgresQuery(t *testing.T) {
+	s := sqlStorage{dialect: newPostgresDialect()}
+	q, err := s.eventQuery(&Filter{
+		Source:     Values("identity"),
+		ResourceId: Values("b3b70c8271a845709f9a03030e705da7"),
+		UserId:     Values("eb5cd8f9_"),
+		Time:       map[string]string{"gte": "2017-05-02T12:00:00"},
+	}, "tenant1")
+	require.Nil(t, err)
+
+	assert.Equal(t, " WHERE tenant_id = $1"+
+		` AND (lower((body#>>'{event_type}')) LIKE $2 ESCAPE '\' OR lower((body#>>'{event_type}')) LIKE $3 ESCAPE '\')`+
+		" AND body @> $4::jsonb"+
+		` AND (body#>>'{payload,initiator,user_id}') LIKE $5 ESCAPE '\'`+
+		" AND event_time >= $6",
+		q.whereClause())
+	assert.Equal(t, []interface{}{
+		"tenant1",
+		"identity%",
+		"%/identity%",
+		`{"payload":{"target":{"id":"b3b70c8271a845709f9a03030e705da7"}}}`,
+		`eb5cd8f9\_%`,
+		time.Date(2017, 5, 2, 12, 0, 0, 0, time.UTC),
+	}, q.args)
+}
+
+func Test_PostgresQueryExpression(t *testing.T) {
+	s := sqlStorage{dialect: newPostgresDialect()}
+	q, err := s.eventQuery(&Filter{Query: QueryOr{
+		QueryMatch{Field: "initiator.host.address", Value: "10.0_*", Wildcard: true},
+		QueryNot{Operand: QueryMatch{Field: "outcome", Value: "success"}},
+	}}, "")
+	require.Nil(t, err)
+
+	assert.Equal(t, ` WHERE ((body#>>'{payload,initiator,host,address}') LIKE $1 ESCAPE '\'`+
+		" OR (body @> $2::jsonb) IS NOT TRUE)",
+		q.whereClause())
+	assert.Equal(t, []interface{}{`10.0\_%`, `{"payload":{"outcome":"success"}}`}, q.args)
+}
+
+func Test_PostgresPartitionName(t *testing.T) {
+	eventTime := time.Date(2017, 12, 31, 23, 30, 0, 0, time.FixedZone("", -3600))
+	assert.Equal(t, "events_2018_01", partitionName(eventTime))
+}
+
+// Test_PostgresIndexes checks that the filters of GetEvents can use an index, also for
+// phrase prefixes, which may start after a slash. Like Test_PostgresConformance, it only
+// runs if HERMES_TEST_POSTGRES_DSN is set, and drops the events table.
+func Test_PostgresIndexes(t *testing.T) {
+	dsn := os.Getenv("HERMES_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("HERMES_TEST_POSTGRES_DSN is not set")
+	}
+	p, err := NewPostgres(dsn)
+	require.Nil(t, err)
+	defer p.db.Close()
+	require.Nil(t, ResetPostgres(p))
+	file, err := os.Open("../test/events.ndjson")
+	require.Nil(t, err)
+	defer file.Close()
+	events, err := ReadFixture(file)
+	require.Nil(t, err)
+	require.Nil(t, p.WriteEvents(events))
+
+	filters := map[string]*Filter{
+		"event_type":     {EventType: Values("identity.project")},
+		"resource_type":  {ResourceType: Values("account")},
+		"observer_type":  {ObserverType: Values("security")},
+		"user_id":        {UserId: Values("eb5cd8f9")},
+		"resource_id":    {ResourceId: Values("b3b70c8271a845709f9a03030e705da7")},
+		"several_values": {ResourceType: Values("project", "account")},
+	}
+	for name, filter := range filters {
+		q, err := p.eventQuery(filter, "")
+		require.Nil(t, err, name)
+		plan := explain(t, p, "SELECT id FROM events"+q.whereClause(), q.args)
+		assert.NotContains(t, plan, "Seq Scan", "%s: %s", name, plan)
+	}
+}
+
+// explain returns the plan of the query, with sequential scans disabled, so that they
+// only appear if no index can be used.
+func explain(t *testing.T, p *Postgres, query string, args []interface{}) string {
+	tx, err := p.db.Begin()
+	require.Nil(t, err)
+	defer tx.Rollback()
+	_, err = tx.Exec(`SET LOCAL enable_seqscan = off`)
+	require.Nil(t, err)
+	rows, err := tx.Query("EXPLAIN "+query, args...)
+	require.Nil(t, err)
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var line string
+		require.Nil(t, rows.Scan(&line))
+		lines = append(lines, line)
+	}
+	require.Nil(t, rows.Err())
+	return strings.Join(lines, "\n")
+}
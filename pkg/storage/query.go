@@ -0,0 +1,93 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import "sort"
+
+// Query is a condition on events, as given in the q parameter of the API. It is one
+//  of QueryAnd, QueryOr, QueryNot, QueryMatch and QueryText, which each driver
+//  translates into its own query language.
+type Query interface {
+	isQuery()
+}
+
+// QueryAnd matches the events that all of its operands match.
+type QueryAnd []Query
+
+// QueryOr matches the events that any of its operands matches.
+type QueryOr []Query
+
+// QueryNot matches the events that its operand does not match.
+type QueryNot struct {
+	Operand Query
+}
+
+// QueryMatch matches the events where a field has a value. The comparison respects case.
+type QueryMatch struct {
+	// One of the keys of QueryFields
+	Field string
+	Value string
+	// Whether "*" in Value stands for any sequence of characters
+	Wildcard bool
+}
+
+// QueryText matches the events where the words of Text appear in this order in any of
+//  the QueryFields, ignoring case, like ElasticSearch's match_phrase query.
+type QueryText struct {
+	Text string
+}
+
+func (QueryAnd) isQuery()   {}
+func (QueryOr) isQuery()    {}
+func (QueryNot) isQuery()   {}
+func (QueryMatch) isQuery() {}
+func (QueryText) isQuery()  {}
+
+// QueryFields maps the fields that queries can refer to onto their paths in the event.
+//  Only these fields can be queried, so that clients cannot probe the internals of the storage.
+var QueryFields = map[string]string{
+	"id":                     "payload.id",
+	"event_type":             "event_type",
+	"publisher_id":           "publisher_id",
+	"action":                 "payload.action",
+	"outcome":                "payload.outcome",
+	"initiator.id":           "payload.initiator.id",
+	"initiator.typeURI":      "payload.initiator.typeURI",
+	"initiator.user_id":      "payload.initiator.user_id",
+	"initiator.project_id":   "payload.initiator.project_id",
+	"initiator.domain_id":    "payload.initiator.domain_id",
+	"initiator.host.address": "payload.initiator.host.address",
+	"initiator.host.agent":   "payload.initiator.host.agent",
+	"target.id":              "payload.target.id",
+	"target.typeURI":         "payload.target.typeURI",
+	"target.name":            "payload.target.name",
+	"observer.id":            "payload.observer.id",
+	"observer.typeURI":       "payload.observer.typeURI",
+}
+
+// queryPaths returns the paths of the QueryFields in a stable order.
+func queryPaths() []string {
+	var paths []string
+	for _, path := range QueryFields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,594 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sapcc/hermes/pkg/util"
+)
+
+// sqlDialect contains what differs between the SQL databases that events can be stored in.
+//  All of them use an events table with the columns id (the CADF event ID), tenant_id,
+//  message_id, event_time and body (the EventDetail as JSON).
+type sqlDialect interface {
+	// placeholder returns the placeholder for the n-th argument of a statement, starting at 1
+	placeholder(n int) string
+	// jsonText returns an expression for the text at the given path in the body, e.g. "payload.target.id"
+	jsonText(path string) string
+	// jsonEquals returns a condition for the text at the given path being equal to value,
+	//  with %s in place of the placeholder, and the argument for it
+	jsonEquals(path, value string) (string, interface{})
+	// hasPrefix returns a case-sensitive condition for expr starting with prefix, with %s in
+	//  place of the placeholder, and the argument for it
+	hasPrefix(expr, prefix string) (string, interface{})
+	// matchesWildcard returns a case-sensitive condition for expr matching a pattern where "*"
+	//  stands for any sequence of characters, with %s in place of the placeholder, and the argument for it
+	matchesWildcard(expr, pattern string) (string, interface{})
+	// timeArg converts a time into a value that can be compared with the event_time column
+	timeArg(t time.Time) interface{}
+	// timeBucket returns an expression for the start of the histogram bucket of the given
+	//  interval that contains event_time, in milliseconds since the epoch
+	timeBucket(interval time.Duration) string
+	// prepareWrite is called outside of the transaction before an event is written, e.g. to create the table it goes into
+	prepareWrite(db *sql.DB, eventTime time.Time) error
+	// writeEvent stores a single event, replacing an existing event with the same ID
+	writeEvent(tx *sql.Tx, te TenantEvent, eventTime time.Time, body []byte) error
+}
+
+// sqlStorage implements the read side of Storage, and the parts of the write side
+// that all SQL databases have in common.
+type sqlStorage struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// Mapping from the API's sort fields to paths in the event body
+var sqlSortFields = map[string]string{
+	"source":        "publisher_id",
+	"resource_type": "payload.target.typeURI",
+	"resource_name": "payload.target.id",
+	"event_type":    "event_type",
+}
+
+// sqlQuery collects the conditions and arguments of a statement.
+type sqlQuery struct {
+	dialect    sqlDialect
+	conditions []string
+	args       []interface{}
+}
+
+// arg adds an argument and returns its placeholder.
+func (q *sqlQuery) arg(value interface{}) string {
+	q.args = append(q.args, value)
+	return q.dialect.placeholder(len(q.args))
+}
+
+// where adds a condition, with %s in it being replaced by the placeholders for the arguments.
+func (q *sqlQuery) where(condition string, args ...interface{}) {
+	var placeholders []interface{}
+	for _, a := range args {
+		placeholders = append(placeholders, q.arg(a))
+	}
+	q.conditions = append(q.conditions, fmt.Sprintf(condition, placeholders...))
+}
+
+// whereIn adds a condition for expr being one of the values.
+func (q *sqlQuery) whereIn(expr string, values []string) {
+	if len(values) == 1 {
+		q.where(expr+" = %s", values[0])
+		return
+	}
+	var args []interface{}
+	for _, v := range values {
+		args = append(args, v)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("%s, ", len(values)), ", ")
+	q.where(expr+" IN ("+placeholders+")", args...)
+}
+
+// valueCondition returns a condition for a field matching a value of its ValueFilter,
+//  adding its arguments. It reproduces the queries of the ElasticSearch driver:
+//   - prefixes respect case, like the prefix query on a keyword field
+//   - phrase prefixes approximate the match_phrase_prefix query on a text field: the
+//     phrase is matched case-insensitively, and it may start at the beginning of the
+//     field or after a slash, which separates the terms of a typeURI
+func (q *sqlQuery) valueCondition(field filterField, value string) string {
+	expr := q.dialect.jsonText(field.path)
+	switch {
+	case isWildcard(value):
+		condition, arg := q.dialect.matchesWildcard(expr, value)
+		return fmt.Sprintf(condition, q.arg(arg))
+	case field.match == valuePrefix:
+		condition, arg := q.dialect.hasPrefix(expr, value)
+		return fmt.Sprintf(condition, q.arg(arg))
+	case field.match == valuePhrasePrefix:
+		escaped := likeEscape(strings.ToLower(value))
+		return fmt.Sprintf(`(lower(%s) LIKE %s ESCAPE '\' OR lower(%s) LIKE %s ESCAPE '\')`,
+			expr, q.arg(escaped+"%"), expr, q.arg("%/"+escaped+"%"))
+	case field.match == valueAddress:
+		// checked by Filter.checkValues
+		exact, prefixes, _ := addressMatch(value)
+		var conditions []string
+		if len(exact) > 0 {
+			placeholders := make([]string, len(exact))
+			for i, address := range exact {
+				placeholders[i] = q.arg(address)
+			}
+			conditions = append(conditions, expr+" IN ("+strings.Join(placeholders, ", ")+")")
+		}
+		for _, prefix := range prefixes {
+			condition, arg := q.dialect.hasPrefix(expr, prefix)
+			conditions = append(conditions, fmt.Sprintf(condition, q.arg(arg)))
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")"
+	}
+	condition, arg := q.dialect.jsonEquals(field.path, value)
+	return fmt.Sprintf(condition, q.arg(arg))
+}
+
+// queryCondition translates a query of Filter.Query into a condition, adding its arguments.
+//  Negations also match events without the field, like in ElasticSearch.
+func (q *sqlQuery) queryCondition(query Query) string {
+	join := func(operands []Query, operator string) string {
+		var conditions []string
+		for _, operand := range operands {
+			conditions = append(conditions, q.queryCondition(operand))
+		}
+		if len(conditions) == 0 {
+			return "1 = 1"
+		}
+		return "(" + strings.Join(conditions, " "+operator+" ") + ")"
+	}
+	switch query := query.(type) {
+	case QueryAnd:
+		return join(query, "AND")
+	case QueryOr:
+		return join(query, "OR")
+	case QueryNot:
+		return "(" + q.queryCondition(query.Operand) + ") IS NOT TRUE"
+	case QueryMatch:
+		path := QueryFields[query.Field]
+		var condition string
+		var arg interface{}
+		if query.Wildcard {
+			condition, arg = q.dialect.matchesWildcard(q.dialect.jsonText(path), query.Value)
+		} else {
+			condition, arg = q.dialect.jsonEquals(path, query.Value)
+		}
+		return fmt.Sprintf(condition, q.arg(arg))
+	case QueryText:
+		// This approximates a phrase search: the terms must appear in this order, but
+		// they can also be part of longer terms, or have other terms between them.
+		var terms []string
+		for _, term := range analyze(query.Text) {
+			terms = append(terms, likeEscape(term))
+		}
+		pattern := "%" + strings.Join(terms, "%") + "%"
+		var conditions []string
+		for _, path := range queryPaths() {
+			conditions = append(conditions, fmt.Sprintf(`lower(%s) LIKE %s ESCAPE '\'`, q.dialect.jsonText(path), q.arg(pattern)))
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")"
+	}
+	return "1 = 1"
+}
+
+// likeEscape escapes the wildcards of LIKE patterns, for use with ESCAPE '\'.
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (q *sqlQuery) whereClause() string {
+	if len(q.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.conditions, " AND ")
+}
+
+// eventQuery translates the filter and tenant into conditions, like the query that
+// the ElasticSearch driver builds.
+func (s sqlStorage) eventQuery(filter *Filter, tenantId string) (*sqlQuery, error) {
+	q := &sqlQuery{dialect: s.dialect}
+	if tenants := filter.tenants(tenantId); tenants != nil {
+		q.whereIn("tenant_id", tenants)
+	}
+	err := filter.checkValues()
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range filterFields {
+		v := field.values(filter)
+		if len(v.Include) > 0 {
+			var conditions []string
+			for _, value := range v.Include {
+				conditions = append(conditions, q.valueCondition(field, value))
+			}
+			if len(conditions) == 1 {
+				q.conditions = append(q.conditions, conditions[0])
+			} else {
+				q.conditions = append(q.conditions, "("+strings.Join(conditions, " OR ")+")")
+			}
+		}
+		// like in ElasticSearch, events without the field are not excluded
+		for _, value := range v.Exclude {
+			q.conditions = append(q.conditions, "("+q.valueCondition(field, value)+") IS NOT TRUE")
+		}
+	}
+	if filter.Query != nil {
+		q.conditions = append(q.conditions, q.queryCondition(filter.Query))
+	}
+	timeRange, err := parseTimeFilter(filter.Time)
+	if err != nil {
+		return nil, err
+	}
+	operators := map[string]string{"lt": "<", "lte": "<=", "gt": ">", "gte": ">="}
+	for op, t := range timeRange {
+		if operator, ok := operators[op]; ok {
+			q.where("event_time "+operator+" %s", s.dialect.timeArg(t))
+		}
+	}
+	return q, nil
+}
+
+func (s sqlStorage) GetEvents(filter *Filter, tenantId string) (*EventPage, error) {
+	err := filter.checkFacets()
+	if err != nil {
+		return nil, err
+	}
+	q, err := s.eventQuery(filter, tenantId)
+	if err != nil {
+		return nil, err
+	}
+
+	var page EventPage
+	err = s.db.QueryRow("SELECT COUNT(*) FROM events"+q.whereClause(), q.args...).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	var order []string
+	for _, fieldOrder := range filter.Sort {
+		direction := map[string]string{"asc": "ASC", "desc": "DESC"}[fieldOrder.Order]
+		if direction == "" {
+			continue
+		}
+		if fieldOrder.Fieldname == "time" {
+			order = append(order, "event_time "+direction)
+		} else if path, ok := sqlSortFields[fieldOrder.Fieldname]; ok {
+			order = append(order, s.dialect.jsonText(path)+" "+direction)
+		}
+	}
+	// message_id is unique, so sorting on it last gives a stable order for paging
+	order = append(order, "event_time DESC", "message_id ASC")
+
+	offset := filter.Offset
+	if filter.Cursor != nil {
+		offset = filter.Cursor.Offset
+	}
+	query := fmt.Sprintf("SELECT tenant_id, body FROM events%s ORDER BY %s LIMIT %s OFFSET %s",
+		q.whereClause(), strings.Join(order, ", "), q.arg(filter.Limit), q.arg(offset))
+	util.LogDebug("Querying events: %s", query)
+	rows, err := s.db.Query(query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tenantId string
+		var body []byte
+		err = rows.Scan(&tenantId, &body)
+		if err != nil {
+			return nil, err
+		}
+		var event EventDetail
+		err = json.Unmarshal(body, &event)
+		if err != nil {
+			return nil, err
+		}
+		event.TenantID = tenantId
+		page.Events = append(page.Events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Events) > 0 && int(offset)+len(page.Events) < page.Total {
+		last := page.Events[len(page.Events)-1]
+		page.Next = &Cursor{
+			Offset:     offset + uint(len(page.Events)),
+			SortValues: []interface{}{last.Payload.EventTime, last.MessageID},
+		}
+	}
+
+	// each facet needs its own GROUP BY query
+	if len(filter.Facets) > 0 {
+		page.Facets = make(map[string]AttributeValueList)
+		for _, facet := range filter.Facets {
+			page.Facets[facet], err = s.GetAttributes(filter, tenantId, facet, filter.FacetLimit)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &page, nil
+}
+
+func (s sqlStorage) GetEvent(eventId string, tenantId string) (*EventDetail, error) {
+	q := &sqlQuery{dialect: s.dialect}
+	q.where("message_id = %s", eventId)
+	if tenantId != "" {
+		q.where("tenant_id = %s", tenantId)
+	}
+	var event EventDetail
+	var body []byte
+	err := s.db.QueryRow("SELECT tenant_id, body FROM events"+q.whereClause(), q.args...).Scan(&event.TenantID, &body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, &event)
+	return &event, err
+}
+
+// GetAttributes counts the values of the attribute among the matching events, like the
+// terms aggregation of ElasticSearch does.
+func (s sqlStorage) GetAttributes(filter *Filter, tenantId string, attribute string, limit uint) (AttributeValueList, error) {
+	path, err := attributePath(attribute, limit)
+	if err != nil {
+		return nil, err
+	}
+	q, err := s.eventQuery(filter, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	field := s.dialect.jsonText(path)
+	q.conditions = append(q.conditions, field+" IS NOT NULL")
+	query := fmt.Sprintf("SELECT %s, COUNT(*) FROM events%s GROUP BY %s ORDER BY COUNT(*) DESC, %s",
+		field, q.whereClause(), field, field)
+	// the values of "source" are added up from all event types
+	if attribute != "source" {
+		query += " LIMIT " + q.arg(limit)
+	}
+	util.LogDebug("Querying attribute values: %s", query)
+	rows, err := s.db.Query(query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var value string
+		var count int64
+		err = rows.Scan(&value, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[value] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return attributeValues(attribute, counts, limit), nil
+}
+
+// GetHistogram counts the matching events by the start of their bucket, like the
+// date_histogram aggregation of ElasticSearch does.
+func (s sqlStorage) GetHistogram(filter *Filter, tenantId string, interval time.Duration, splitBy string) ([]HistogramBucket, error) {
+	err := checkInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+	q, err := s.eventQuery(filter, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	columns, groups := s.dialect.timeBucket(interval)+" AS bucket", "bucket"
+	splitPath, split := HistogramFields[splitBy]
+	if split {
+		columns += ", " + s.dialect.jsonText(splitPath) + " AS split_value"
+		groups += ", split_value"
+	} else {
+		columns += ", NULL"
+	}
+	query := fmt.Sprintf("SELECT %s, COUNT(*) FROM events%s GROUP BY %s ORDER BY bucket",
+		columns, q.whereClause(), groups)
+	util.LogDebug("Querying histogram: %s", query)
+	rows, err := s.db.Query(query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []HistogramBucket{}
+	for rows.Next() {
+		var start int64
+		var value sql.NullString
+		var count int
+		err = rows.Scan(&start, &value, &count)
+		if err != nil {
+			return nil, err
+		}
+		t := time.Unix(0, start*int64(time.Millisecond)).UTC()
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Time.Equal(t) {
+			bucket := HistogramBucket{Time: t}
+			if split {
+				bucket.Counts = make(map[string]int)
+			}
+			buckets = append(buckets, bucket)
+		}
+		bucket := &buckets[len(buckets)-1]
+		bucket.Count += count
+		// events without the field are only counted in the total, like in ElasticSearch
+		if split && value.Valid {
+			bucket.Counts[value.String] += count
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		limitCounts(bucket.Counts)
+	}
+	return buckets, nil
+}
+
+func (s sqlStorage) GetTop(filter *Filter, tenantId string, field string, limit uint, splitBy string) ([]TopValue, error) {
+	path, err := topPath(field, limit)
+	if err != nil {
+		return nil, err
+	}
+	q, err := s.eventQuery(filter, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	expr := s.dialect.jsonText(path)
+	q.conditions = append(q.conditions, expr+" IS NOT NULL", expr+" <> ''")
+	query := fmt.Sprintf("SELECT %s, COUNT(*) FROM events%s GROUP BY %s ORDER BY COUNT(*) DESC, %s LIMIT %s",
+		expr, q.whereClause(), expr, expr, q.arg(limit))
+	util.LogDebug("Querying top values: %s", query)
+	rows, err := s.db.Query(query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []TopValue{}
+	for rows.Next() {
+		var value TopValue
+		err = rows.Scan(&value.Value, &value.Count)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	splitPath, split := HistogramFields[splitBy]
+	if !split || len(values) == 0 {
+		return sortTopValues(values, limit), nil
+	}
+
+	// the split counts of the top values need a second query
+	byValue := make(map[string]*TopValue, len(values))
+	topValues := make([]string, len(values))
+	for i := range values {
+		values[i].Counts = make(map[string]int)
+		byValue[values[i].Value] = &values[i]
+		topValues[i] = values[i].Value
+	}
+	q, err = s.eventQuery(filter, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	q.whereIn(expr, topValues)
+	splitExpr := s.dialect.jsonText(splitPath)
+	q.conditions = append(q.conditions, splitExpr+" IS NOT NULL")
+	query = fmt.Sprintf("SELECT %s, %s, COUNT(*) FROM events%s GROUP BY %s, %s",
+		expr, splitExpr, q.whereClause(), expr, splitExpr)
+	util.LogDebug("Querying top values by %s: %s", splitBy, query)
+	splitRows, err := s.db.Query(query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer splitRows.Close()
+	for splitRows.Next() {
+		var value, splitValue string
+		var count int
+		err = splitRows.Scan(&value, &splitValue, &count)
+		if err != nil {
+			return nil, err
+		}
+		if topValue, ok := byValue[value]; ok {
+			topValue.Counts[splitValue] += count
+		}
+	}
+	if err = splitRows.Err(); err != nil {
+		return nil, err
+	}
+	return sortTopValues(values, limit), nil
+}
+
+// MaxLimit returns the same default as ElasticSearch's max_result_window
+func (s sqlStorage) MaxLimit() uint {
+	return 10000
+}
+
+// WriteEvents writes the events in a single transaction. Events without a CADF event ID
+// are rejected; any other failure fails the whole batch.
+func (s sqlStorage) WriteEvents(events []TenantEvent) error {
+	bulkErr := BulkError{Items: make(map[int]ItemError), Total: len(events)}
+	bodies := make(map[int][]byte)
+	times := make(map[int]time.Time)
+	for i, te := range events {
+		if te.Event == nil || te.Event.Payload.ID == "" {
+			bulkErr.Items[i] = ItemError{Status: 400, Reason: "event has no CADF event ID"}
+			continue
+		}
+		t, err := eventTime(te.Event)
+		if err != nil {
+			bulkErr.Items[i] = ItemError{Status: 400, Reason: err.Error()}
+			continue
+		}
+		body, err := json.Marshal(te.Event)
+		if err != nil {
+			bulkErr.Items[i] = ItemError{Status: 400, Reason: err.Error()}
+			continue
+		}
+		err = s.dialect.prepareWrite(s.db, t)
+		if err != nil {
+			return err
+		}
+		bodies[i] = body
+		times[i] = t
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i, te := range events {
+		body, valid := bodies[i]
+		if !valid {
+			continue
+		}
+		err = s.dialect.writeEvent(tx, te, times[i], body)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if len(bulkErr.Items) > 0 {
+		return bulkErr
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	// Registers the "sqlite3" driver with database/sql
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite is a storage driver that keeps the events in a local SQLite database.
+//  It needs no further infrastructure, which makes it suitable for small
+//  deployments, development and CI.
+type SQLite struct {
+	sqlStorage
+}
+
+// NewSQLite opens the database file at the given path (as configured in
+// sqlite.path), creating it and its schema if necessary.
+func NewSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time, and an in-memory database
+	// exists only within its connection
+	db.SetMaxOpenConns(1)
+	s := &SQLite{sqlStorage{db: db, dialect: sqliteDialect{}}}
+	err = s.EnsureSchema()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create SQLite schema in %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// The indexes cover the filters of GetEvents. event_time is stored in microseconds since the epoch.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS events (
+		id         TEXT    NOT NULL PRIMARY KEY,
+		tenant_id  TEXT    NOT NULL,
+		message_id TEXT    NOT NULL,
+		event_time INTEGER NOT NULL,
+		body       TEXT    NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS events_tenant_time ON events (tenant_id, event_time)`,
+	`CREATE INDEX IF NOT EXISTS events_message_id ON events (message_id)`,
+	`CREATE INDEX IF NOT EXISTS events_event_type ON events (json_extract(body, '$.event_type'))`,
+	`CREATE INDEX IF NOT EXISTS events_target_type ON events (json_extract(body, '$.payload.target.typeURI'))`,
+	`CREATE INDEX IF NOT EXISTS events_target_id ON events (json_extract(body, '$.payload.target.id'))`,
+	`CREATE INDEX IF NOT EXISTS events_user_id ON events (json_extract(body, '$.payload.initiator.user_id'))`,
+}
+
+// EnsureSchema creates the events table and its indexes if they do not exist yet.
+func (s SQLite) EnsureSchema() error {
+	for _, statement := range sqliteSchema {
+		_, err := s.db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) placeholder(n int) string {
+	return "?"
+}
+
+func (sqliteDialect) jsonText(path string) string {
+	return fmt.Sprintf("json_extract(body, '$.%s')", strings.Replace(path, "'", "''", -1))
+}
+
+func (d sqliteDialect) jsonEquals(path, value string) (string, interface{}) {
+	return d.jsonText(path) + " = %s", value
+}
+
+func (sqliteDialect) hasPrefix(expr, prefix string) (string, interface{}) {
+	// LIKE is case-insensitive in SQLite
+	return fmt.Sprintf("substr(%s, 1, %d) = %%s", expr, utf8.RuneCountInString(prefix)), prefix
+}
+
+func (sqliteDialect) matchesWildcard(expr, pattern string) (string, interface{}) {
+	// unlike LIKE, GLOB is case-sensitive
+	glob := strings.NewReplacer("?", "[?]", "[", "[[]").Replace(pattern)
+	return expr + " GLOB %s", glob
+}
+
+func (sqliteDialect) timeArg(t time.Time) interface{} {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+func (sqliteDialect) timeBucket(interval time.Duration) string {
+	ms := int64(interval / time.Millisecond)
+	return fmt.Sprintf("(event_time / 1000 / %d) * %d", ms, ms)
+}
+
+func (sqliteDialect) prepareWrite(db *sql.DB, eventTime time.Time) error {
+	return nil
+}
+
+func (d sqliteDialect) writeEvent(tx *sql.Tx, te TenantEvent, eventTime time.Time, body []byte) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO events (id, tenant_id, message_id, event_time, body) VALUES (?, ?, ?, ?, ?)`,
+		te.Event.Payload.ID, te.TenantID, te.Event.MessageID, d.timeArg(eventTime), string(body))
+	return err
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLite(t *testing.T) *SQLite {
+	s, err := NewSQLite(":memory:")
+	require.Nil(t, err)
+	return s
+}
+
+func Test_SQLiteStorage_Reopen(t *testing.T) {
+	path := t.TempDir() + "/events.db"
+	s, err := NewSQLite(path)
+	require.Nil(t, err)
+	writeTestEvents(t, s)
+	s.db.Close()
+
+	// The schema is only created once, and the events are still there
+	s, err = NewSQLite(path)
+	require.Nil(t, err)
+	page, err := s.GetEvents(&Filter{Limit: 10}, "tenant2")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"d"}, eventIds(page))
+}
+
+func Test_SQLiteStorage_InvalidAttribute(t *testing.T) {
+	_, err := newTestSQLite(t).GetAttributes(&Filter{}, "", "payload.target.id') --", 10)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,1210 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storagetest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// FakeElasticSearch is an in-process stand-in for an ElasticSearch or OpenSearch
+// cluster, so that the ElasticSearch driver can be tested without one. It implements
+// the parts of the REST API that the driver uses, with the mappings that an index gets
+// from the index template that the driver installs, or without one from the dynamic
+// mapping:
+//
+//   - Strings are text fields with a keyword subfield, which is named like in the
+//     dynamic template of the first installed index template whose pattern matches
+//     the index, or "keyword" without one. Other subfields do not exist, so queries
+//     on them match nothing. Text fields are analyzed like the standard analyzer
+//     does, and cannot be used for sorting and aggregations.
+//   - @timestamp and payload.eventTime are date fields.
+//   - Queries can combine bool, match (also of type phrase_prefix), match_phrase,
+//     match_phrase_prefix, term, terms, prefix, wildcard, range and match_all queries.
+//   - Searches support sorting, from, size, search_after, and terms and date_histogram
+//     aggregations, which can contain further aggregations. They can be sent to
+//     _search, or to _msearch, which takes the indices in the body.
+//   - The mappings of fields can be read with _mapping/field.
+//   - Like ElasticSearch, the fake rejects request lines longer than 4096 bytes.
+//
+// Where the supported versions differ in the parts that the driver uses (mapping
+// types, index template APIs, the total number of hits, date_histogram intervals), the fake behaves like the
+// version that it was started with.
+type FakeElasticSearch struct {
+	*httptest.Server
+	distribution string
+	version      string
+	major, minor int
+	mutex        sync.Mutex
+	documents    map[string]fakeDocument
+	templates    map[string]string
+	indices      map[string]fakeIndex
+}
+
+type fakeDocument struct {
+	index, docType, id string
+	// the name of the keyword subfield of strings in the index
+	keyword string
+	source  map[string]interface{}
+	raw     json.RawMessage
+}
+
+// fakeIndex is the mapping that an index got when its first document was written.
+type fakeIndex struct {
+	docType, keyword string
+}
+
+// NewFakeElasticSearch starts a FakeElasticSearch without any documents. The version
+// is the one that the cluster reports, like "5.6.0" for ElasticSearch or
+// "opensearch-2.11.0" for OpenSearch. Its URL is in the URL field, and it needs to
+// be closed with Close().
+func NewFakeElasticSearch(version string) *FakeElasticSearch {
+	f := &FakeElasticSearch{
+		distribution: "elasticsearch",
+		version:      version,
+		documents:    make(map[string]fakeDocument),
+		templates:    make(map[string]string),
+		indices:      make(map[string]fakeIndex),
+	}
+	if strings.HasPrefix(version, "opensearch-") {
+		f.distribution = "opensearch"
+		f.version = strings.TrimPrefix(version, "opensearch-")
+	}
+	parts := strings.Split(f.version, ".")
+	f.major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		f.minor, _ = strconv.Atoi(parts[1])
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// Whether documents still have a mapping type, which is the case up to ElasticSearch 6.
+func (f *FakeElasticSearch) hasTypes() bool {
+	return f.distribution == "elasticsearch" && f.major < 7
+}
+
+// Whether the _type of documents is rejected, like ElasticSearch 8 and OpenSearch 2 do.
+// ElasticSearch 7 only deprecated it, and reports "_doc" as the type of all documents.
+func (f *FakeElasticSearch) typesRemoved() bool {
+	if f.distribution == "opensearch" {
+		return f.major >= 2
+	}
+	return f.major >= 8
+}
+
+// Whether the _index_template API exists, which it does since ElasticSearch 7.8.
+func (f *FakeElasticSearch) hasComposableTemplates() bool {
+	return f.distribution == "opensearch" || f.major > 7 || (f.major == 7 && f.minor >= 8)
+}
+
+// Template returns the body of an index template, or "" if it was not installed.
+func (f *FakeElasticSearch) Template(name string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.templates[name]
+}
+
+// Indices returns the names of all indices that contain documents.
+func (f *FakeElasticSearch) Indices() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	seen := make(map[string]bool)
+	var indices []string
+	for _, doc := range f.documents {
+		if !seen[doc.index] {
+			seen[doc.index] = true
+			indices = append(indices, doc.index)
+		}
+	}
+	sort.Strings(indices)
+	return indices
+}
+
+// fakeError is an error that is reported like ElasticSearch does.
+type fakeError struct {
+	status  int
+	errType string
+	reason  string
+}
+
+func (e fakeError) Error() string {
+	return e.errType + ": " + e.reason
+}
+
+func badRequest(format string, args ...interface{}) fakeError {
+	return fakeError{400, "illegal_argument_exception", fmt.Sprintf(format, args...)}
+}
+
+func (f *FakeElasticSearch) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var result interface{}
+	var err error
+	p := r.URL.Path
+	switch {
+	case len(r.Method)+len(r.RequestURI)+len(r.Proto)+2 > maxInitialLineLength:
+		err = fakeError{400, "too_long_frame_exception", fmt.Sprintf("An HTTP line is larger than %d bytes.", maxInitialLineLength)}
+	case p == "/" || p == "":
+		version := map[string]interface{}{"number": f.version}
+		tagline := "You Know, for Search"
+		if f.distribution == "opensearch" {
+			version["distribution"] = f.distribution
+			tagline = "The OpenSearch Project: https://opensearch.org/"
+		}
+		result = map[string]interface{}{
+			"name":         "fake",
+			"cluster_name": "hermes-test",
+			"version":      version,
+			"tagline":      tagline,
+		}
+	case p == "/_nodes/http":
+		address := strings.TrimPrefix(f.URL, "http://")
+		result = map[string]interface{}{
+			"cluster_name": "hermes-test",
+			"nodes": map[string]interface{}{
+				"fake": map[string]interface{}{
+					"name": "fake",
+					"http": map[string]interface{}{"publish_address": address, "bound_address": []string{address}},
+				},
+			},
+		}
+	case p == "/_bulk":
+		result, err = f.bulk(r)
+	case strings.HasPrefix(p, "/_template/"):
+		err = f.putTemplate(strings.TrimPrefix(p, "/_template/"), r, false)
+		result = map[string]interface{}{"acknowledged": true}
+	case strings.HasPrefix(p, "/_index_template/") && f.hasComposableTemplates():
+		err = f.putTemplate(strings.TrimPrefix(p, "/_index_template/"), r, true)
+		result = map[string]interface{}{"acknowledged": true}
+	case p == "/_msearch":
+		result, err = f.multiSearch(r)
+	case strings.Contains(p, "/_mapping/field/"):
+		parts := strings.SplitN(strings.Trim(p, "/"), "/_mapping/field/", 2)
+		result = f.fieldMappings(parts[0], strings.Split(parts[1], ","))
+	case strings.HasSuffix(p, "/_search"):
+		body, _ := ioutil.ReadAll(r.Body)
+		result, err = f.search(strings.Trim(strings.TrimSuffix(p, "/_search"), "/"), body)
+	default:
+		err = fakeError{404, "unsupported_operation_exception", r.Method + " " + p + " is not implemented by the fake"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		fe, ok := err.(fakeError)
+		if !ok {
+			fe = fakeError{500, "exception", err.Error()}
+		}
+		result = map[string]interface{}{
+			"error":  map[string]interface{}{"type": fe.errType, "reason": fe.reason},
+			"status": fe.status,
+		}
+		w.WriteHeader(fe.status)
+	}
+	if r.Method != "HEAD" {
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// putTemplate stores an index template, after checking that the body has the form
+// that the version expects.
+func (f *FakeElasticSearch) putTemplate(name string, r *http.Request, composable bool) error {
+	body, _ := ioutil.ReadAll(r.Body)
+	var template map[string]interface{}
+	err := json.Unmarshal(body, &template)
+	if err != nil {
+		return fakeError{400, "parse_exception", err.Error()}
+	}
+	// ElasticSearch 5 takes the pattern in "template", which is the body of the
+	// mappings and settings in composable templates
+	patternKey := "index_patterns"
+	if !composable && f.distribution == "elasticsearch" && f.major < 6 {
+		patternKey = "template"
+	}
+	if template[patternKey] == nil || (composable && template["template"] == nil) {
+		return badRequest("index template [%s] is missing [%s]", name, patternKey)
+	}
+	f.templates[name] = string(body)
+	return nil
+}
+
+// createIndex returns the mapping of an index, which is created with the keyword
+// subfield of the first index template that matches it, like ElasticSearch does for
+// the first document that is written to a missing index.
+func (f *FakeElasticSearch) createIndex(name, docType string) fakeIndex {
+	if index, exists := f.indices[name]; exists {
+		return index
+	}
+	index := fakeIndex{docType, "keyword"}
+	var templateNames []string
+	for templateName := range f.templates {
+		templateNames = append(templateNames, templateName)
+	}
+	sort.Strings(templateNames)
+	for _, templateName := range templateNames {
+		var template map[string]interface{}
+		json.Unmarshal([]byte(f.templates[templateName]), &template)
+		if !templateMatches(template, name) {
+			continue
+		}
+		if keyword := dynamicKeywordSubfield(template); keyword != "" {
+			index.keyword = keyword
+			break
+		}
+	}
+	f.indices[name] = index
+	return index
+}
+
+// templateMatches checks whether an index template applies to an index, by the
+// patterns in "index_patterns", or in "template" for ElasticSearch 5.
+func templateMatches(template map[string]interface{}, index string) bool {
+	var patterns []interface{}
+	switch p := template["index_patterns"].(type) {
+	case []interface{}:
+		patterns = p
+	case string:
+		patterns = []interface{}{p}
+	}
+	if p, ok := template["template"].(string); ok {
+		patterns = append(patterns, p)
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(fmt.Sprint(pattern), index); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dynamicKeywordSubfield finds the name of the keyword subfield that the dynamic
+// templates somewhere in the mappings of an index template give to new fields.
+func dynamicKeywordSubfield(value interface{}) string {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if dynamicTemplates, ok := object["dynamic_templates"].([]interface{}); ok {
+		for _, dynamicTemplate := range dynamicTemplates {
+			named, _ := dynamicTemplate.(map[string]interface{})
+			for _, body := range named {
+				body, _ := body.(map[string]interface{})
+				mapping, _ := body["mapping"].(map[string]interface{})
+				fields, _ := mapping["fields"].(map[string]interface{})
+				for name, field := range fields {
+					if field, ok := field.(map[string]interface{}); ok && field["type"] == "keyword" {
+						return name
+					}
+				}
+			}
+		}
+	}
+	var keys []string
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if keyword := dynamicKeywordSubfield(object[key]); keyword != "" {
+			return keyword
+		}
+	}
+	return ""
+}
+
+// fieldMappings answers _mapping/field requests with the fields that each of the
+// matching indices has, under the mapping type of the index up to ElasticSearch 6.
+func (f *FakeElasticSearch) fieldMappings(indices string, fields []string) interface{} {
+	result := make(map[string]interface{})
+	for name, index := range f.indices {
+		if !matchIndex(indices, name) {
+			continue
+		}
+		mappings := make(map[string]interface{})
+		for _, field := range fields {
+			kind := fieldKind(field, index.keyword)
+			if kind == "" {
+				continue
+			}
+			leaf := field[strings.LastIndex(field, ".")+1:]
+			mappings[field] = map[string]interface{}{
+				"full_name": field,
+				"mapping":   map[string]interface{}{leaf: map[string]interface{}{"type": kind}},
+			}
+		}
+		if f.hasTypes() {
+			mappings = map[string]interface{}{index.docType: mappings}
+		}
+		result[name] = map[string]interface{}{"mappings": mappings}
+	}
+	return result
+}
+
+func (f *FakeElasticSearch) bulk(r *http.Request) (interface{}, error) {
+	var items []interface{}
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var action map[string]struct {
+			Index string `json:"_index"`
+			Type  string `json:"_type"`
+			ID    string `json:"_id"`
+		}
+		err := json.Unmarshal(scanner.Bytes(), &action)
+		if err != nil {
+			return nil, badRequest("malformed action: %s", err.Error())
+		}
+		op := "index"
+		meta, ok := action[op]
+		if !ok {
+			op = "create"
+			meta, ok = action[op]
+		}
+		if !ok || !scanner.Scan() {
+			return nil, badRequest("only index and create actions with a document are implemented by the fake")
+		}
+		switch {
+		case f.typesRemoved() && meta.Type != "":
+			return nil, badRequest("Action/metadata line [1] contains an unknown parameter [_type]")
+		case f.hasTypes() && meta.Type == "":
+			return nil, fakeError{400, "action_request_validation_exception", "Validation Failed: 1: type is missing;"}
+		case !f.hasTypes() && !f.typesRemoved():
+			meta.Type = "_doc"
+		}
+		raw := json.RawMessage(append([]byte(nil), scanner.Bytes()...))
+		var source map[string]interface{}
+		err = json.Unmarshal(raw, &source)
+		if err != nil {
+			items = append(items, map[string]interface{}{op: map[string]interface{}{
+				"_index": meta.Index, "_id": meta.ID, "status": 400,
+				"error": map[string]interface{}{"type": "mapper_parsing_exception", "reason": "failed to parse"},
+			}})
+			continue
+		}
+		if meta.ID == "" {
+			meta.ID = fmt.Sprintf("generated-%d", len(f.documents))
+		}
+		key := meta.Index + "/" + meta.ID
+		status := 201
+		if _, exists := f.documents[key]; exists {
+			status = 200
+			if op == "create" {
+				items = append(items, map[string]interface{}{op: map[string]interface{}{
+					"_index": meta.Index, "_id": meta.ID, "status": 409,
+					"error": map[string]interface{}{"type": "version_conflict_engine_exception", "reason": "document already exists"},
+				}})
+				continue
+			}
+		}
+		index := f.createIndex(meta.Index, meta.Type)
+		f.documents[key] = fakeDocument{meta.Index, meta.Type, meta.ID, index.keyword, source, raw}
+		item := map[string]interface{}{"_index": meta.Index, "_id": meta.ID, "status": status}
+		if meta.Type != "" {
+			item["_type"] = meta.Type
+		}
+		items = append(items, map[string]interface{}{op: item})
+	}
+	return map[string]interface{}{"took": 1, "errors": false, "items": items}, scanner.Err()
+}
+
+type fakeSortField struct {
+	field     string
+	ascending bool
+}
+
+// maxInitialLineLength is the default limit of ElasticSearch on the length of the request line.
+const maxInitialLineLength = 4096
+
+// multiSearch runs the searches of a _msearch request, whose header lines name the
+// indices, and returns their results or errors in the same order.
+func (f *FakeElasticSearch) multiSearch(r *http.Request) (interface{}, error) {
+	var responses []interface{}
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var header struct {
+			Index interface{} `json:"index"`
+		}
+		err := json.Unmarshal(scanner.Bytes(), &header)
+		if err != nil {
+			return nil, fakeError{400, "parse_exception", err.Error()}
+		}
+		var indices []string
+		switch index := header.Index.(type) {
+		case string:
+			indices = []string{index}
+		case []interface{}:
+			for _, i := range index {
+				indices = append(indices, fmt.Sprint(i))
+			}
+		}
+		if !scanner.Scan() {
+			return nil, badRequest("The msearch request must be terminated by a newline [\\n]")
+		}
+		result, err := f.search(strings.Join(indices, ","), append([]byte(nil), scanner.Bytes()...))
+		if err != nil {
+			fe, ok := err.(fakeError)
+			if !ok {
+				fe = fakeError{500, "exception", err.Error()}
+			}
+			result = map[string]interface{}{
+				"error":  map[string]interface{}{"type": fe.errType, "reason": fe.reason},
+				"status": fe.status,
+			}
+		}
+		responses = append(responses, result)
+	}
+	return map[string]interface{}{"responses": responses}, nil
+}
+
+func (f *FakeElasticSearch) search(indices string, body []byte) (interface{}, error) {
+	var request struct {
+		Query        map[string]interface{}            `json:"query"`
+		From         *int                              `json:"from"`
+		Size         *int                              `json:"size"`
+		Sort         []map[string]map[string]string    `json:"sort"`
+		SearchAfter  []interface{}                     `json:"search_after"`
+		Aggregations map[string]map[string]interface{} `json:"aggregations"`
+		// Only understood since ElasticSearch 6; all hits are counted by the fake anyway
+		TrackTotalHits interface{} `json:"track_total_hits"`
+	}
+	if len(body) > 0 {
+		err := json.Unmarshal(body, &request)
+		if err != nil {
+			return nil, fakeError{400, "parsing_exception", err.Error()}
+		}
+	}
+	if request.TrackTotalHits != nil && f.distribution == "elasticsearch" && f.major < 6 {
+		return nil, fakeError{400, "parsing_exception", "Unknown key for a VALUE_BOOLEAN in [track_total_hits]."}
+	}
+
+	var hits []fakeDocument
+	for _, doc := range f.documents {
+		if !matchIndex(indices, doc.index) {
+			continue
+		}
+		ok, err := matchQuery(doc, request.Query)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			hits = append(hits, doc)
+		}
+	}
+
+	var searched []fakeIndex
+	for name, index := range f.indices {
+		if matchIndex(indices, name) {
+			searched = append(searched, index)
+		}
+	}
+	var sortFields []fakeSortField
+	for _, s := range request.Sort {
+		for field, options := range s {
+			mapped, err := checkDocValues(field, searched)
+			if err != nil {
+				return nil, err
+			}
+			if !mapped && len(searched) > 0 {
+				return nil, fakeError{400, "search_phase_execution_exception", fmt.Sprintf("No mapping found for [%s] in order to sort on", field)}
+			}
+			sortFields = append(sortFields, fakeSortField{field, options["order"] != "desc"})
+		}
+	}
+	// ElasticSearch orders by score if no sort is given; this fake orders by ID instead
+	sortFields = append(sortFields, fakeSortField{"_id", true})
+	sortValues := func(doc fakeDocument) []interface{} {
+		var values []interface{}
+		for _, s := range sortFields[:len(sortFields)-1] {
+			values = append(values, sortValue(doc, s.field))
+		}
+		return append(values, doc.id)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return compareSortValues(sortValues(hits[i]), sortValues(hits[j]), sortFields) < 0
+	})
+
+	total := len(hits)
+	aggregations := make(map[string]interface{})
+	for name, agg := range request.Aggregations {
+		result, err := f.aggregation(hits, agg, searched)
+		if err != nil {
+			return nil, err
+		}
+		aggregations[name] = result
+	}
+
+	if request.SearchAfter != nil {
+		after := request.SearchAfter
+		if len(after) != len(sortFields)-1 {
+			return nil, badRequest("search_after has %d value(s) but sort has %d", len(after), len(sortFields)-1)
+		}
+		start := len(hits)
+		for i, doc := range hits {
+			values := sortValues(doc)
+			if compareSortValues(values[:len(after)], after, sortFields) > 0 {
+				start = i
+				break
+			}
+		}
+		hits = hits[start:]
+	} else if request.From != nil {
+		if *request.From > len(hits) {
+			hits = nil
+		} else {
+			hits = hits[*request.From:]
+		}
+	}
+	size := 10
+	if request.Size != nil {
+		size = *request.Size
+	}
+	if len(hits) > size {
+		hits = hits[:size]
+	}
+
+	resultHits := []interface{}{}
+	for _, doc := range hits {
+		values := sortValues(doc)
+		hit := map[string]interface{}{
+			"_index": doc.index, "_id": doc.id,
+			"_score": nil, "_source": doc.raw,
+		}
+		if doc.docType != "" {
+			hit["_type"] = doc.docType
+		}
+		if len(request.Sort) > 0 {
+			hit["sort"] = values[:len(values)-1]
+		}
+		resultHits = append(resultHits, hit)
+	}
+	var totalHits interface{} = total
+	if !f.hasTypes() {
+		totalHits = map[string]interface{}{"value": total, "relation": "eq"}
+	}
+	result := map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"hits":      map[string]interface{}{"total": totalHits, "max_score": nil, "hits": resultHits},
+	}
+	if len(aggregations) > 0 {
+		result["aggregations"] = aggregations
+	}
+	return result, nil
+}
+
+func matchIndex(patterns, index string) bool {
+	if patterns == "" || patterns == "_all" {
+		return true
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		if ok, _ := path.Match(pattern, index); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldKind returns how an index with the given keyword subfield maps a field:
+// "date", "keyword", "text", or "" for a subfield that the index does not have.
+func fieldKind(field, keyword string) string {
+	switch {
+	case field == "@timestamp" || field == "payload.eventTime":
+		return "date"
+	case field == "_id" || strings.HasSuffix(field, "."+keyword):
+		return "keyword"
+	case strings.HasSuffix(field, ".raw") || strings.HasSuffix(field, ".keyword"):
+		return ""
+	}
+	return "text"
+}
+
+// checkDocValues checks that none of the searched indices maps a field as text, which
+// cannot be used for sorting and aggregations, and reports whether any of them has it.
+func checkDocValues(field string, indices []fakeIndex) (bool, error) {
+	mapped := false
+	for _, index := range indices {
+		switch fieldKind(field, index.keyword) {
+		case "text":
+			return false, badRequest("Fielddata is disabled on text fields by default. Set fielddata=true on [%s] in order to load fielddata in memory by uninverting the inverted index.", field)
+		case "":
+		default:
+			mapped = true
+		}
+	}
+	return mapped, nil
+}
+
+// fieldValue returns the value of a (possibly nested) field of a document as string.
+func fieldValue(doc fakeDocument, field string) (string, bool) {
+	switch fieldKind(field, doc.keyword) {
+	case "":
+		return "", false
+	case "keyword":
+		field = strings.TrimSuffix(field, "."+doc.keyword)
+	}
+	var value interface{} = doc.source
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		value, ok = object[key]
+		if !ok || value == nil {
+			return "", false
+		}
+	}
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+	return fmt.Sprint(value), true
+}
+
+// Formats of the date fields, as mapped by the index template
+var fakeDateFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"2006-01-02T15:04:05.999999-0700",
+}
+
+func parseDate(value string) (time.Time, error) {
+	for _, format := range fakeDateFormats {
+		t, err := time.Parse(format, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fakeError{400, "parse_exception", fmt.Sprintf("failed to parse date field [%s]", value)}
+}
+
+// sortValue returns the value of a field as ElasticSearch reports it in the sort
+// values of a hit: dates as milliseconds since the epoch, keywords as strings.
+func sortValue(doc fakeDocument, field string) interface{} {
+	value, ok := fieldValue(doc, field)
+	if !ok {
+		return nil
+	}
+	if fieldKind(field, doc.keyword) == "date" {
+		t, err := parseDate(value)
+		if err != nil {
+			return nil
+		}
+		return float64(t.UnixNano() / int64(time.Millisecond))
+	}
+	return value
+}
+
+func compareSortValues(a, b []interface{}, fields []fakeSortField) int {
+	for i := range a {
+		c := compareValues(a[i], b[i])
+		if c != 0 {
+			// missing values come last in either order
+			if a[i] == nil || b[i] == nil || fields[i].ascending {
+				return c
+			}
+			return -c
+		}
+	}
+	return 0
+}
+
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	af, aIsNumber := toFloat(a)
+	bf, bIsNumber := toFloat(b)
+	if aIsNumber && bIsNumber {
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// analyze splits text into lowercase terms, roughly like the standard analyzer does.
+func analyze(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.'
+	})
+}
+
+func matchQueries(doc fakeDocument, clauses interface{}, all bool) (bool, error) {
+	list, ok := clauses.([]interface{})
+	if !ok {
+		list = []interface{}{clauses}
+	}
+	for _, clause := range list {
+		query, ok := clause.(map[string]interface{})
+		if !ok {
+			return false, fakeError{400, "parsing_exception", "malformed query clause"}
+		}
+		matched, err := matchQuery(doc, query)
+		if err != nil {
+			return false, err
+		}
+		if matched != all {
+			return matched, nil
+		}
+	}
+	return all, nil
+}
+
+// fieldQuery splits {"field": options} into the field name and its options.
+func fieldQuery(body interface{}) (string, interface{}, error) {
+	object, ok := body.(map[string]interface{})
+	if ok {
+		for field, options := range object {
+			if !strings.HasPrefix(field, "_") {
+				return field, options, nil
+			}
+		}
+	}
+	return "", nil, fakeError{400, "parsing_exception", "query has no field"}
+}
+
+func matchQuery(doc fakeDocument, query map[string]interface{}) (bool, error) {
+	if len(query) == 0 {
+		return true, nil
+	}
+	for queryType, body := range query {
+		switch queryType {
+		case "match_all":
+			return true, nil
+		case "bool":
+			clauses, _ := body.(map[string]interface{})
+			for _, occur := range []string{"must", "filter"} {
+				if clauses[occur] != nil {
+					ok, err := matchQueries(doc, clauses[occur], true)
+					if !ok || err != nil {
+						return false, err
+					}
+				}
+			}
+			if clauses["must_not"] != nil {
+				ok, err := matchQueries(doc, clauses["must_not"], false)
+				if ok || err != nil {
+					return false, err
+				}
+			}
+			if clauses["should"] != nil {
+				return matchQueries(doc, clauses["should"], false)
+			}
+			return true, nil
+		case "match":
+			field, options, err := fieldQuery(body)
+			if err != nil {
+				return false, err
+			}
+			text, matchType := options, ""
+			if object, ok := options.(map[string]interface{}); ok {
+				text = object["query"]
+				matchType, _ = object["type"].(string)
+			}
+			value, ok := fieldValue(doc, field)
+			if !ok {
+				return false, nil
+			}
+			return matchText(value, fmt.Sprint(text), fieldKind(field, doc.keyword), matchType), nil
+		case "match_phrase", "match_phrase_prefix":
+			field, options, err := fieldQuery(body)
+			if err != nil {
+				return false, err
+			}
+			text := options
+			if object, ok := options.(map[string]interface{}); ok {
+				text = object["query"]
+			}
+			value, ok := fieldValue(doc, field)
+			if !ok {
+				return false, nil
+			}
+			return matchText(value, fmt.Sprint(text), fieldKind(field, doc.keyword), strings.TrimPrefix(queryType, "match_")), nil
+		case "term", "prefix":
+			field, options, err := fieldQuery(body)
+			if err != nil {
+				return false, err
+			}
+			if object, ok := options.(map[string]interface{}); ok {
+				options = object["value"]
+			}
+			expected := fmt.Sprint(options)
+			value, ok := fieldValue(doc, field)
+			if !ok {
+				return false, nil
+			}
+			if queryType == "term" {
+				return value == expected, nil
+			}
+			return strings.HasPrefix(value, expected), nil
+		case "wildcard":
+			field, options, err := fieldQuery(body)
+			if err != nil {
+				return false, err
+			}
+			if object, ok := options.(map[string]interface{}); ok {
+				options = object["value"]
+			}
+			value, ok := fieldValue(doc, field)
+			if !ok {
+				return false, nil
+			}
+			return matchWildcard(value, fmt.Sprint(options)), nil
+		case "terms":
+			field, options, err := fieldQuery(body)
+			if err != nil {
+				return false, err
+			}
+			values, _ := options.([]interface{})
+			value, ok := fieldValue(doc, field)
+			for _, expected := range values {
+				if ok && value == fmt.Sprint(expected) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case "range":
+			return matchRange(doc, body)
+		default:
+			return false, fakeError{400, "parsing_exception", fmt.Sprintf("no [query] registered for [%s] in the fake", queryType)}
+		}
+	}
+	return false, nil
+}
+
+// matchText evaluates a match query on a field of the given kind.
+func matchText(value, text, kind, matchType string) bool {
+	if kind == "keyword" {
+		return value == text
+	}
+	terms, queryTerms := analyze(value), analyze(text)
+	if len(queryTerms) == 0 {
+		return false
+	}
+	if matchType != "phrase" && matchType != "phrase_prefix" {
+		// boolean match: any of the terms
+		for _, qt := range queryTerms {
+			for _, t := range terms {
+				if t == qt {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	last := len(queryTerms) - 1
+	for start := 0; start+len(queryTerms) <= len(terms); start++ {
+		matched := true
+		for i, qt := range queryTerms {
+			t := terms[start+i]
+			if t != qt && !(i == last && matchType == "phrase_prefix" && strings.HasPrefix(t, qt)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcard evaluates a wildcard pattern, where "*" matches any sequence of characters,
+// "?" matches a single character, and a backslash escapes the next character.
+func matchWildcard(value, pattern string) bool {
+	var rx strings.Builder
+	rx.WriteString("^(?s:")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*':
+			rx.WriteString(".*")
+		case c == '?':
+			rx.WriteString(".")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			rx.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			rx.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	rx.WriteString(")$")
+	return regexp.MustCompile(rx.String()).MatchString(value)
+}
+
+func matchRange(doc fakeDocument, body interface{}) (bool, error) {
+	field, options, err := fieldQuery(body)
+	if err != nil {
+		return false, err
+	}
+	params, _ := options.(map[string]interface{})
+	bounds := map[string]interface{}{}
+	for _, op := range []string{"gt", "gte", "lt", "lte"} {
+		if params[op] != nil {
+			bounds[op] = params[op]
+		}
+	}
+	// the form generated by the Go client
+	includeLower, includeUpper := params["include_lower"] != false, params["include_upper"] != false
+	if params["from"] != nil {
+		bounds[map[bool]string{true: "gte", false: "gt"}[includeLower]] = params["from"]
+	}
+	if params["to"] != nil {
+		bounds[map[bool]string{true: "lte", false: "lt"}[includeUpper]] = params["to"]
+	}
+
+	value, ok := fieldValue(doc, field)
+	if !ok {
+		return false, nil
+	}
+	for op, bound := range bounds {
+		var c int
+		if fieldKind(field, doc.keyword) == "date" {
+			t, err := parseDate(value)
+			if err != nil {
+				return false, nil
+			}
+			b, err := parseDate(fmt.Sprint(bound))
+			if err != nil {
+				return false, err
+			}
+			c = compareValues(float64(t.UnixNano()), float64(b.UnixNano()))
+		} else {
+			c = strings.Compare(value, fmt.Sprint(bound))
+		}
+		switch {
+		case op == "gt" && c <= 0, op == "gte" && c < 0, op == "lt" && c >= 0, op == "lte" && c > 0:
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// aggregation evaluates an aggregation, including the aggregations nested in it, on
+// hits from the searched indices.
+func (f *FakeElasticSearch) aggregation(hits []fakeDocument, agg map[string]interface{}, indices []fakeIndex) (map[string]interface{}, error) {
+	var result map[string]interface{}
+	var buckets [][]fakeDocument
+	var err error
+	if terms, ok := agg["terms"].(map[string]interface{}); ok {
+		result, buckets, err = termsAggregation(hits, terms, indices)
+	} else if histogram, ok := agg["date_histogram"].(map[string]interface{}); ok {
+		result, buckets, err = f.dateHistogramAggregation(hits, histogram)
+	} else {
+		return nil, badRequest("only terms and date_histogram aggregations are implemented by the fake")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	subAggs, _ := agg["aggregations"].(map[string]interface{})
+	if subAggs == nil {
+		subAggs, _ = agg["aggs"].(map[string]interface{})
+	}
+	for name, subAgg := range subAggs {
+		subAgg, ok := subAgg.(map[string]interface{})
+		if !ok {
+			return nil, badRequest("invalid aggregation [%s]", name)
+		}
+		for i, bucket := range result["buckets"].([]interface{}) {
+			subResult, err := f.aggregation(buckets[i], subAgg, indices)
+			if err != nil {
+				return nil, err
+			}
+			bucket.(map[string]interface{})[name] = subResult
+		}
+	}
+	return result, nil
+}
+
+// termsAggregation evaluates a terms aggregation, whose buckets are ordered by
+// descending count and then by key, like ElasticSearch does. It also returns the
+// documents of each bucket. Like in ElasticSearch, a field that none of the indices
+// has yields no buckets.
+func termsAggregation(hits []fakeDocument, terms map[string]interface{}, indices []fakeIndex) (map[string]interface{}, [][]fakeDocument, error) {
+	field, _ := terms["field"].(string)
+	if _, err := checkDocValues(field, indices); err != nil {
+		return nil, nil, err
+	}
+	size := 10
+	if s, ok := terms["size"].(float64); ok {
+		size = int(s)
+	}
+
+	counts := make(map[string]int)
+	docs := make(map[string][]fakeDocument)
+	for _, doc := range hits {
+		if value, ok := fieldValue(doc, field); ok {
+			counts[value]++
+			docs[value] = append(docs[value], doc)
+		}
+	}
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	other := 0
+	if len(keys) > size {
+		for _, key := range keys[size:] {
+			other += counts[key]
+		}
+		keys = keys[:size]
+	}
+	buckets := []interface{}{}
+	var bucketDocs [][]fakeDocument
+	for _, key := range keys {
+		buckets = append(buckets, map[string]interface{}{"key": key, "doc_count": counts[key]})
+		bucketDocs = append(bucketDocs, docs[key])
+	}
+	return map[string]interface{}{
+		"doc_count_error_upper_bound": 0,
+		"sum_other_doc_count":         other,
+		"buckets":                     buckets,
+	}, bucketDocs, nil
+}
+
+// Units of the fixed intervals of date_histogram aggregations
+var fakeIntervalUnits = map[string]time.Duration{
+	"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour,
+}
+
+var fakeIntervalRx = regexp.MustCompile(`^([0-9]+)(ms|s|m|h|d)$`)
+
+// dateHistogramAggregation evaluates a date_histogram aggregation with a fixed interval,
+// whose buckets are ordered by time and keyed by their start in milliseconds since the
+// epoch. Like before ElasticSearch 7.2, the interval is given as "interval"; since then,
+// as "fixed_interval", and ElasticSearch 8 does not accept "interval" anymore.
+func (f *FakeElasticSearch) dateHistogramAggregation(hits []fakeDocument, histogram map[string]interface{}) (map[string]interface{}, [][]fakeDocument, error) {
+	hasFixedInterval := f.distribution == "opensearch" || f.major > 7 || (f.major == 7 && f.minor >= 2)
+	hasInterval := f.distribution == "opensearch" || f.major < 8
+	var interval string
+	switch {
+	case histogram["fixed_interval"] != nil && hasFixedInterval:
+		interval, _ = histogram["fixed_interval"].(string)
+	case histogram["interval"] != nil && hasInterval:
+		interval, _ = histogram["interval"].(string)
+	default:
+		return nil, nil, badRequest("Required one of fields [interval, fixed_interval], but none were specified.")
+	}
+	match := fakeIntervalRx.FindStringSubmatch(interval)
+	if match == nil {
+		return nil, nil, badRequest("failed to parse setting [date_histogram.interval] with value [%s]", interval)
+	}
+	n, _ := strconv.Atoi(match[1])
+	step := int64(time.Duration(n)*fakeIntervalUnits[match[2]]) / int64(time.Millisecond)
+	if step <= 0 {
+		return nil, nil, badRequest("Zero or negative time interval not supported")
+	}
+	field, _ := histogram["field"].(string)
+	if kind := fieldKind(field, ""); kind != "date" {
+		return nil, nil, badRequest("Field [%s] of type [%s] is not supported for aggregation [date_histogram]", field, kind)
+	}
+	minDocCount := 0
+	if m, ok := histogram["min_doc_count"].(float64); ok {
+		minDocCount = int(m)
+	}
+
+	docs := make(map[int64][]fakeDocument)
+	var keys []int64
+	for _, doc := range hits {
+		value, ok := sortValue(doc, field).(float64)
+		if !ok {
+			continue
+		}
+		ms := int64(value)
+		key := ms - ms%step
+		if ms%step < 0 {
+			key -= step
+		}
+		if _, exists := docs[key]; !exists {
+			keys = append(keys, key)
+		}
+		docs[key] = append(docs[key], doc)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	if minDocCount == 0 && len(keys) > 0 {
+		// fill the gaps with empty buckets
+		var all []int64
+		for key := keys[0]; key <= keys[len(keys)-1]; key += step {
+			all = append(all, key)
+		}
+		keys = all
+	}
+	buckets := []interface{}{}
+	var bucketDocs [][]fakeDocument
+	for _, key := range keys {
+		if len(docs[key]) < minDocCount {
+			continue
+		}
+		buckets = append(buckets, map[string]interface{}{
+			"key":           key,
+			"key_as_string": time.Unix(0, key*int64(time.Millisecond)).UTC().Format("2006-01-02T15:04:05.000Z"),
+			"doc_count":     len(docs[key]),
+		})
+		bucketDocs = append(bucketDocs, docs[key])
+	}
+	return map[string]interface{}{"buckets": buckets}, bucketDocs, nil
+}
@@ -0,0 +1,696 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+// Package storagetest contains the conformance test suite for implementations
+// of storage.Storage. The suite describes the behavior of the ElasticSearch
+// driver, which all other drivers need to reproduce, so that the API behaves
+// the same no matter where the events are stored.
+//
+// A driver's test calls Run with a function that returns a new, empty storage:
+//
+//	func Test_Conformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage {
+//			return storage.NewMemory()
+//		})
+//	}
+package storagetest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new, empty storage.
+type Factory func(t *testing.T) storage.Storage
+
+// Run runs every check of the suite on a new storage from the factory.
+func Run(t *testing.T, newStorage Factory) {
+	checks := []struct {
+		name  string
+		check func(*testing.T, storage.Storage)
+	}{
+		{"TenantIsolation", checkTenantIsolation},
+		{"IncludeTenants", checkIncludeTenants},
+		{"Filters", checkFilters},
+		{"Query", checkQuery},
+		{"Sort", checkSort},
+		{"Paging", checkPaging},
+		{"Attributes", checkAttributes},
+		{"Facets", checkFacets},
+		{"Histogram", checkHistogram},
+		{"Top", checkTop},
+		{"Write", checkWrite},
+	}
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			s := newStorage(t)
+			Seed(t, s)
+			c.check(t, s)
+		})
+	}
+}
+
+// Tenants of the corpus
+const (
+	ProjectA = "project-a"
+	ProjectB = "project-b"
+	DomainC  = "domain-c"
+)
+
+// corpusEvent describes an event of the corpus. The keys double as CADF event IDs,
+// and "msg-" plus the key is the message ID, which the API uses as event ID.
+type corpusEvent struct {
+	key, tenant, eventType, publisher, targetType, targetId, userId, eventTime string
+}
+
+// The corpus contains events with distinct times, so that the default sort order is
+// unambiguous. Values that are compared while sorting differ in their first letter,
+// so that the order does not depend on the collation of SQL databases.
+var corpus = []corpusEvent{
+	{"a1", ProjectA, "identity.project.created", "identity.keystone-1", "data/security/project", "proj-1", "user-alice", "2017-05-01T10:00:00.000000+0000"},
+	{"a2", ProjectA, "identity.project.deleted", "identity.keystone-1", "data/security/project", "proj-1", "user-alice", "2017-05-01T11:00:00.000000+0000"},
+	{"a3", ProjectA, "identity.role_assignment.created", "identity.keystone-1", "data/security/account/user", "user-bob", "user-admin", "2017-05-01T12:00:00.000000+0000"},
+	{"a4", ProjectA, "compute.instance.create.end", "compute.nova-1", "compute/server", "server-1", "user-bob", "2017-05-02T08:00:00.000000+0000"},
+	{"a5", ProjectA, "compute.instance.delete.end", "compute.nova-1", "compute/server", "server-1", "user-bob", "2017-05-02T09:00:00.000000+0000"},
+	{"a6", ProjectA, "dns.zone.create", "designate.central", "service/dns/zone", "zone-1", "user-carol", "2017-05-03T07:30:00.000000+0000"},
+	{"b1", ProjectB, "identity.project.created", "identity.keystone-1", "data/security/project", "proj-2", "user-dave", "2017-05-01T10:30:00.000000+0000"},
+	{"b2", ProjectB, "compute.instance.create.end", "compute.nova-1", "compute/server", "server-2", "user-dave", "2017-05-02T08:30:00.000000+0000"},
+	{"c1", DomainC, "identity.domain.updated", "identity.keystone-1", "data/security/domain", "domain-c", "user-admin", "2017-05-01T09:00:00.000000+0000"},
+}
+
+// Addresses of the users' hosts
+var corpusAddresses = map[string]string{
+	"user-alice": "10.0.0.1",
+	"user-bob":   "10.0.1.2",
+	"user-carol": "10.0.0.130",
+	"user-dave":  "2001:db8::1",
+	"user-admin": "192.168.0.1",
+}
+
+// Observers by publisher
+var corpusObservers = map[string][2]string{
+	"identity.keystone-1": {"service/security", "keystone-1"},
+	"compute.nova-1":      {"service/compute", "nova-1"},
+	"designate.central":   {"service/dns", "designate-central"},
+}
+
+func (c corpusEvent) event() *storage.EventDetail {
+	var event storage.EventDetail
+	event.PublisherID = c.publisher
+	event.EventType = c.eventType
+	event.MessageID = "msg-" + c.key
+	event.Priority = "info"
+	p := &event.Payload
+	p.ID = c.key
+	p.TypeURI = "http://schemas.dmtf.org/cloud/audit/1.0/event"
+	p.EventType = "activity"
+	p.EventTime = c.eventTime
+	p.Outcome = "success"
+	if c.key == "a5" {
+		p.Outcome = "failure"
+	}
+	for _, action := range []string{"create", "update", "delete"} {
+		if strings.Contains(c.eventType, "."+action) {
+			p.Action = action
+		}
+	}
+	p.Observer.TypeURI = corpusObservers[c.publisher][0]
+	p.Observer.ID = corpusObservers[c.publisher][1]
+	p.Initiator.Host.Address = corpusAddresses[c.userId]
+	p.Initiator.TypeURI = "service/security/account/user"
+	p.Initiator.UserID = c.userId
+	if c.tenant == DomainC {
+		p.Initiator.DomainID = c.tenant
+	} else {
+		p.Initiator.ProjectID = c.tenant
+	}
+	p.Target.TypeURI = c.targetType
+	p.Target.ID = c.targetId
+	return &event
+}
+
+// Corpus returns the events that Seed writes.
+func Corpus() []storage.TenantEvent {
+	var events []storage.TenantEvent
+	for _, c := range corpus {
+		events = append(events, storage.TenantEvent{TenantID: c.tenant, Event: c.event()})
+	}
+	return events
+}
+
+// Seed writes the corpus into the storage.
+func Seed(t *testing.T, s storage.Storage) {
+	require.Nil(t, s.WriteEvents(Corpus()))
+}
+
+// keys returns the corpus keys (i.e. the CADF event IDs) of the events on a page.
+func keys(page *storage.EventPage) []string {
+	result := []string{}
+	for _, event := range page.Events {
+		result = append(result, event.Payload.ID)
+	}
+	return result
+}
+
+func getKeys(t *testing.T, s storage.Storage, filter storage.Filter, tenantId string) []string {
+	if filter.Limit == 0 {
+		filter.Limit = 100
+	}
+	page, err := s.GetEvents(&filter, tenantId)
+	require.Nil(t, err, fmt.Sprintf("%+v", filter))
+	assert.Equal(t, len(page.Events), page.Total, "all events should fit on the page: %+v", filter)
+	return keys(page)
+}
+
+func checkTenantIsolation(t *testing.T, s storage.Storage) {
+	// An empty tenant ID means all tenants
+	totals := map[string]int{"": 9, ProjectA: 6, ProjectB: 2, DomainC: 1, "project-x": 0}
+	for tenantId, total := range totals {
+		page, err := s.GetEvents(&storage.Filter{Limit: 10}, tenantId)
+		require.Nil(t, err)
+		assert.Equal(t, total, page.Total, "tenant \"%s\"", tenantId)
+		for _, event := range page.Events {
+			tenant := event.Payload.Initiator.ProjectID + event.Payload.Initiator.DomainID
+			if tenantId != "" {
+				assert.Equal(t, tenantId, tenant)
+			}
+			// Each event is returned with the tenant that it belongs to, also when searching all tenants
+			assert.Equal(t, tenant, event.TenantID)
+		}
+	}
+
+	event, err := s.GetEvent("msg-b1", ProjectB)
+	require.Nil(t, err)
+	require.NotNil(t, event)
+	assert.Equal(t, "b1", event.Payload.ID)
+	assert.Equal(t, ProjectB, event.TenantID)
+	assert.Equal(t, "identity.project.created", event.EventType)
+	assert.Equal(t, "2017-05-01T10:30:00.000000+0000", event.Payload.EventTime)
+
+	event, err = s.GetEvent("msg-b1", "")
+	require.Nil(t, err)
+	assert.NotNil(t, event)
+
+	event, err = s.GetEvent("msg-b1", ProjectA)
+	assert.Nil(t, err)
+	assert.Nil(t, event, "events must not be visible to other tenants")
+
+	event, err = s.GetEvent("b1", ProjectB)
+	assert.Nil(t, err)
+	assert.Nil(t, event, "events are identified by their message ID")
+}
+
+func checkIncludeTenants(t *testing.T, s storage.Storage) {
+	filter := storage.Filter{Limit: 10, IncludeTenants: []string{ProjectB, "project-x"}}
+	page, err := s.GetEvents(&filter, DomainC)
+	require.Nil(t, err)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, []string{"b2", "b1", "c1"}, keys(page))
+	// Each event is returned with the tenant that it belongs to
+	tenants := map[string]string{}
+	for _, event := range page.Events {
+		tenants[event.Payload.ID] = event.TenantID
+	}
+	assert.Equal(t, map[string]string{"b2": ProjectB, "b1": ProjectB, "c1": DomainC}, tenants)
+
+	// The other filters still apply
+	filter = storage.Filter{Source: storage.Values("identity"), IncludeTenants: []string{ProjectA}}
+	assert.Equal(t, []string{"a3", "a2", "a1", "c1"}, getKeys(t, s, filter, DomainC))
+}
+
+func checkFilters(t *testing.T, s storage.Storage) {
+	tests := []struct {
+		filter   storage.Filter
+		expected []string
+	}{
+		// Source and EventType match phrase prefixes of event_type, ignoring case
+		{storage.Filter{Source: storage.Values("identity")}, []string{"a3", "a2", "a1"}},
+		{storage.Filter{Source: storage.Values("IDENTITY")}, []string{"a3", "a2", "a1"}},
+		{storage.Filter{Source: storage.Values("ident")}, []string{"a3", "a2", "a1"}},
+		{storage.Filter{Source: storage.Values("project")}, []string{}},
+		{storage.Filter{EventType: storage.Values("identity.project")}, []string{"a2", "a1"}},
+		{storage.Filter{EventType: storage.Values("identity.project.created")}, []string{"a1"}},
+		{storage.Filter{EventType: storage.Values("identity.role_")}, []string{"a3"}},
+		{storage.Filter{EventType: storage.Values("project.created")}, []string{}},
+		// ResourceType matches phrase prefixes of the target typeURI, whose terms are separated by slashes
+		{storage.Filter{ResourceType: storage.Values("data/security")}, []string{"a3", "a2", "a1"}},
+		{storage.Filter{ResourceType: storage.Values("security/project")}, []string{"a2", "a1"}},
+		{storage.Filter{ResourceType: storage.Values("compute/serv")}, []string{"a5", "a4"}},
+		{storage.Filter{ResourceType: storage.Values("account")}, []string{"a3"}},
+		{storage.Filter{ResourceType: storage.Values("urity")}, []string{}},
+		// ResourceId matches the target ID exactly
+		{storage.Filter{ResourceId: storage.Values("server-1")}, []string{"a5", "a4"}},
+		{storage.Filter{ResourceId: storage.Values("server")}, []string{}},
+		{storage.Filter{ResourceId: storage.Values("SERVER-1")}, []string{}},
+		// UserId matches prefixes of the initiator's user ID, respecting case
+		{storage.Filter{UserId: storage.Values("user-b")}, []string{"a5", "a4"}},
+		{storage.Filter{UserId: storage.Values("user-bob")}, []string{"a5", "a4"}},
+		{storage.Filter{UserId: storage.Values("USER-B")}, []string{}},
+		// Time ranges apply to the event time
+		{storage.Filter{Time: map[string]string{"gte": "2017-05-02T00:00:00"}}, []string{"a6", "a5", "a4"}},
+		{storage.Filter{Time: map[string]string{"lt": "2017-05-01T11:00:00"}}, []string{"a1"}},
+		{storage.Filter{Time: map[string]string{"lte": "2017-05-01T11:00:00"}}, []string{"a2", "a1"}},
+		{storage.Filter{Time: map[string]string{"gt": "2017-05-01T11:00:00", "lte": "2017-05-02T08:00:00"}}, []string{"a4", "a3"}},
+		{storage.Filter{Time: map[string]string{"gt": "2017-05-01T13:00:00.000000+0200"}}, []string{"a6", "a5", "a4", "a3"}},
+		// Outcome, Action and the IDs of the initiator and observer match exactly
+		{storage.Filter{Outcome: storage.Values("failure")}, []string{"a5"}},
+		{storage.Filter{Outcome: storage.Values("fail")}, []string{}},
+		{storage.Filter{Action: storage.Values("create")}, []string{"a6", "a4", "a3", "a1"}},
+		{storage.Filter{Action: storage.Values("delete")}, []string{"a5", "a2"}},
+		{storage.Filter{InitiatorProjectId: storage.Values(ProjectA)}, []string{"a6", "a5", "a4", "a3", "a2", "a1"}},
+		{storage.Filter{InitiatorProjectId: storage.Values("project")}, []string{}},
+		{storage.Filter{InitiatorDomainId: storage.Values(DomainC)}, []string{}},
+		{storage.Filter{ObserverId: storage.Values("nova-1")}, []string{"a5", "a4"}},
+		{storage.Filter{ObserverId: storage.Values("nova")}, []string{}},
+		// ObserverType matches phrase prefixes like ResourceType
+		{storage.Filter{ObserverType: storage.Values("service/comp")}, []string{"a5", "a4"}},
+		{storage.Filter{ObserverType: storage.Values("service")}, []string{"a6", "a5", "a4", "a3", "a2", "a1"}},
+		// InitiatorAddress matches addresses exactly, or IPv4 CIDR ranges
+		{storage.Filter{InitiatorAddress: storage.Values("10.0.0.1")}, []string{"a2", "a1"}},
+		{storage.Filter{InitiatorAddress: storage.Values("10.0.0.1/32")}, []string{"a2", "a1"}},
+		{storage.Filter{InitiatorAddress: storage.Values("10.0.0.0/24")}, []string{"a6", "a2", "a1"}},
+		{storage.Filter{InitiatorAddress: storage.Values("10.0.0.0/25")}, []string{"a2", "a1"}},
+		{storage.Filter{InitiatorAddress: storage.Values("10.0.0.128/25")}, []string{"a6"}},
+		{storage.Filter{InitiatorAddress: storage.Values("10.0.0.0/23")}, []string{"a6", "a5", "a4", "a2", "a1"}},
+		{storage.Filter{InitiatorAddress: storage.Values("10.0.0.0/8")}, []string{"a6", "a5", "a4", "a2", "a1"}},
+		{storage.Filter{InitiatorAddress: storage.Values("192.0.0.0/2")}, []string{"a3"}},
+		{storage.Filter{InitiatorAddress: storage.Values("0.0.0.0/0")}, []string{"a6", "a5", "a4", "a3", "a2", "a1"}},
+		// Several values match alternatively, and events that match an excluded value are
+		// left out, but not events without the field
+		{storage.Filter{EventType: storage.Values("identity.project.created", "identity.project.deleted")}, []string{"a2", "a1"}},
+		{storage.Filter{Source: storage.Values("identity", "dns")}, []string{"a6", "a3", "a2", "a1"}},
+		{storage.Filter{ResourceId: storage.Values("server-1", "zone-1")}, []string{"a6", "a5", "a4"}},
+		{storage.Filter{InitiatorAddress: storage.Values("10.0.0.1", "192.168.0.0/16")}, []string{"a3", "a2", "a1"}},
+		{storage.Filter{EventType: storage.ValueFilter{Exclude: []string{"identity"}}}, []string{"a6", "a5", "a4"}},
+		{storage.Filter{Action: storage.ValueFilter{Exclude: []string{"create"}}}, []string{"a5", "a2"}},
+		{storage.Filter{Outcome: storage.ValueFilter{Exclude: []string{"failure"}}}, []string{"a6", "a4", "a3", "a2", "a1"}},
+		{storage.Filter{InitiatorAddress: storage.ValueFilter{Exclude: []string{"10.0.0.0/24"}}}, []string{"a5", "a4", "a3"}},
+		{storage.Filter{InitiatorDomainId: storage.ValueFilter{Exclude: []string{DomainC}}}, []string{"a6", "a5", "a4", "a3", "a2", "a1"}},
+		{storage.Filter{EventType: storage.ValueFilter{Include: []string{"compute"}, Exclude: []string{"compute.instance.delete"}}}, []string{"a4"}},
+		// Values with "*" match the whole value, respecting case
+		{storage.Filter{EventType: storage.Values("*.created")}, []string{"a3", "a1"}},
+		{storage.Filter{EventType: storage.Values("*.CREATED")}, []string{}},
+		{storage.Filter{EventType: storage.ValueFilter{Exclude: []string{"*.end"}}}, []string{"a6", "a3", "a2", "a1"}},
+		{storage.Filter{ResourceType: storage.Values("compute/*")}, []string{"a5", "a4"}},
+		{storage.Filter{InitiatorAddress: storage.Values("10.0.*")}, []string{"a6", "a5", "a4", "a2", "a1"}},
+		{storage.Filter{UserId: storage.ValueFilter{Include: []string{"user-*"}, Exclude: []string{"user-b"}}}, []string{"a6", "a3", "a2", "a1"}},
+		// All filters are combined
+		{storage.Filter{Source: storage.Values("compute"), UserId: storage.Values("user-bob"), EventType: storage.Values("compute.instance.delete")}, []string{"a5"}},
+	}
+	for _, test := range tests {
+		actual := getKeys(t, s, test.filter, ProjectA)
+		assert.Equal(t, test.expected, actual, fmt.Sprintf("%+v", test.filter))
+	}
+
+	_, err := s.GetEvents(&storage.Filter{Limit: 10, Time: map[string]string{"gt": "yesterday"}}, ProjectA)
+	assert.NotNil(t, err, "invalid times are rejected")
+
+	filter := storage.Filter{InitiatorAddress: storage.Values("2001:db8::1")}
+	assert.Equal(t, []string{"b2", "b1"}, getKeys(t, s, filter, ProjectB))
+	filter = storage.Filter{InitiatorDomainId: storage.Values(DomainC)}
+	assert.Equal(t, []string{"c1"}, getKeys(t, s, filter, DomainC))
+	for _, address := range []string{"10.0.0.256", "10.0.0.0/33", "2001:db8::/32", "localhost"} {
+		_, err = s.GetEvents(&storage.Filter{Limit: 10, InitiatorAddress: storage.Values(address)}, ProjectA)
+		assert.NotNil(t, err, "invalid address %s is rejected", address)
+	}
+	_, err = s.GetEvents(&storage.Filter{Limit: 10, InitiatorAddress: storage.ValueFilter{Exclude: []string{"localhost"}}}, ProjectA)
+	assert.NotNil(t, err, "invalid excluded addresses are rejected")
+}
+
+func checkQuery(t *testing.T, s storage.Storage) {
+	eventType := func(value string) storage.QueryMatch {
+		return storage.QueryMatch{Field: "event_type", Value: value}
+	}
+	tests := []struct {
+		query    storage.Query
+		expected []string
+	}{
+		// Field values match exactly, respecting case
+		{eventType("identity.project.created"), []string{"a1"}},
+		{eventType("identity.project"), []string{}},
+		{storage.QueryMatch{Field: "outcome", Value: "SUCCESS"}, []string{}},
+		{storage.QueryMatch{Field: "target.typeURI", Value: "data/security/project"}, []string{"a2", "a1"}},
+		// unless they contain wildcards
+		{storage.QueryMatch{Field: "target.id", Value: "server-*", Wildcard: true}, []string{"a5", "a4"}},
+		{storage.QueryMatch{Field: "event_type", Value: "compute.*.end", Wildcard: true}, []string{"a5", "a4"}},
+		{storage.QueryMatch{Field: "event_type", Value: "*.created", Wildcard: true}, []string{"a3", "a1"}},
+		{storage.QueryMatch{Field: "event_type", Value: "compute.?nstance*", Wildcard: true}, []string{}},
+		// Negations also match events without the field
+		{storage.QueryNot{Operand: storage.QueryMatch{Field: "initiator.user_id", Value: "user-bob"}}, []string{"a6", "a3", "a2", "a1"}},
+		{storage.QueryNot{Operand: storage.QueryMatch{Field: "initiator.domain_id", Value: DomainC}}, []string{"a6", "a5", "a4", "a3", "a2", "a1"}},
+		{storage.QueryOr{eventType("dns.zone.create"), storage.QueryMatch{Field: "target.id", Value: "proj-1"}}, []string{"a6", "a2", "a1"}},
+		{storage.QueryAnd{
+			storage.QueryOr{storage.QueryMatch{Field: "target.id", Value: "server-1"}, storage.QueryMatch{Field: "target.id", Value: "zone-1"}},
+			storage.QueryNot{Operand: eventType("compute.instance.delete.end")},
+		}, []string{"a6", "a4"}},
+		// Text is searched in all fields, ignoring case
+		{storage.QueryText{Text: "Alice"}, []string{"a2", "a1"}},
+		{storage.QueryText{Text: "security project"}, []string{"a2", "a1"}},
+		{storage.QueryText{Text: "zone-1"}, []string{"a6"}},
+	}
+	for _, test := range tests {
+		actual := getKeys(t, s, storage.Filter{Query: test.query}, ProjectA)
+		assert.Equal(t, test.expected, actual, fmt.Sprintf("%+v", test.query))
+	}
+
+	// The query is combined with the other filters
+	filter := storage.Filter{Source: storage.Values("compute"), Query: storage.QueryNot{Operand: eventType("compute.instance.create.end")}}
+	assert.Equal(t, []string{"a5"}, getKeys(t, s, filter, ProjectA))
+}
+
+func checkSort(t *testing.T, s storage.Storage) {
+	tests := []struct {
+		sort     []storage.FieldOrder
+		expected []string
+	}{
+		// By default, the newest events come first
+		{nil, []string{"a6", "a5", "a4", "a3", "a2", "a1"}},
+		{[]storage.FieldOrder{{Fieldname: "time", Order: "asc"}}, []string{"a1", "a2", "a3", "a4", "a5", "a6"}},
+		{[]storage.FieldOrder{{Fieldname: "time", Order: "desc"}}, []string{"a6", "a5", "a4", "a3", "a2", "a1"}},
+		{[]storage.FieldOrder{{Fieldname: "event_type", Order: "asc"}}, []string{"a4", "a5", "a6", "a1", "a2", "a3"}},
+		{[]storage.FieldOrder{{Fieldname: "event_type", Order: "desc"}}, []string{"a3", "a2", "a1", "a6", "a5", "a4"}},
+		// Ties are broken by the default order
+		{[]storage.FieldOrder{{Fieldname: "resource_name", Order: "asc"}}, []string{"a2", "a1", "a5", "a4", "a3", "a6"}},
+		{[]storage.FieldOrder{{Fieldname: "resource_type", Order: "asc"}}, []string{"a5", "a4", "a3", "a2", "a1", "a6"}},
+		{[]storage.FieldOrder{{Fieldname: "source", Order: "desc"}}, []string{"a3", "a2", "a1", "a6", "a5", "a4"}},
+		{[]storage.FieldOrder{{Fieldname: "source", Order: "asc"}, {Fieldname: "time", Order: "asc"}}, []string{"a4", "a5", "a6", "a1", "a2", "a3"}},
+	}
+	for _, test := range tests {
+		actual := getKeys(t, s, storage.Filter{Sort: test.sort}, ProjectA)
+		assert.Equal(t, test.expected, actual, fmt.Sprintf("%+v", test.sort))
+	}
+}
+
+func checkPaging(t *testing.T, s storage.Storage) {
+	all := getKeys(t, s, storage.Filter{}, "")
+	require.Equal(t, 9, len(all))
+
+	// Paging with offsets
+	var paged []string
+	for offset := uint(0); offset < 9; offset += 4 {
+		page, err := s.GetEvents(&storage.Filter{Offset: offset, Limit: 4}, "")
+		require.Nil(t, err)
+		assert.Equal(t, 9, page.Total, "offset %d", offset)
+		paged = append(paged, keys(page)...)
+		if offset+4 < 9 {
+			assert.NotNil(t, page.Next, "offset %d", offset)
+		} else {
+			assert.Nil(t, page.Next, "offset %d", offset)
+		}
+	}
+	assert.Equal(t, all, paged)
+
+	page, err := s.GetEvents(&storage.Filter{Offset: 20, Limit: 4}, "")
+	require.Nil(t, err)
+	assert.Equal(t, 9, page.Total)
+	assert.Empty(t, page.Events)
+	assert.Nil(t, page.Next)
+
+	// Paging with cursors, also with a non-default sort order
+	for _, sort := range [][]storage.FieldOrder{nil, {{Fieldname: "event_type", Order: "asc"}}} {
+		all = getKeys(t, s, storage.Filter{Sort: sort}, "")
+		paged = nil
+		filter := storage.Filter{Limit: 2, Sort: sort}
+		for i := 0; i < 10; i++ {
+			page, err := s.GetEvents(&filter, "")
+			require.Nil(t, err)
+			assert.Equal(t, 9, page.Total)
+			paged = append(paged, keys(page)...)
+			if page.Next == nil {
+				break
+			}
+			filter.Cursor = page.Next
+		}
+		assert.Equal(t, all, paged, fmt.Sprintf("%+v", sort))
+	}
+}
+
+func checkAttributes(t *testing.T, s storage.Storage) {
+	tests := []struct {
+		attribute string
+		filter    storage.Filter
+		tenantId  string
+		limit     uint
+		expected  []string
+	}{
+		// The most frequent values come first, ties are ordered by value
+		{"event_type", storage.Filter{}, "", 10, []string{
+			"compute.instance.create.end:2", "identity.project.created:2", "compute.instance.delete.end:1", "dns.zone.create:1",
+			"identity.domain.updated:1", "identity.project.deleted:1", "identity.role_assignment.created:1",
+		}},
+		// Sources are derived from the event types, whose counts are added up
+		{"source", storage.Filter{}, ProjectA, 10, []string{"identity:3", "compute:2", "dns:1"}},
+		{"source", storage.Filter{}, ProjectA, 1, []string{"identity:3"}},
+		{"resource_type", storage.Filter{}, ProjectB, 10, []string{"compute/server:1", "data/security/project:1"}},
+		{"resource_name", storage.Filter{}, DomainC, 10, []string{"domain-c:1"}},
+		{"event_type", storage.Filter{}, "project-x", 10, []string{}},
+		{"initiator.user_id", storage.Filter{}, "", 2, []string{"user-admin:2", "user-alice:2"}},
+		// Only the events matching the filter are counted
+		{"outcome", storage.Filter{EventType: storage.Values("compute")}, ProjectA, 10, []string{"failure:1", "success:1"}},
+		{"event_type", storage.Filter{Time: map[string]string{"gte": "2017-05-02T00:00:00"}}, ProjectA, 10, []string{
+			"compute.instance.create.end:1", "compute.instance.delete.end:1", "dns.zone.create:1",
+		}},
+		{"target.id", storage.Filter{IncludeTenants: []string{ProjectB}, Source: storage.Values("compute")}, ProjectA, 10, []string{"server-1:2", "server-2:1"}},
+	}
+	for _, test := range tests {
+		values, err := s.GetAttributes(&test.filter, test.tenantId, test.attribute, test.limit)
+		require.Nil(t, err)
+		assert.Equal(t, test.expected, attributeValues(values), "%s of tenant \"%s\" with %+v", test.attribute, test.tenantId, test.filter)
+	}
+
+	// Only the AttributeFields can be counted
+	_, err := s.GetAttributes(&storage.Filter{}, ProjectA, "payload.target.id", 10)
+	assert.NotNil(t, err)
+	_, err = s.GetAttributes(&storage.Filter{}, ProjectA, "event_type", storage.MaxAttributeLimit+1)
+	assert.NotNil(t, err)
+}
+
+// attributeValues formats attribute values as "value:count" for comparison.
+func attributeValues(values storage.AttributeValueList) []string {
+	result := []string{}
+	for _, v := range values {
+		result = append(result, fmt.Sprintf("%s:%d", v.Value, v.Count))
+	}
+	return result
+}
+
+func checkFacets(t *testing.T, s storage.Storage) {
+	// Facets count all matching events, not only those on the page
+	filter := storage.Filter{
+		Source: storage.Values("identity"), Limit: 1,
+		Facets: []string{"event_type", "source", "initiator.user_id"}, FacetLimit: 2,
+	}
+	page, err := s.GetEvents(&filter, ProjectA)
+	require.Nil(t, err)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, 1, len(page.Events))
+	assert.Equal(t, map[string][]string{
+		"event_type":        {"identity.project.created:1", "identity.project.deleted:1"},
+		"source":            {"identity:3"},
+		"initiator.user_id": {"user-alice:2", "user-admin:1"},
+	}, facets(page))
+
+	// The facets stay the same on all pages
+	filter.Cursor = page.Next
+	page, err = s.GetEvents(&filter, ProjectA)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"user-alice:2", "user-admin:1"}, facets(page)["initiator.user_id"])
+
+	filter = storage.Filter{Outcome: storage.Values("failure"), Limit: 10, Facets: []string{"outcome", "resource_type"}, FacetLimit: 10}
+	page, err = s.GetEvents(&filter, "")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a5"}, keys(page))
+	assert.Equal(t, map[string][]string{"outcome": {"failure:1"}, "resource_type": {"compute/server:1"}}, facets(page))
+
+	// Without events, the facets have no values
+	filter = storage.Filter{Limit: 10, Facets: []string{"action"}, FacetLimit: 10}
+	page, err = s.GetEvents(&filter, "project-x")
+	require.Nil(t, err)
+	assert.Equal(t, map[string][]string{"action": {}}, facets(page))
+
+	// Without facets, there are none in the page
+	page, err = s.GetEvents(&storage.Filter{Limit: 10}, ProjectA)
+	require.Nil(t, err)
+	assert.Nil(t, page.Facets)
+
+	// Only the AttributeFields can be facets
+	_, err = s.GetEvents(&storage.Filter{Limit: 10, Facets: []string{"payload.action"}, FacetLimit: 10}, ProjectA)
+	assert.NotNil(t, err)
+	_, err = s.GetEvents(&storage.Filter{Limit: 10, Facets: []string{"action"}}, ProjectA)
+	assert.NotNil(t, err)
+}
+
+// facets formats the facets of a page like attributeValues.
+func facets(page *storage.EventPage) map[string][]string {
+	result := make(map[string][]string)
+	for facet, values := range page.Facets {
+		result[facet] = attributeValues(values)
+	}
+	return result
+}
+
+// histogram describes the buckets of a histogram as "start count" or "start count value:count ...",
+// with the start in UTC, so that the expected buckets are easy to read.
+func histogram(buckets []storage.HistogramBucket) []string {
+	result := []string{}
+	for _, b := range buckets {
+		result = append(result, fmt.Sprintf("%s %d", b.Time.UTC().Format("01-02T15:04"), b.Count)+splitCounts(b.Counts))
+	}
+	return result
+}
+
+// splitCounts formats the counts of a HistogramBucket or TopValue, ordered by value.
+func splitCounts(counts map[string]int) string {
+	var values []string
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	result := ""
+	for _, value := range values {
+		result += fmt.Sprintf(" %s:%d", value, counts[value])
+	}
+	return result
+}
+
+func checkHistogram(t *testing.T, s storage.Storage) {
+	tests := []struct {
+		filter   storage.Filter
+		tenantId string
+		interval time.Duration
+		splitBy  string
+		expected []string
+	}{
+		// Only buckets with events are returned, in ascending order
+		{storage.Filter{}, ProjectA, 24 * time.Hour, "", []string{"05-01T00:00 3", "05-02T00:00 2", "05-03T00:00 1"}},
+		{storage.Filter{}, ProjectA, 24 * time.Hour, "outcome", []string{
+			"05-01T00:00 3 success:3", "05-02T00:00 2 failure:1 success:1", "05-03T00:00 1 success:1",
+		}},
+		// Buckets start at multiples of the interval, and the filter applies
+		{storage.Filter{Time: map[string]string{"gte": "2017-05-01T09:00:00", "lt": "2017-05-01T12:00:00"}}, "", 2 * time.Hour, "event_type", []string{
+			"05-01T08:00 1 identity.domain.updated:1", "05-01T10:00 3 identity.project.created:2 identity.project.deleted:1",
+		}},
+		{storage.Filter{EventType: storage.Values("compute")}, ProjectA, 30 * time.Minute, "", []string{"05-02T08:00 1", "05-02T09:00 1"}},
+		{storage.Filter{IncludeTenants: []string{ProjectB}, EventType: storage.Values("compute")}, ProjectA, time.Hour, "outcome", []string{
+			"05-02T08:00 2 success:2", "05-02T09:00 1 failure:1",
+		}},
+		{storage.Filter{}, "project-x", time.Hour, "", []string{}},
+	}
+	for _, test := range tests {
+		buckets, err := s.GetHistogram(&test.filter, test.tenantId, test.interval, test.splitBy)
+		require.Nil(t, err)
+		assert.Equal(t, test.expected, histogram(buckets), "%+v by %s of tenant \"%s\"", test.filter, test.interval, test.tenantId)
+	}
+
+	_, err := s.GetHistogram(&storage.Filter{}, ProjectA, 0, "")
+	assert.NotNil(t, err)
+}
+
+// topValues formats the result of GetTop for comparison.
+func topValues(values []storage.TopValue) []string {
+	result := []string{}
+	for _, v := range values {
+		result = append(result, fmt.Sprintf("%s %d", v.Value, v.Count)+splitCounts(v.Counts))
+	}
+	return result
+}
+
+func checkTop(t *testing.T, s storage.Storage) {
+	tests := []struct {
+		field    string
+		filter   storage.Filter
+		tenantId string
+		limit    uint
+		splitBy  string
+		expected []string
+	}{
+		// The most frequent values come first, ties are ordered by value
+		{"action", storage.Filter{}, "", 10, "", []string{"create 6", "delete 2", "update 1"}},
+		{"initiator.user_id", storage.Filter{}, ProjectA, 2, "", []string{"user-alice 2", "user-bob 2"}},
+		{"initiator.host.address", storage.Filter{}, "", 3, "", []string{"10.0.0.1 2", "10.0.1.2 2", "192.168.0.1 2"}},
+		// The counts can be split by outcome
+		{"action", storage.Filter{}, ProjectA, 10, "outcome", []string{"create 4 success:4", "delete 2 failure:1 success:1"}},
+		// Only the events matching the filter are counted
+		{"target.id", storage.Filter{IncludeTenants: []string{ProjectB}, Source: storage.Values("compute")}, ProjectA, 10, "outcome", []string{
+			"server-1 2 failure:1 success:1", "server-2 1 success:1",
+		}},
+		{"initiator.user_id", storage.Filter{Time: map[string]string{"gte": "2017-05-02T00:00:00"}}, ProjectA, 10, "", []string{"user-bob 2", "user-carol 1"}},
+		{"action", storage.Filter{}, "project-x", 10, "outcome", []string{}},
+	}
+	for _, test := range tests {
+		values, err := s.GetTop(&test.filter, test.tenantId, test.field, test.limit, test.splitBy)
+		require.Nil(t, err)
+		assert.Equal(t, test.expected, topValues(values), "%s of tenant \"%s\" with %+v", test.field, test.tenantId, test.filter)
+	}
+
+	// Only the TopFields can be ranked
+	_, err := s.GetTop(&storage.Filter{}, ProjectA, "event_type", 10, "")
+	assert.NotNil(t, err)
+	_, err = s.GetTop(&storage.Filter{}, ProjectA, "action", storage.MaxTopLimit+1, "")
+	assert.NotNil(t, err)
+}
+
+func checkWrite(t *testing.T, s storage.Storage) {
+	// Writing an event again replaces it
+	event := corpus[0].event()
+	event.Payload.Outcome = "failure"
+	require.Nil(t, s.WriteEvents([]storage.TenantEvent{{TenantID: ProjectA, Event: event}}))
+	page, err := s.GetEvents(&storage.Filter{Limit: 10}, ProjectA)
+	require.Nil(t, err)
+	assert.Equal(t, 6, page.Total)
+	stored, err := s.GetEvent("msg-a1", ProjectA)
+	require.Nil(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, "failure", stored.Payload.Outcome)
+
+	// The storage keeps its own copy of the event
+	event.Payload.Outcome = "pending"
+	stored, err = s.GetEvent("msg-a1", ProjectA)
+	require.Nil(t, err)
+	assert.Equal(t, "failure", stored.Payload.Outcome)
+
+	// Invalid events are rejected individually
+	valid := corpusEvent{"a7", ProjectA, "identity.project.updated", "identity.keystone-1", "data/security/project", "proj-1", "user-alice", "2017-05-04T10:00:00.000000+0000"}.event()
+	invalid := corpusEvent{"", ProjectA, "identity.project.updated", "identity.keystone-1", "data/security/project", "proj-1", "user-alice", "2017-05-04T11:00:00.000000+0000"}.event()
+	// the time decides where the event is stored, so it cannot be replaced by the current time
+	invalidTime := corpusEvent{"a8", ProjectA, "identity.project.updated", "identity.keystone-1", "data/security/project", "proj-1", "user-alice", "yesterday"}.event()
+	err = s.WriteEvents([]storage.TenantEvent{{TenantID: ProjectA, Event: invalid}, {TenantID: ProjectA, Event: valid}, {TenantID: ProjectA, Event: invalidTime}})
+	require.IsType(t, storage.BulkError{}, err)
+	bulkErr := err.(storage.BulkError)
+	assert.Equal(t, 3, bulkErr.Total)
+	require.Equal(t, 2, len(bulkErr.Items))
+	for _, i := range []int{0, 2} {
+		assert.Equal(t, 400, bulkErr.Items[i].Status)
+		assert.False(t, bulkErr.Items[i].Retryable())
+	}
+	stored, err = s.GetEvent("msg-a7", ProjectA)
+	require.Nil(t, err)
+	assert.NotNil(t, stored)
+	stored, err = s.GetEvent("msg-a8", ProjectA)
+	require.Nil(t, err)
+	assert.Nil(t, stored)
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The shared behavior of all drivers is checked by the storagetest package. The
+// helpers in this file are for the tests of driver-specific behavior.
+
+// testEvent builds an event with the given IDs and a time on 2017-05-02.
+func testEvent(id, eventType, targetType, eventTime string) *EventDetail {
+	var event EventDetail
+	event.EventType = eventType
+	event.PublisherID = "identity.keystone-2031324599-gujvn"
+	event.MessageID = "msg-" + id
+	event.Payload.ID = id
+	event.Payload.EventTime = "2017-05-02T" + eventTime + ".000000+0000"
+	event.Payload.Target.TypeURI = targetType
+	event.Payload.Target.ID = "target-" + id
+	event.Payload.Initiator.UserID = "user-" + id
+	return &event
+}
+
+// writeTestEvents writes three events for tenant1 and one for tenant2.
+func writeTestEvents(t *testing.T, m Storage) {
+	err := m.WriteEvents([]TenantEvent{
+		{TenantID: "tenant1", Event: testEvent("a", "identity.project.deleted", "data/security/project", "12:00:00")},
+		{TenantID: "tenant1", Event: testEvent("b", "identity.role_assignment.created", "data/security/account/user", "11:00:00")},
+		{TenantID: "tenant1", Event: testEvent("c", "compute.instance.create.end", "compute/server", "13:00:00")},
+		{TenantID: "tenant2", Event: testEvent("d", "identity.project.created", "data/security/project", "10:00:00")},
+	})
+	require.Nil(t, err)
+}
+
+func eventIds(page *EventPage) []string {
+	var ids []string
+	for _, event := range page.Events {
+		ids = append(ids, event.Payload.ID)
+	}
+	return ids
+}